@@ -0,0 +1,65 @@
+package authentication
+
+import (
+	"context"
+)
+
+// Actor is a party acting on behalf of the subject of a token, as described by the
+// RFC 8693 "act" and "may_act" claims, e.g. support staff impersonating a user.
+type Actor struct {
+	Subject string
+	Issuer  string
+
+	// Actor is the party that acted before this one in a delegation chain, or nil.
+	Actor *Actor
+}
+
+// ActorFromCtx returns the actor of the token authenticated by the Authenticate
+// middleware, from its "act" claim. The token subject remains the effective subject,
+// the one role checks apply to, see EffectiveSubjectFromCtx.
+func ActorFromCtx(ctx context.Context) (Actor, bool) {
+	return actorClaim(ctx, "act")
+}
+
+// MayActFromCtx returns the party the "may_act" claim of the authenticated token
+// authorizes to act on behalf of its subject.
+func MayActFromCtx(ctx context.Context) (Actor, bool) {
+	return actorClaim(ctx, "may_act")
+}
+
+// EffectiveSubjectFromCtx returns the subject the authenticated token acts for, its
+// "sub" or else "uid" claim, whether or not an actor acts on its behalf.
+func EffectiveSubjectFromCtx(ctx context.Context) string {
+	c, _ := appClaimsFromCtx(ctx)
+	if c.Subject != "" {
+		return c.Subject
+	}
+	return c.UserID
+}
+
+func actorClaim(ctx context.Context, name string) (Actor, bool) {
+	c, ok := appClaimsFromCtx(ctx)
+	if !ok {
+		return Actor{}, false
+	}
+	act := parseActor(c.custom[name])
+	if act == nil {
+		return Actor{}, false
+	}
+	return *act, true
+}
+
+// parseActor parses an actor claim, an object with a "sub" member and, for delegation
+// chains, an "act" member of its own.
+func parseActor(v interface{}) *Actor {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	sub, ok := toString(obj["sub"])
+	if !ok || sub == "" {
+		return nil
+	}
+	iss, _ := obj["iss"].(string)
+	return &Actor{Subject: sub, Issuer: iss, Actor: parseActor(obj["act"])}
+}
@@ -0,0 +1,66 @@
+package authentication
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+)
+
+func TestActor(t *testing.T) {
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret})
+
+	var subject string
+	var actor, mayAct *Actor
+	r := chi.NewRouter()
+	r.With(ja.Verify(), ja.Authenticate, ja.RequiresRole("CUSTOMER")).Get("/", func(w http.ResponseWriter, r *http.Request) {
+		subject = EffectiveSubjectFromCtx(r.Context())
+		actor, mayAct = nil, nil
+		if a, ok := ActorFromCtx(r.Context()); ok {
+			actor = &a
+		}
+		if a, ok := MayActFromCtx(r.Context()); ok {
+			mayAct = &a
+		}
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	tests := []struct {
+		name    string
+		claims  jwt.MapClaims
+		status  int
+		subject string
+		actor   *Actor
+		mayAct  *Actor
+	}{
+		{"delegated", jwt.MapClaims{"uid": "1", "sub": "user@example.com", "roles": []string{"CUSTOMER"},
+			"act": map[string]interface{}{"sub": "admin@example.com", "iss": "https://support.example"}},
+			200, "user@example.com", &Actor{Subject: "admin@example.com", Issuer: "https://support.example"}, nil},
+		{"delegation chain", jwt.MapClaims{"uid": "1", "sub": "user@example.com", "roles": []string{"CUSTOMER"},
+			"act": map[string]interface{}{"sub": "tool", "act": map[string]interface{}{"sub": "admin@example.com"}}},
+			200, "user@example.com", &Actor{Subject: "tool", Actor: &Actor{Subject: "admin@example.com"}}, nil},
+		{"may act", jwt.MapClaims{"uid": "1", "sub": "user@example.com", "roles": []string{"CUSTOMER"},
+			"may_act": map[string]interface{}{"sub": "admin@example.com"}},
+			200, "user@example.com", nil, &Actor{Subject: "admin@example.com"}},
+		{"not delegated", jwt.MapClaims{"uid": "1", "roles": []string{"CUSTOMER"}}, 200, "1", nil, nil},
+		{"malformed actor", jwt.MapClaims{"uid": "1", "roles": []string{"CUSTOMER"}, "act": "admin"}, 200, "1", nil, nil},
+		{"roles of the actor", jwt.MapClaims{"uid": "1", "sub": "user@example.com", "roles": []string{"ADMIN"},
+			"act": map[string]interface{}{"sub": "admin@example.com"}}, 401, "", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subject, actor, mayAct = "", nil, nil
+			if status, _ := testRequest(t, ts, "GET", "/", newAuthHeader(tt.claims), nil); status != tt.status {
+				t.Fatalf("GET / = %d, want %d", status, tt.status)
+			}
+			if subject != tt.subject || !reflect.DeepEqual(actor, tt.actor) || !reflect.DeepEqual(mayAct, tt.mayAct) {
+				t.Fatalf("got subject %q, actor %+v, may act %+v, want %q, %+v, %+v", subject, actor, mayAct, tt.subject, tt.actor, tt.mayAct)
+			}
+		})
+	}
+}
@@ -1,8 +1,11 @@
 package authentication
 
 import (
+	"context"
 	"errors"
 	"net/http"
+	"net/http/httptest"
+	"testing"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
@@ -11,36 +14,207 @@ import (
 // Role defines a perticular user role
 type Role string
 
+// Middleware is a http middleware handler. Verify, RequiresRole and the method
+// values of Authenticate and Optional are all Middlewares.
+type Middleware = func(http.Handler) http.Handler
+
+// Token sources, the request locations a token string is searched in
+const (
+	TokenSourceQuery  = "query"
+	TokenSourceHeader = "header"
+	TokenSourceCookie = "cookie"
+
+	// TokenSourceForwardedAccessToken is the raw token a service mesh forwards in
+	// the X-Forwarded-Access-Token header.
+	TokenSourceForwardedAccessToken = "forwarded-access-token"
+	// TokenSourceMeshPayload is the payload of a token already verified by a service
+	// mesh, forwarded in the X-Jwt-Payload header, see WithTrustedMeshPayload.
+	TokenSourceMeshPayload = "mesh-payload"
+)
+
+// Service mesh headers read by the TokenSourceForwardedAccessToken and
+// TokenSourceMeshPayload sources.
+const (
+	ForwardedAccessTokenHeader = "X-Forwarded-Access-Token"
+	MeshPayloadHeader          = "X-Jwt-Payload"
+)
+
+// RefreshRecommendedHeader is set on responses to requests authenticated with a token
+// that expired within the expiry grace period, see WithExpiryGrace.
+const RefreshRecommendedHeader = "X-Token-Refresh-Recommended"
+
+// RefreshedTokenHeader carries the token minted by the AutoRefresh middleware.
+const RefreshedTokenHeader = "X-Refreshed-Token"
+
+// CSRFHeader is the request header carrying the CSRF token, see WithCSRFProtection.
+const CSRFHeader = "X-CSRF-Token"
+
+// DenyReasonHeader is the response header naming the reason a request is denied, one
+// of the ErrorCode constants, e.g. ErrorCodeRoleMissing.
+const DenyReasonHeader = "X-Auth-Deny-Reason"
+
+// AudienceMatchMode defines how the "aud" claim is matched against the accepted audiences.
+type AudienceMatchMode int
+
+// Audience match modes
+const (
+	// AudienceMatchAny accepts tokens valid for any of the accepted audiences
+	AudienceMatchAny AudienceMatchMode = iota
+	// AudienceMatchAll accepts tokens valid for every one of the accepted audiences
+	AudienceMatchAll
+)
+
+// MatchMode defines how a set of required values is matched against the token claims.
+type MatchMode int
+
+// Match modes
+const (
+	// MatchAny accepts tokens granted any of the required values
+	MatchAny MatchMode = iota
+	// MatchAll accepts tokens granted every one of the required values
+	MatchAll
+)
+
 // Library errors
 var (
 	ErrUnauthorized = errors.New("authentication: token is unauthorized")
+	ErrForbidden    = errors.New("authentication: access is forbidden")
 	ErrExpired      = errors.New("authentication: token is expired")
 	ErrNBFInvalid   = errors.New("authentication: token nbf validation failed")
 	ErrIATInvalid   = errors.New("authentication: token iat validation failed")
 	ErrNoTokenFound = errors.New("authentication: no token found")
 	ErrAlgoInvalid  = errors.New("authentication: algorithm mismatch")
+
+	ErrAudienceInvalid         = errors.New("authentication: token audience mismatch")
+	ErrTokenInDisallowedSource = errors.New("authentication: token found in a disallowed source")
+	ErrCookieSignatureInvalid  = errors.New("authentication: cookie signature mismatch")
+	ErrFingerprintMismatch     = errors.New("authentication: token fingerprint mismatch")
+	ErrIPMismatch              = errors.New("authentication: token client ip mismatch")
+	ErrBodyHashMismatch        = errors.New("authentication: token body hash mismatch")
+	ErrCSRFTokenMismatch       = errors.New("authentication: csrf token mismatch")
+	ErrKeyPEMInvalid           = errors.New("authentication: invalid PEM encoded key")
+
+	ErrTokenUseInvalid       = errors.New("authentication: token was not issued for this use")
+	ErrClaimsSchemaViolation = errors.New("authentication: token claims violate the schema")
+	ErrClaimsTooLarge        = errors.New("authentication: token claims exceed the size limits")
+
+	ErrIssuerInvalid  = errors.New("authentication: token issuer mismatch")
+	ErrInvalidSubject = errors.New("authentication: token subject is invalid")
+
+	ErrCredentialsChanged = errors.New("authentication: token issued before the subject's credentials changed")
+	ErrTokenVersionStale  = errors.New("authentication: token version is stale")
+
+	ErrMissingExpiry         = errors.New("authentication: token has no expiry")
+	ErrTokenLifetimeExceeded = errors.New("authentication: token lifetime exceeds the maximum")
+
+	ErrX5CChainInvalid = errors.New("authentication: x5c certificate chain invalid")
+
+	ErrReplay       = errors.New("authentication: token nonce already used")
+	ErrMissingNonce = errors.New("authentication: token has no nonce")
+
+	ErrTokenAlreadyUsed = errors.New("authentication: single-use token already used")
+	ErrMissingJTI       = errors.New("authentication: token has no jti")
+
+	ErrInvalidLogoutToken = errors.New("authentication: invalid back-channel logout token")
+
+	ErrTypInvalid               = errors.New("authentication: token type mismatch")
+	ErrUnsupportedCritHeader    = errors.New("authentication: token uses unsupported critical header extensions")
+	ErrUnsupportedSerialization = errors.New("authentication: token uses the unsupported JWS JSON serialization")
+
+	ErrUntrustedProxy = errors.New("authentication: forwarded headers from an untrusted source")
+
+	ErrSessionLimitExceeded = errors.New("authentication: subject has too many active sessions")
+	ErrUsageCapExceeded     = errors.New("authentication: token usage cap exceeded")
+
+	ErrHostNotAllowed = errors.New("authentication: request received on a host or scheme not allowed")
+
+	ErrInvalidRedirect = errors.New("authentication: redirect is not a local path")
+
+	ErrBodyTooLarge = errors.New("authentication: request body exceeds the size limit")
+
+	// The unavailable errors are system errors, see IsSystemError.
+	ErrKeyUnavailable          = errors.New("authentication: signing key unavailable")
+	ErrRolesUnavailable        = errors.New("authentication: subject roles unavailable")
+	ErrTokenVersionUnavailable = errors.New("authentication: subject token version unavailable")
+	ErrCredentialsUnavailable  = errors.New("authentication: subject credentials change unavailable")
+	ErrSessionsUnavailable     = errors.New("authentication: subject sessions unavailable")
+	ErrUsageUnavailable        = errors.New("authentication: token usage unavailable")
 )
 
+// systemErrors lists the errors caused by the verifier rather than by the token.
+var systemErrors = []error{
+	ErrKeyUnavailable,
+	ErrRolesUnavailable,
+	ErrTokenVersionUnavailable,
+	ErrCredentialsUnavailable,
+	ErrSessionsUnavailable,
+	ErrUsageUnavailable,
+}
+
+// IsSystemError reports whether err is caused by the verifier itself, e.g. a
+// key that can't be resolved, rather than by a missing, expired or invalid token.
+func IsSystemError(err error) bool {
+	for _, e := range systemErrors {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
 // JWTAuth implements the JWTAuth methods
 type JWTAuth interface {
+	// Validate and Warmup check the configuration, call them before serving
+	Validate() error
+	Warmup(ctx context.Context) error
+	Reconfigure(config Config) error
+
 	// Functions to create JWTs
 	GenTokenPair(accessClaims *AppClaims, refreshClaims *RefreshClaims) (string, string, error)
 	CreateJWT(c *AppClaims) (string, error)
 	CreateRefreshJWT(c *RefreshClaims) (string, error)
+	CreateDeepLinkJWT(link DeepLink) (string, error)
 
 	// Middlewares for validating JWT tokens
 	Authenticate(next http.Handler) http.Handler
-	Verify() func(http.Handler) http.Handler
-	RequiresRole(role Role) func(next http.Handler) http.Handler
+	ForceAuthenticate(next http.Handler) http.Handler
+	Optional(next http.Handler) http.Handler
+	Verify() Middleware
+	RequiresRole(role Role) Middleware
+	AutoRefresh(within time.Duration) Middleware
+	RequiresTokenUse(use string) Middleware
+	RequiresFeature(feature string) Middleware
+	RequiresScope(scope string) Middleware
+	RequiresScopes(mode MatchMode, scopes ...string) Middleware
+	RequiresSubjectMatch(extract func(r *http.Request) (string, error)) Middleware
+	RequiresAuthorizedParty(azp ...string) Middleware
+	RequiresMatchingRequest() Middleware
+	RequiresRegion(region string) Middleware
+	RequiresSingleUse(store UsedTokenStore) Middleware
+	Builder() *ChainBuilder
+	CapDeadlineToExpiry() Middleware
+	WrapHandlerFunc(fn http.HandlerFunc, roles ...Role) http.HandlerFunc
+	DeepLinkHandler() http.Handler
+
+	// Functions to read the verified claims from the request context
+	FullClaims(ctx context.Context) (jwt.MapClaims, error)
+	ClaimsInto(ctx context.Context, v interface{}) error
 
 	// Functions to extract tokens from http request
 	TokenFromCookie(r *http.Request) string
 	TokenFromHeader(r *http.Request) string
 	TokenFromQuery(r *http.Request) string
+	TokenSources() []string
+
+	// Functions to write tokens to http responses
+	SetTokenCookie(w http.ResponseWriter, tokenString string)
 
 	// Functions to encode and decode tokens
 	Encode(claims jwt.Claims) (t *jwt.Token, tokenString string, err error)
 	Decode(tokenString string) (t *jwt.Token, err error)
+	Parse(tokenString string) (AppClaims, error)
+	VerifyLogoutToken(tokenStr string) (LogoutClaims, error)
+	ValidateFrom(ctx context.Context, extractor TokenExtractor) (*jwt.Token, error)
 
 	// Utility functions for setting token expiry
 	ExpireIn(tm time.Duration) int64
@@ -48,15 +222,18 @@ type JWTAuth interface {
 	SetIssuedNow(claims jwt.MapClaims)
 	SetExpiry(claims jwt.MapClaims, tm time.Time)
 	SetExpiryIn(claims jwt.MapClaims, tm time.Duration)
+
+	// Functions for testing protected handlers
+	TestRoundTrip(t testing.TB, claims *AppClaims, req *http.Request, h http.Handler) *httptest.ResponseRecorder
 }
 
 // Config holds the configuration for the jwtauth
 type Config struct {
 	// Algorithm to be used for for signing and validating JWT token
 	JwtAuthAlgo string `json:"jwtAuthAlgo"`
-	// JWT token expiry duration
+	// JWT token expiry duration, in JSON a number of nanoseconds or a string like "15m"
 	JwtExpiry time.Duration `json:"jwtExpiry"`
-	// Refresh token expiry duration
+	// Refresh token expiry duration, in JSON like JwtExpiry
 	JwtRefreshExpiry time.Duration `json:"jwtRefreshExpiry"`
 	// Private key used for generating JWT token
 	SignKey interface{} `json:"signKey"`
@@ -64,6 +241,23 @@ type Config struct {
 	VerifyKey interface{} `json:"verifyKey"`
 	// Custom JWT Parser *jwt.Parser is custom parser settings introduced in jwt-go/v2.4.0.
 	JwtParser *jwt.Parser `json:"jwtParser"`
+	// HMAC secret used for generating and validating JWT token, read by NewFromConfig
+	Secret string `json:"secret"`
+	// PEM encoded RSA or ECDSA private key used for generating JWT token, read by NewFromConfig
+	SignKeyPEM string `json:"signKeyPEM"`
+	// PEM encoded RSA or ECDSA public key used to validate the JWT token, read by NewFromConfig
+	VerifyKeyPEM string `json:"verifyKeyPEM"`
+	// Accepted token issuers, see WithIssuer
+	Issuers []string `json:"issuers"`
+	// Accepted token audiences, see WithAudience
+	Audiences []string `json:"audiences"`
+	// Clock skew tolerated validating the token times, see WithLeeway, in JSON like
+	// JwtExpiry
+	Leeway time.Duration `json:"leeway"`
+	// Name of the token cookie, see WithCookieName
+	CookieName string `json:"cookieName"`
+	// Sources tokens are read from, see WithTokenSources
+	TokenSources []string `json:"tokenSources"`
 }
 
 // AppClaims represent the claims parsed from JWT access token.
@@ -78,6 +272,12 @@ type AppClaims struct {
 	Type string `json:"type,omitempty"`
 	// Metadata associated with the account
 	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	// Warnings lists the optional claims that could not be parsed and were skipped
+	Warnings []error `json:"-"`
+	// audiences holds an "aud" claim of several audiences, see Audiences
+	audiences []string
+	// custom holds the claims not mapped onto the fields, see Principal
+	custom map[string]interface{}
 	// https://tools.ietf.org/html/rfc7519#section-4.1
 	jwt.StandardClaims
 }
@@ -0,0 +1,111 @@
+package authentication
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+)
+
+func TestAuditAccess(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+	})
+
+	var mu sync.Mutex
+	var entries []AuditEntry
+	sink := func(e AuditEntry) {
+		mu.Lock()
+		defer mu.Unlock()
+		entries = append(entries, e)
+	}
+
+	r := chi.NewRouter()
+	r.Use(TokenAuthHS256.Verify(), AuditAccess(sink), TokenAuthHS256.Authenticate)
+	r.Use(TokenAuthHS256.RequiresRole("ADMIN"))
+	r.Get("/admin", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	admin := newAuthHeader(jwt.MapClaims{"uid": "1", "sub": "admin-1", "roles": []string{"ADMIN"}})
+	user := newAuthHeader(jwt.MapClaims{"uid": "2", "sub": "user-2", "roles": []string{"USER"}})
+	testRequest(t, ts, "GET", "/admin", admin, nil)
+	testRequest(t, ts, "GET", "/admin", user, nil)
+	testRequest(t, ts, "GET", "/admin", nil, nil)
+
+	want := []struct {
+		subject string
+		source  string
+		outcome AuditOutcome
+	}{
+		{"admin-1", TokenSourceHeader, AuditAllowed},
+		{"user-2", TokenSourceHeader, AuditDenied},
+		{"", "", AuditDenied},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d audit entries, want %d", len(entries), len(want))
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.Subject != w.subject || e.Source != w.source || e.Outcome != w.outcome || e.Method != "GET" || e.Path != "/admin" || e.Time.IsZero() {
+			t.Errorf("entry %d = %+v, want subject %q source %q outcome %q", i, e, w.subject, w.source, w.outcome)
+		}
+	}
+	if len(entries[1].Roles) != 1 || entries[1].Roles[0] != "USER" {
+		t.Errorf("entry roles = %v", entries[1].Roles)
+	}
+}
+
+func TestAuditAccessWriter(t *testing.T) {
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}, WithRolesDelimiter(" "))
+	entries := make(chan AuditEntry, 1)
+	sink := func(e AuditEntry) {
+		entries <- e
+	}
+
+	r := chi.NewRouter()
+	r.Use(ja.Verify(), AuditAccess(sink))
+	r.Get("/events", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("event"))
+		w.(http.Flusher).Flush()
+	})
+	r.Get("/socket", func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Hijack() error = %v", err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: close\r\n\r\n")
+		buf.Flush()
+	})
+
+	// The writer flushes through and the roles are split on the configured delimiter
+	req := httptest.NewRequest("GET", "/events", nil)
+	req.Header = newAuthHeader(jwt.MapClaims{"uid": "1", "sub": "admin-1", "roles": "ADMIN EDITOR"})
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	entry := <-entries
+	if !rec.Flushed || entry.Status != 200 {
+		t.Errorf("flushed = %v, status = %d, want a flushed 200", rec.Flushed, entry.Status)
+	}
+	if len(entry.Roles) != 2 || entry.Roles[0] != "ADMIN" || entry.Roles[1] != "EDITOR" {
+		t.Errorf("entry roles = %v, want [ADMIN EDITOR]", entry.Roles)
+	}
+
+	// and hijacks the connection
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	status, _ := testRequest(t, ts, "GET", "/socket", nil, nil)
+	if entry := <-entries; status != 101 || entry.Status != 101 {
+		t.Errorf("got %d, audited %d, want 101", status, entry.Status)
+	}
+}
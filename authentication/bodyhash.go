@@ -0,0 +1,87 @@
+package authentication
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// WithBodyHashBinding binds tokens carrying an "htd" or "bodyhash" claim to the request
+// they sign, e.g. webhook deliveries: the claim must equal the BodyHash of the request
+// over the given headers, or the request is rejected with ErrBodyHashMismatch. Tokens
+// without either claim are accepted. The body is buffered, so handlers still read it,
+// and bodies over the WithMaxBodySize limit are rejected with ErrBodyTooLarge.
+func WithBodyHashBinding(headers []string) Option {
+	return func(ja *jwtAuth) {
+		ja.bodyHashBinding = true
+		ja.bodyHashHeaders = headers
+	}
+}
+
+// BodyHash returns the value of the "htd" claim binding a token to r, see
+// WithBodyHashBinding: the unpadded base64url encoded SHA-256 digest of the canonical
+// request, made of the request method, the escaped path and, in order, each of the
+// headers as its lower case name, a colon and its comma separated values, all
+// terminated by a newline, followed by a newline and the body. The body is read and
+// replaced with a copy.
+func BodyHash(r *http.Request, headers []string) (string, error) {
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			return "", err
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	return hashRequest(r, headers, body), nil
+}
+
+// hashRequest returns the BodyHash of r with the given body.
+func hashRequest(r *http.Request, headers []string, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n", r.Method, r.URL.EscapedPath())
+	for _, name := range headers {
+		fmt.Fprintf(h, "%s:%s\n", strings.ToLower(name), strings.Join(r.Header[http.CanonicalHeaderKey(name)], ","))
+	}
+	h.Write([]byte("\n"))
+	h.Write(body)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// checkBodyHash verifies the request is the one the body hash claim of the token signs.
+func (ja *jwtAuth) checkBodyHash(r *http.Request, claims jwt.MapClaims) error {
+	if !ja.bodyHashBinding {
+		return nil
+	}
+	v, ok := claims["htd"]
+	if !ok {
+		if v, ok = claims["bodyhash"]; !ok {
+			return nil
+		}
+	}
+	want, _ := v.(string)
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		if body, err = readBody(nil, r, ja.maxBodySize); err == ErrBodyTooLarge {
+			return err
+		} else if err != nil {
+			return fmt.Errorf("%w: %v", ErrBodyHashMismatch, err)
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	got := hashRequest(r, ja.bodyHashHeaders, body)
+	if want == "" || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+		return ErrBodyHashMismatch
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package authentication
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestBodyHashBinding(t *testing.T) {
+	headers := []string{"Content-Type", "X-Webhook-Event"}
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}, WithBodyHashBinding(headers), WithMaxBodySize(64))
+	var received string
+	h := ja.Verify()(ja.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = string(body)
+	})))
+
+	newRequest := func(body, event string) *http.Request {
+		req := httptest.NewRequest("POST", "/hooks/orders", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Webhook-Event", event)
+		return req
+	}
+	signed := newRequest(`{"order":42}`, "order.paid")
+	htd, err := BodyHash(signed, headers)
+	if err != nil {
+		t.Fatalf("BodyHash() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		req    *http.Request
+		status int
+	}{
+		{"matching body", jwt.MapClaims{"htd": htd}, newRequest(`{"order":42}`, "order.paid"), 200},
+		{"matching bodyhash claim", jwt.MapClaims{"bodyhash": htd}, newRequest(`{"order":42}`, "order.paid"), 200},
+		{"tampered body", jwt.MapClaims{"htd": htd}, newRequest(`{"order":43}`, "order.paid"), 403},
+		{"tampered header", jwt.MapClaims{"htd": htd}, newRequest(`{"order":42}`, "order.refunded"), 403},
+		{"unbound token", jwt.MapClaims{}, newRequest(`{"order":43}`, "order.paid"), 200},
+		{"body too large", jwt.MapClaims{"htd": htd}, newRequest(`{"order":42,"padding":"`+strings.Repeat("x", 64)+`"}`, "order.paid"), 413},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := jwt.MapClaims{"uid": "1", "roles": []string{}}
+			for k, v := range tt.claims {
+				claims[k] = v
+			}
+			received = ""
+			tt.req.Header.Set("Authorization", "BEARER "+newJwtToken(TokenSecret, claims))
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, tt.req)
+			if rec.Code != tt.status {
+				t.Fatalf("got %d, want %d", rec.Code, tt.status)
+			}
+			if tt.status == 200 && !strings.HasPrefix(received, `{"order":4`) {
+				t.Fatalf("handler read body %q", received)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package authentication
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+)
+
+func TestChainBuilder(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+	})
+
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	protect := TokenAuthHS256.Builder().
+		Use(trace("first")).
+		Verify().
+		Authenticate().
+		RequireRole("ADMIN").
+		RequireScope("reports:read").
+		Use(trace("last")).
+		Build()
+
+	r := chi.NewRouter()
+	r.With(protect).Get("/reports", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		header http.Header
+		status int
+	}{
+		{"role and scope", newAuthHeader(jwt.MapClaims{"uid": "1", "roles": []string{"ADMIN"}, "scope": "reports:read reports:write"}), 200},
+		{"scp array", newAuthHeader(jwt.MapClaims{"uid": "1", "roles": []string{"ADMIN"}, "scp": []string{"reports:read"}}), 200},
+		{"missing scope", newAuthHeader(jwt.MapClaims{"uid": "1", "roles": []string{"ADMIN"}, "scope": "reports:write"}), 403},
+		{"missing role", newAuthHeader(jwt.MapClaims{"uid": "1", "roles": []string{"USER"}, "scope": "reports:read"}), 401},
+		{"no token", nil, 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, _ := testRequest(t, ts, "GET", "/reports", tt.header, nil); status != tt.status {
+				t.Fatalf("got %d, want %d", status, tt.status)
+			}
+		})
+	}
+
+	order = nil
+	testRequest(t, ts, "GET", "/reports", tests[0].header, nil)
+	if len(order) != 2 || order[0] != "first" || order[1] != "last" {
+		t.Fatalf("middlewares ran in order %v, want [first last]", order)
+	}
+}
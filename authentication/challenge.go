@@ -0,0 +1,63 @@
+package authentication
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// WithChallengeRedirect redirects browsers to the login page at loginURL instead of
+// sending them a 401 Unauthorized response: Authenticate answers requests without a
+// valid token that accept text/html with a 302 Found response to loginURL, its
+// return_to query parameter set to the path and query of the request. Other
+// requests, e.g. of API clients accepting application/json, get the ErrorHandler
+// response as before.
+func WithChallengeRedirect(loginURL string) Option {
+	return func(ja *jwtAuth) {
+		ja.challengeURL = loginURL
+	}
+}
+
+// fail rejects a request the Authenticate middleware didn't authenticate, redirecting
+// browsers to the login page if configured.
+func (ja *jwtAuth) fail(w http.ResponseWriter, r *http.Request, err error) {
+	if ja.challengeURL != "" && ErrorStatus(err) == http.StatusUnauthorized && acceptsHTML(r) {
+		if target, perr := challengeTarget(ja.challengeURL, r); perr == nil {
+			http.Redirect(w, r, target, http.StatusFound)
+			return
+		}
+	}
+	ja.errorHandler(w, r, err)
+}
+
+// challengeTarget returns loginURL with the return_to parameter pointing back at r.
+func challengeTarget(loginURL string, r *http.Request) (string, error) {
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("return_to", r.URL.RequestURI())
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// acceptsHTML reports whether the Accept header of r explicitly lists text/html,
+// wildcards aside, with a non-zero quality.
+func acceptsHTML(r *http.Request) bool {
+	for _, accept := range r.Header["Accept"] {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+			if err != nil || mediaType != "text/html" {
+				continue
+			}
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package authentication
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestChallengeRedirect(t *testing.T) {
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}, WithChallengeRedirect("https://login.example.com/start?app=admin"))
+	h := ja.Verify()(ja.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})))
+
+	tests := []struct {
+		name     string
+		accept   string
+		header   http.Header
+		status   int
+		location string
+	}{
+		{"browser", "text/html,application/xhtml+xml,*/*;q=0.8", nil, 302, "https://login.example.com/start?app=admin&return_to=%2Freports%3Fmonth%3D5"},
+		{"browser with valid token", "text/html", newAuthHeader(jwt.MapClaims{"uid": "123", "roles": []string{}}), 200, ""},
+		{"api client", "application/json", nil, 401, ""},
+		{"wildcard", "*/*", nil, 401, ""},
+		{"html refused", "application/json, text/html;q=0", nil, 401, ""},
+		{"no accept header", "", nil, 401, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/reports?month=5", nil)
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.status || rec.Header().Get("Location") != tt.location {
+				t.Fatalf("got %d %q, want %d %q", rec.Code, rec.Header().Get("Location"), tt.status, tt.location)
+			}
+		})
+	}
+}
@@ -1,23 +1,105 @@
 package authentication
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 )
 
-// ParseClaims parses JWT claims into AppClaims.
+// defaultRolesDelimiter separates the roles of a roles claim sent as a single string.
+const defaultRolesDelimiter = ","
+
+// ClaimOption sets a claim of the AppClaims built by NewAppClaims.
+type ClaimOption func(c *AppClaims)
+
+// NewAppClaims returns the AppClaims of a token for subject sub with the given roles,
+// setting both the "sub" and the "uid" claim to sub, ready to be signed with Encode
+// in the shape of ToMap. It fails for an empty subject and for claims expiring before
+// they are issued, e.g. set with a non-positive WithClaimTTL.
+func NewAppClaims(sub string, roles []Role, opts ...ClaimOption) (AppClaims, error) {
+	if sub == "" {
+		return AppClaims{}, errors.New("claims subject is empty")
+	}
+	if roles == nil {
+		roles = []Role{}
+	}
+	c := AppClaims{UserID: sub, Roles: roles}
+	c.Subject = sub
+	for _, opt := range opts {
+		opt(&c)
+	}
+	if c.ExpiresAt != 0 && c.ExpiresAt <= c.IssuedAt {
+		return AppClaims{}, errors.New("claims expire before they are issued")
+	}
+	return c, nil
+}
+
+// WithClaimAudience sets the "aud" claim.
+func WithClaimAudience(aud string) ClaimOption {
+	return func(c *AppClaims) {
+		c.Audience = aud
+	}
+}
+
+// WithClaimIssuer sets the "iss" claim.
+func WithClaimIssuer(iss string) ClaimOption {
+	return func(c *AppClaims) {
+		c.Issuer = iss
+	}
+}
+
+// WithClaimTTL sets the "iat" claim to now and the "exp" claim to now plus ttl, which
+// must be at least a second.
+func WithClaimTTL(ttl time.Duration) ClaimOption {
+	return func(c *AppClaims) {
+		now := time.Now()
+		c.IssuedAt = now.Unix()
+		c.ExpiresAt = now.Add(ttl).Unix()
+	}
+}
+
+// WithCustomClaim sets the custom claim key in Metadata.
+func WithCustomClaim(key string, value interface{}) ClaimOption {
+	return func(c *AppClaims) {
+		if c.Metadata == nil {
+			c.Metadata = map[string]interface{}{}
+		}
+		c.Metadata[key] = value
+	}
+}
+
+// ParseClaims parses JWT claims into AppClaims. A roles claim sent as a single
+// string is split on commas. Missing or malformed "uid", "roles" and registered
+// claims fail the parse, malformed optional claims are skipped and reported in
+// Warnings instead.
 func (c *AppClaims) ParseClaims(claims jwt.MapClaims) error {
+	return c.parseClaims(claims, defaultRolesDelimiter)
+}
+
+// parseClaims parses JWT claims into AppClaims, splitting a roles claim sent as a
+// single string on rolesDelimiter.
+func (c *AppClaims) parseClaims(claims jwt.MapClaims, rolesDelimiter string) error {
 	// parse UserID
 	id, ok := claims["uid"]
 	if !ok {
 		return errors.New("could not parse user id")
 	}
-	c.UserID = id.(string)
+	if c.UserID, ok = toString(id); !ok {
+		return errors.New("could not parse user id")
+	}
 
 	// Parse name
+	c.Warnings = nil
 	if name, ok := claims["name"]; ok {
-		c.Name = name.(string)
+		if c.Name, ok = toString(name); !ok {
+			c.Warnings = append(c.Warnings, errors.New("could not parse claims name"))
+		}
 	}
 
 	// parse Roles
@@ -25,48 +107,107 @@ func (c *AppClaims) ParseClaims(claims jwt.MapClaims) error {
 	if !ok {
 		return errors.New("could not parse claims roles")
 	}
-	var roles []Role
-	if rl != nil {
-		for _, v := range rl.([]Role) {
-			roles = append(roles, v)
-		}
+	roles, err := parseRoles(rl, rolesDelimiter)
+	if err != nil {
+		return err
 	}
 	c.Roles = roles
 
 	// Parse Type
 	if t, ok := claims["type"]; ok {
-		c.Type = t.(string)
+		if c.Type, ok = toString(t); !ok {
+			c.Warnings = append(c.Warnings, errors.New("could not parse claims type"))
+		}
 	}
 
 	// Parse metadata
-	if meta, ok := claims["metadata"]; ok {
-		c.Metadata = meta.(map[string]interface{})
+	if meta, ok := claims["metadata"]; ok && meta != nil {
+		if c.Metadata, ok = meta.(map[string]interface{}); !ok {
+			c.Warnings = append(c.Warnings, errors.New("could not parse claims metadata"))
+		}
 	}
 
-	// Parse standars claims
-	if aud, ok := claims["aud"]; ok {
-		c.Audience = aud.(string)
+	// Keep the audiences jwt.StandardClaims can't hold
+	c.audiences = nil
+	if list, _ := parseAudience(claims["aud"]); len(list) > 1 {
+		c.audiences = list
 	}
-	if exp, ok := claims["exp"]; ok {
-		c.ExpiresAt = exp.(int64)
+
+	// Keep the custom claims for Principal and ActorFromCtx
+	c.custom = nil
+	for k, v := range claims {
+		if !containsString(appClaimNames, k) {
+			if c.custom == nil {
+				c.custom = map[string]interface{}{}
+			}
+			c.custom[k] = v
+		}
+	}
+
+	return parseStandardClaims(&c.StandardClaims, claims)
+}
+
+// appClaimNames are the claims mapped onto the fields of AppClaims.
+var appClaimNames = []string{"uid", "name", "roles", "type", "metadata", "aud", "exp", "jti", "iat", "iss", "nbf", "sub"}
+
+// Principal is the flat representation of an authenticated account, e.g. for the
+// input of an external policy engine.
+type Principal struct {
+	// Subject of the token, the user id if the token has no "sub" claim
+	Subject string `json:"subject"`
+	// Roles of the account
+	Roles []string `json:"roles"`
+	// Scopes granted by the "scope" or "scp" claim
+	Scopes []string `json:"scopes"`
+	// Tenant of the account from the "tenant_id" or "tid" claim
+	Tenant string `json:"tenant,omitempty"`
+	// Claims holds the custom claims, those not mapped onto AppClaims or the fields above
+	Claims map[string]interface{} `json:"claims"`
+}
+
+// Principal returns the flat representation of the account, with empty slices and
+// maps rather than nil ones so that it serializes to the same JSON shape always.
+func (c AppClaims) Principal() Principal {
+	p := Principal{
+		Subject: c.Subject,
+		Roles:   make([]string, len(c.Roles)),
+		Scopes:  scopesClaim(c.custom),
+		Claims:  map[string]interface{}{},
 	}
-	if jti, ok := claims["jti"]; ok {
-		c.Id = jti.(string)
+	if p.Subject == "" {
+		p.Subject = c.UserID
 	}
-	if iat, ok := claims["iat"]; ok {
-		c.IssuedAt = iat.(int64)
+	for i, role := range c.Roles {
+		p.Roles[i] = string(role)
 	}
-	if iss, ok := claims["iss"]; ok {
-		c.Issuer = iss.(string)
+	if p.Scopes == nil {
+		p.Scopes = []string{}
 	}
-	if nbf, ok := claims["nbf"]; ok {
-		c.NotBefore = nbf.(int64)
+	for _, name := range []string{"tenant_id", "tid"} {
+		if tenant, ok := c.custom[name].(string); ok && p.Tenant == "" {
+			p.Tenant = tenant
+		}
 	}
-	if sub, ok := claims["sub"]; ok {
-		c.Subject = sub.(string)
+	for k, v := range c.custom {
+		switch k {
+		case "scope", "scp", "tenant_id", "tid":
+		default:
+			p.Claims[k] = v
+		}
 	}
+	return p
+}
 
-	return nil
+// Audiences returns the audiences of the "aud" claim, sent as a single string or an
+// array, and an empty slice when there is none.
+func (c AppClaims) Audiences() []string {
+	if len(c.audiences) > 0 {
+		return append([]string(nil), c.audiences...)
+	}
+	if c.Audience != "" {
+		return []string{c.Audience}
+	}
+	return []string{}
 }
 
 // ParseClaims parses the JWT claims into RefreshClaims.
@@ -76,48 +217,371 @@ func (c *RefreshClaims) ParseClaims(claims jwt.MapClaims) error {
 	if !ok {
 		return errors.New("could not parse user id")
 	}
-	c.UserID = id.(string)
+	if c.UserID, ok = toString(id); !ok {
+		return errors.New("could not parse user id")
+	}
 
 	// parse Roles
 	rl, ok := claims["roles"]
 	if !ok {
 		return errors.New("could not parse claims roles")
 	}
-	var roles []Role
-	if rl != nil {
-		for _, v := range rl.([]Role) {
-			roles = append(roles, v)
-		}
+	roles, err := parseRoles(rl, defaultRolesDelimiter)
+	if err != nil {
+		return err
 	}
 	c.Roles = roles
 
 	// Parse metadata
-	if meta, ok := claims["metadata"]; ok {
-		c.Metadata = meta.(map[string]interface{})
+	if meta, ok := claims["metadata"]; ok && meta != nil {
+		if c.Metadata, ok = meta.(map[string]interface{}); !ok {
+			return errors.New("could not parse claims metadata")
+		}
 	}
 
-	// Parse standars claims
-	if aud, ok := claims["aud"]; ok {
-		c.Audience = aud.(string)
+	return parseStandardClaims(&c.StandardClaims, claims)
+}
+
+// ToMap returns the claims in the shape they are encoded in a token, e.g. for a
+// "whoami" endpoint: registered time claims are unix seconds, Metadata stays nested
+// under "metadata" and the custom claims of a parsed token, those not mapped onto the
+// fields, are kept alongside. Empty optional claims are left out, "uid" and "roles"
+// are always present.
+func (c AppClaims) ToMap() map[string]interface{} {
+	roles := c.Roles
+	if roles == nil {
+		roles = []Role{}
+	}
+	m := make(map[string]interface{}, len(c.custom)+2)
+	for k, v := range c.custom {
+		m[k] = v
+	}
+	m["uid"] = c.UserID
+	m["roles"] = roles
+	if c.Name != "" {
+		m["name"] = c.Name
+	}
+	if c.Type != "" {
+		m["type"] = c.Type
+	}
+	if len(c.Metadata) > 0 {
+		m["metadata"] = c.Metadata
+	}
+	if aud := c.Audiences(); len(aud) > 1 {
+		m["aud"] = aud
+	} else if len(aud) == 1 {
+		m["aud"] = aud[0]
 	}
-	if exp, ok := claims["exp"]; ok {
-		c.ExpiresAt = exp.(int64)
+	if c.ExpiresAt != 0 {
+		m["exp"] = c.ExpiresAt
 	}
-	if jti, ok := claims["jti"]; ok {
-		c.Id = jti.(string)
+	if c.Id != "" {
+		m["jti"] = c.Id
 	}
-	if iat, ok := claims["iat"]; ok {
-		c.ExpiresAt = iat.(int64)
+	if c.IssuedAt != 0 {
+		m["iat"] = c.IssuedAt
 	}
-	if iss, ok := claims["iss"]; ok {
-		c.Issuer = iss.(string)
+	if c.Issuer != "" {
+		m["iss"] = c.Issuer
 	}
-	if nbf, ok := claims["nbf"]; ok {
-		c.ExpiresAt = nbf.(int64)
+	if c.NotBefore != 0 {
+		m["nbf"] = c.NotBefore
 	}
-	if sub, ok := claims["sub"]; ok {
-		c.Subject = sub.(string)
+	if c.Subject != "" {
+		m["sub"] = c.Subject
 	}
+	return m
+}
+
+// GetString returns the custom claim stored under key in Metadata as a string.
+// JSON numbers are returned in their textual form.
+func (c AppClaims) GetString(key string) (string, bool) {
+	v, ok := c.Metadata[key]
+	if !ok {
+		return "", false
+	}
+	return toString(v)
+}
 
+// GetInt returns the custom claim stored under key in Metadata as an int64.
+// Integral JSON numbers and numeric strings are both accepted.
+func (c AppClaims) GetInt(key string) (int64, bool) {
+	v, ok := c.Metadata[key]
+	if !ok {
+		return 0, false
+	}
+	return toInt64(v)
+}
+
+// GetBool returns the custom claim stored under key in Metadata as a bool.
+// The strings "true" and "false" are accepted as well.
+func (c AppClaims) GetBool(key string) (bool, bool) {
+	v, ok := c.Metadata[key]
+	if !ok {
+		return false, false
+	}
+	return toBool(v)
+}
+
+// GetStringSlice returns the custom claim stored under key in Metadata as a
+// string slice. Every element of the claim has to be a string.
+func (c AppClaims) GetStringSlice(key string) ([]string, bool) {
+	v, ok := c.Metadata[key]
+	if !ok {
+		return nil, false
+	}
+	return toStringSlice(v)
+}
+
+// parseClaims parses claims into c, with the configured claims root, roles delimiter
+// and issue time claim.
+func (ja *jwtAuth) parseClaims(c *AppClaims, claims jwt.MapClaims) error {
+	if err := c.parseClaims(ja.rootClaims(claims), ja.rolesDelimiter); err != nil {
+		return err
+	}
+	if ja.issuedAtClaim != "" {
+		c.IssuedAt, _ = ja.issuedAt(claims)
+	}
+	return nil
+}
+
+// topLevelClaims are the registered claims read from the top level of the token even
+// with WithClaimsRoot, as the token is validated against them.
+var topLevelClaims = []string{"exp", "nbf", "iat", "iss", "aud", "jti"}
+
+// rootClaims returns the claims AppClaims are parsed from: claims with the members of
+// the object at the claims root, if set, replacing those at the top level.
+func (ja *jwtAuth) rootClaims(claims jwt.MapClaims) jwt.MapClaims {
+	if ja.claimsRoot == "" {
+		return claims
+	}
+	var root interface{} = map[string]interface{}(claims)
+	for _, name := range strings.Split(ja.claimsRoot, ".") {
+		obj, _ := root.(map[string]interface{})
+		root = obj[name]
+	}
+	nested, ok := root.(map[string]interface{})
+	if !ok {
+		return claims
+	}
+	merged := make(jwt.MapClaims, len(claims)+len(nested))
+	for k, v := range claims {
+		merged[k] = v
+	}
+	for k, v := range nested {
+		if !containsString(topLevelClaims, k) {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// issuedAt returns the issue time of the token, read from the "iat" claim or the one
+// set with WithIssuedAtClaim.
+func (ja *jwtAuth) issuedAt(claims jwt.MapClaims) (int64, bool) {
+	if ja.issuedAtClaim == "" {
+		return toInt64(claims["iat"])
+	}
+	if ja.issuedAtLayout == "" {
+		return toInt64(claims[ja.issuedAtClaim])
+	}
+	s, ok := claims[ja.issuedAtClaim].(string)
+	if !ok {
+		return 0, false
+	}
+	t, err := time.Parse(ja.issuedAtLayout, s)
+	if err != nil {
+		return 0, false
+	}
+	return t.Unix(), true
+}
+
+// subjectClaim returns the subject of claims, the "sub" or else the "uid" claim.
+func subjectClaim(claims jwt.MapClaims) string {
+	if sub, _ := claims["sub"].(string); sub != "" {
+		return sub
+	}
+	uid, _ := toString(claims["uid"])
+	return uid
+}
+
+// parseStandardClaims parses the registered claims shared by access and refresh tokens.
+func parseStandardClaims(c *jwt.StandardClaims, claims jwt.MapClaims) error {
+	var ok bool
+	if aud, found := claims["aud"]; found {
+		list, ok := parseAudience(aud)
+		if !ok {
+			return errors.New("could not parse claims aud")
+		}
+		if len(list) == 1 {
+			c.Audience = list[0]
+		}
+	}
+	if exp, found := claims["exp"]; found {
+		if c.ExpiresAt, ok = toInt64(exp); !ok {
+			return errors.New("could not parse claims exp")
+		}
+	}
+	if jti, found := claims["jti"]; found {
+		if c.Id, ok = toString(jti); !ok {
+			return errors.New("could not parse claims jti")
+		}
+	}
+	if iat, found := claims["iat"]; found {
+		if c.IssuedAt, ok = toInt64(iat); !ok {
+			return errors.New("could not parse claims iat")
+		}
+	}
+	if iss, found := claims["iss"]; found {
+		if c.Issuer, ok = toString(iss); !ok {
+			return errors.New("could not parse claims iss")
+		}
+	}
+	if nbf, found := claims["nbf"]; found {
+		if c.NotBefore, ok = toInt64(nbf); !ok {
+			return errors.New("could not parse claims nbf")
+		}
+	}
+	if sub, found := claims["sub"]; found {
+		if c.Subject, ok = toString(sub); !ok {
+			return errors.New("could not parse claims sub")
+		}
+	}
+	return nil
+}
+
+// parseAudience converts an "aud" claim, a single string or an array, into a slice.
+func parseAudience(v interface{}) ([]string, bool) {
+	switch t := v.(type) {
+	case nil:
+		return []string{}, true
+	case string:
+		return []string{t}, true
+	}
+	return toStringSlice(v)
+}
+
+// parseRoles converts a roles claim into a slice of Role. A decoded token
+// carries the roles as []interface{}, claims built in code as []Role or []string.
+// Some issuers send a single string of roles separated by delimiter instead.
+func parseRoles(v interface{}, delimiter string) ([]Role, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if rl, ok := v.([]Role); ok {
+		return append([]Role(nil), rl...), nil
+	}
+	if str, ok := v.(string); ok {
+		var roles []Role
+		for _, r := range strings.Split(str, delimiter) {
+			if r = strings.TrimSpace(r); r != "" {
+				roles = append(roles, Role(r))
+			}
+		}
+		return roles, nil
+	}
+	list, ok := toStringSlice(v)
+	if !ok {
+		return nil, errors.New("could not parse claims roles")
+	}
+	var roles []Role
+	for _, r := range list {
+		roles = append(roles, Role(r))
+	}
+	return roles, nil
+}
+
+func toString(v interface{}) (string, bool) {
+	switch t := v.(type) {
+	case string:
+		return t, true
+	case json.Number:
+		return t.String(), true
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), true
+	case int64:
+		return strconv.FormatInt(t, 10), true
+	case int:
+		return strconv.Itoa(t), true
+	}
+	return "", false
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch t := v.(type) {
+	case int64:
+		return t, true
+	case int:
+		return int64(t), true
+	case int32:
+		return int64(t), true
+	case float64:
+		if t != math.Trunc(t) || t > math.MaxInt64 || t < math.MinInt64 {
+			return 0, false
+		}
+		return int64(t), true
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i, true
+		}
+		return toInt64(string(t))
+	case string:
+		if i, err := strconv.ParseInt(t, 10, 64); err == nil {
+			return i, true
+		}
+		if f, err := strconv.ParseFloat(t, 64); err == nil {
+			return toInt64(f)
+		}
+	}
+	return 0, false
+}
+
+func toBool(v interface{}) (bool, bool) {
+	switch t := v.(type) {
+	case bool:
+		return t, true
+	case string:
+		if b, err := strconv.ParseBool(t); err == nil {
+			return b, true
+		}
+	}
+	return false, false
+}
+
+func toStringSlice(v interface{}) ([]string, bool) {
+	switch t := v.(type) {
+	case []string:
+		return append([]string(nil), t...), true
+	case []interface{}:
+		list := make([]string, 0, len(t))
+		for _, e := range t {
+			s, ok := e.(string)
+			if !ok {
+				return nil, false
+			}
+			list = append(list, s)
+		}
+		return list, true
+	}
+	return nil, false
+}
+
+// ValidateUUID returns an error unless sub is a UUID in its canonical form, e.g.
+// "123e4567-e89b-12d3-a456-426614174000", in either case, see WithSubjectValidator.
+func ValidateUUID(sub string) error {
+	if len(sub) != 36 {
+		return fmt.Errorf("subject %q is not a UUID", sub)
+	}
+	for i, c := range sub {
+		switch {
+		case i == 8 || i == 13 || i == 18 || i == 23:
+			if c != '-' {
+				return fmt.Errorf("subject %q is not a UUID", sub)
+			}
+		case '0' <= c && c <= '9', 'a' <= c && c <= 'f', 'A' <= c && c <= 'F':
+		default:
+			return fmt.Errorf("subject %q is not a UUID", sub)
+		}
+	}
 	return nil
 }
@@ -1,6 +1,11 @@
 package authentication
 
 import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"testing"
 	"time"
 
@@ -119,3 +124,423 @@ func TestRefreshClaims_ParseClaims(t *testing.T) {
 		})
 	}
 }
+
+func TestAppClaims_Getters(t *testing.T) {
+	c := AppClaims{
+		Metadata: map[string]interface{}{
+			"plan":     "pro",
+			"seats":    float64(12),
+			"quota":    "42",
+			"frac":     1.5,
+			"beta":     true,
+			"trial":    "false",
+			"features": []interface{}{"export", "sso"},
+			"mixed":    []interface{}{"export", 1},
+		},
+	}
+
+	if v, ok := c.GetString("plan"); !ok || v != "pro" {
+		t.Errorf("GetString(plan) = %v, %v", v, ok)
+	}
+	if v, ok := c.GetString("seats"); !ok || v != "12" {
+		t.Errorf("GetString(seats) = %v, %v", v, ok)
+	}
+	if v, ok := c.GetInt("seats"); !ok || v != 12 {
+		t.Errorf("GetInt(seats) = %v, %v", v, ok)
+	}
+	if v, ok := c.GetInt("quota"); !ok || v != 42 {
+		t.Errorf("GetInt(quota) = %v, %v", v, ok)
+	}
+	if _, ok := c.GetInt("frac"); ok {
+		t.Errorf("GetInt(frac) should fail for a non integral number")
+	}
+	if v, ok := c.GetBool("beta"); !ok || !v {
+		t.Errorf("GetBool(beta) = %v, %v", v, ok)
+	}
+	if v, ok := c.GetBool("trial"); !ok || v {
+		t.Errorf("GetBool(trial) = %v, %v", v, ok)
+	}
+	if v, ok := c.GetStringSlice("features"); !ok || !reflect.DeepEqual(v, []string{"export", "sso"}) {
+		t.Errorf("GetStringSlice(features) = %v, %v", v, ok)
+	}
+	if _, ok := c.GetStringSlice("mixed"); ok {
+		t.Errorf("GetStringSlice(mixed) should fail for non string elements")
+	}
+	if _, ok := c.GetString("missing"); ok {
+		t.Errorf("GetString(missing) should report a missing claim")
+	}
+}
+
+func TestAppClaims_ToMap(t *testing.T) {
+	now := time.Now().UTC().Unix()
+	c := AppClaims{
+		UserID:   "123456",
+		Name:     "Mike",
+		Roles:    []Role{"USER", "ADMIN"},
+		Metadata: map[string]interface{}{"plan": "pro", "seats": float64(12)},
+		StandardClaims: jwt.StandardClaims{
+			Audience:  "api",
+			ExpiresAt: now + 60,
+			IssuedAt:  now,
+			Subject:   "user-123456",
+		},
+	}
+
+	b, err := json.Marshal(c.ToMap())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims jwt.MapClaims
+	if err := json.Unmarshal(b, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if exp, ok := claims["exp"].(float64); !ok || int64(exp) != now+60 {
+		t.Errorf("exp = %v, want unix seconds %d", claims["exp"], now+60)
+	}
+	if _, ok := claims["nbf"]; ok {
+		t.Errorf("empty nbf claim should be left out")
+	}
+
+	var parsed AppClaims
+	if err := parsed.ParseClaims(claims); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, c) {
+		t.Errorf("round trip = %+v, want %+v", parsed, c)
+	}
+
+	// The custom claims of a parsed token are kept
+	var custom AppClaims
+	if err := custom.ParseClaims(jwt.MapClaims{"uid": "123", "roles": []interface{}{}, "scope": "read", "tenant_id": "acme"}); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"uid": "123", "roles": []Role{}, "scope": "read", "tenant_id": "acme"}
+	if m := custom.ToMap(); !reflect.DeepEqual(m, want) {
+		t.Errorf("ToMap() = %v, want %v", m, want)
+	}
+}
+
+func TestAppClaims_ParseClaims_Roles(t *testing.T) {
+	want := []Role{"admin", "editor"}
+	tests := []struct {
+		name      string
+		roles     interface{}
+		delimiter string
+	}{
+		{"decoded array", []interface{}{"admin", "editor"}, defaultRolesDelimiter},
+		{"string array", []string{"admin", "editor"}, defaultRolesDelimiter},
+		{"comma separated string", "admin,editor", defaultRolesDelimiter},
+		{"comma separated string with spaces", "admin, editor", defaultRolesDelimiter},
+		{"space separated string", "admin editor", " "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c AppClaims
+			if err := c.parseClaims(jwt.MapClaims{"uid": "123", "roles": tt.roles}, tt.delimiter); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(c.Roles, want) {
+				t.Errorf("Roles = %v, want %v", c.Roles, want)
+			}
+		})
+	}
+}
+
+func TestAppClaims_ParseClaims_Warnings(t *testing.T) {
+	var c AppClaims
+	err := c.ParseClaims(jwt.MapClaims{
+		"uid":      "123",
+		"roles":    []interface{}{"admin"},
+		"name":     "Mike",
+		"type":     []interface{}{"weird"},
+		"metadata": "not an object",
+	})
+	if err != nil {
+		t.Fatalf("ParseClaims() error = %v", err)
+	}
+	if c.UserID != "123" || !reflect.DeepEqual(c.Roles, []Role{"admin"}) || c.Name != "Mike" {
+		t.Errorf("ParseClaims() = %+v, want the valid claims parsed", c)
+	}
+	if len(c.Warnings) != 2 {
+		t.Errorf("Warnings = %v, want 2 warnings", c.Warnings)
+	}
+
+	for _, claims := range []jwt.MapClaims{
+		{"roles": []interface{}{"admin"}},
+		{"uid": "123"},
+		{"uid": "123", "roles": []interface{}{"admin"}, "exp": "tomorrow"},
+	} {
+		if err := c.ParseClaims(claims); err == nil {
+			t.Errorf("ParseClaims(%v) succeeded, want an error", claims)
+		}
+	}
+}
+
+func TestNewAppClaims(t *testing.T) {
+	c, err := NewAppClaims("user-1", []Role{"admin"},
+		WithClaimAudience("api"),
+		WithClaimIssuer("https://issuer.example"),
+		WithClaimTTL(time.Hour),
+		WithCustomClaim("tenant", "acme"),
+	)
+	if err != nil {
+		t.Fatalf("NewAppClaims() error = %v", err)
+	}
+	if c.UserID != "user-1" || c.Subject != "user-1" || c.Audience != "api" || c.Issuer != "https://issuer.example" {
+		t.Errorf("NewAppClaims() = %+v", c)
+	}
+	if c.ExpiresAt-c.IssuedAt != int64(time.Hour/time.Second) {
+		t.Errorf("lifetime = %ds, want 3600s", c.ExpiresAt-c.IssuedAt)
+	}
+	if tenant, _ := c.GetString("tenant"); tenant != "acme" {
+		t.Errorf("tenant = %q, want acme", tenant)
+	}
+
+	// the claims survive a round trip through a token
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret})
+	_, tokenString, err := ja.Encode(jwt.MapClaims(c.ToMap()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ja.Parse(tokenString)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if !reflect.DeepEqual(parsed, c) {
+		t.Errorf("Parse() = %+v, want %+v", parsed, c)
+	}
+
+	if c, _ := NewAppClaims("user-1", nil); c.Roles == nil {
+		t.Error("NewAppClaims() left Roles nil")
+	}
+	if _, err := NewAppClaims("", []Role{"admin"}); err == nil {
+		t.Error("NewAppClaims() accepted an empty subject")
+	}
+	for _, ttl := range []time.Duration{0, -time.Hour} {
+		if _, err := NewAppClaims("user-1", nil, WithClaimTTL(ttl)); err == nil {
+			t.Errorf("NewAppClaims() accepted a TTL of %v", ttl)
+		}
+	}
+}
+
+func TestAppClaims_Audiences(t *testing.T) {
+	tests := []struct {
+		name string
+		aud  interface{}
+		want []string
+	}{
+		{"string", "api", []string{"api"}},
+		{"array", []interface{}{"api", "web"}, []string{"api", "web"}},
+		{"single element array", []interface{}{"api"}, []string{"api"}},
+		{"absent", nil, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := jwt.MapClaims{"uid": "123", "roles": []interface{}{}}
+			if tt.aud != nil {
+				claims["aud"] = tt.aud
+			}
+			var c AppClaims
+			if err := c.ParseClaims(claims); err != nil {
+				t.Fatalf("ParseClaims() error = %v", err)
+			}
+			if got := c.Audiences(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Audiences() = %#v, want %#v", got, tt.want)
+			}
+
+			// the audiences survive a round trip through ToMap
+			var parsed AppClaims
+			if err := parsed.ParseClaims(jwt.MapClaims(c.ToMap())); err != nil {
+				t.Fatal(err)
+			}
+			if got := parsed.Audiences(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("round trip Audiences() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+
+	var c AppClaims
+	if err := c.ParseClaims(jwt.MapClaims{"uid": "123", "roles": []interface{}{}, "aud": 1}); err == nil {
+		t.Error("ParseClaims() accepted a numeric aud claim")
+	}
+}
+
+func TestSubjectValidator(t *testing.T) {
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}, WithSubjectValidator(ValidateUUID))
+
+	tests := []struct {
+		name string
+		sub  interface{}
+		ok   bool
+	}{
+		{"uuid", "123e4567-e89b-12d3-a456-426614174000", true},
+		{"upper case uuid", "123E4567-E89B-12D3-A456-426614174000", true},
+		{"not a uuid", "alice", false},
+		{"misplaced dash", "123e4567e-89b-12d3-a456-426614174000", false},
+		{"non hex", "123e4567-e89b-12d3-a456-42661417400g", false},
+		{"absent", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := jwt.MapClaims{"uid": "123", "roles": []string{}}
+			if tt.sub != nil {
+				claims["sub"] = tt.sub
+			}
+			_, err := ja.Parse(newJwtToken(TokenSecret, claims))
+			if tt.ok && err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrInvalidSubject) {
+				t.Fatalf("Parse() error = %v, want %v", err, ErrInvalidSubject)
+			}
+		})
+	}
+}
+
+func TestIssuedAtClaim(t *testing.T) {
+	config := Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}
+	ja := NewJWTAuth(config, WithIssuedAtClaim("created_at", time.RFC3339), WithMaxTokenLifetime(time.Hour))
+
+	now := time.Now().Truncate(time.Second)
+	token := func(createdAt time.Time, ttl time.Duration) string {
+		return newJwtToken(TokenSecret, jwt.MapClaims{
+			"uid":        "123",
+			"roles":      []string{},
+			"created_at": createdAt.Format(time.RFC3339),
+			"exp":        createdAt.Add(ttl).Unix(),
+		})
+	}
+
+	c, err := ja.Parse(token(now.Add(-time.Minute), 30*time.Minute))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if c.IssuedAt != now.Add(-time.Minute).Unix() {
+		t.Fatalf("IssuedAt = %d, want %d", c.IssuedAt, now.Add(-time.Minute).Unix())
+	}
+
+	// the lifetime counts from created_at, so a token created long ago but expiring
+	// soon is still too long lived
+	if _, err := ja.Parse(token(now.Add(-3*time.Hour), 4*time.Hour)); err != ErrTokenLifetimeExceeded {
+		t.Fatalf("long lived: Parse() error = %v, want %v", err, ErrTokenLifetimeExceeded)
+	}
+	if _, err := ja.Parse(token(now.Add(10*time.Minute), 30*time.Minute)); err != ErrIATInvalid {
+		t.Fatalf("created in the future: Parse() error = %v, want %v", err, ErrIATInvalid)
+	}
+
+	// the default stays "iat"
+	std := NewJWTAuth(config)
+	c, err = std.Parse(newJwtToken(TokenSecret, jwt.MapClaims{"uid": "123", "roles": []string{}, "iat": now.Unix(), "created_at": "2001-01-01T00:00:00Z"}))
+	if err != nil || c.IssuedAt != now.Unix() {
+		t.Fatalf("iat: got %d, %v, want %d", c.IssuedAt, err, now.Unix())
+	}
+}
+
+func TestClaimsRoot(t *testing.T) {
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}, WithClaimsRoot("attributes"))
+
+	exp := time.Now().Add(time.Hour).Unix()
+	c, err := ja.Parse(newJwtToken(TokenSecret, jwt.MapClaims{
+		"iss": "saml-bridge",
+		"exp": exp,
+		"sub": "bridge",
+		"attributes": map[string]interface{}{
+			"uid":   "123",
+			"sub":   "alice",
+			"roles": []string{"ADMIN", "USER"},
+			"iss":   "spoofed",
+			"exp":   1,
+		},
+	}))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if c.UserID != "123" || c.Subject != "alice" || !reflect.DeepEqual(c.Roles, []Role{"ADMIN", "USER"}) {
+		t.Fatalf("got %+v, want the nested uid, sub and roles", c)
+	}
+	if c.Issuer != "saml-bridge" || c.ExpiresAt != exp {
+		t.Fatalf("got iss %q exp %d, want the top level ones", c.Issuer, c.ExpiresAt)
+	}
+
+	// tokens without the object parse from the top level
+	c, err = ja.Parse(newJwtToken(TokenSecret, jwt.MapClaims{"uid": "456", "roles": []string{}}))
+	if err != nil || c.UserID != "456" {
+		t.Fatalf("got %+v, %v, want uid 456", c, err)
+	}
+}
+
+func TestClaimsRootSubjectChecks(t *testing.T) {
+	var validated, looked string
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}, WithClaimsRoot("attributes"),
+		WithSubjectValidator(func(sub string) error {
+			validated = sub
+			return nil
+		}),
+		WithTokenVersion(func(sub string) (int, error) {
+			looked = sub
+			return 0, nil
+		}))
+	h := ja.Verify()(ja.Authenticate(ja.RequiresSubjectMatch(func(r *http.Request) (string, error) {
+		return r.URL.Query().Get("user"), nil
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	}))))
+
+	header := newAuthHeader(jwt.MapClaims{
+		"sub":        "bridge",
+		"attributes": map[string]interface{}{"uid": "123", "sub": "alice", "roles": []string{}},
+	})
+	for user, status := range map[string]int{"alice": 200, "bridge": 403} {
+		req := httptest.NewRequest("GET", "/?user="+user, nil)
+		req.Header = header
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != status {
+			t.Fatalf("acting for %s: got %d, want %d", user, rec.Code, status)
+		}
+	}
+	if validated != "alice" || looked != "alice" {
+		t.Fatalf("validated %q, looked up %q, want the nested subject", validated, looked)
+	}
+}
+
+func TestAppClaims_Principal(t *testing.T) {
+	var c AppClaims
+	err := c.ParseClaims(jwt.MapClaims{
+		"uid":        "123",
+		"sub":        "alice",
+		"roles":      []interface{}{"ADMIN"},
+		"name":       "Alice",
+		"scope":      "read:accounts write:accounts",
+		"tenant_id":  "acme",
+		"department": "finance",
+		"exp":        float64(2000000000),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Principal{
+		Subject: "alice",
+		Roles:   []string{"ADMIN"},
+		Scopes:  []string{"read:accounts", "write:accounts"},
+		Tenant:  "acme",
+		Claims:  map[string]interface{}{"department": "finance"},
+	}
+	if got := c.Principal(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	// empty principals keep the JSON shape
+	var empty AppClaims
+	if err := empty.ParseClaims(jwt.MapClaims{"uid": "456", "roles": []interface{}{}}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(empty.Principal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"subject":"456","roles":[],"scopes":[],"claims":{}}` {
+		t.Fatalf("got %s", b)
+	}
+}
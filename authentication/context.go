@@ -2,7 +2,10 @@ package authentication
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strings"
+	"sync"
 
 	jwt "github.com/dgrijalva/jwt-go"
 )
@@ -19,8 +22,22 @@ var (
 	TokenCtxKey        = &contextKey{"Token"}
 	AccessClaimsCtxKey = &contextKey{"AccessClaims"}
 	ErrorCtxKey        = &contextKey{"Error"}
+	TokenSourceCtxKey  = &contextKey{"TokenSource"}
 )
 
+// WithContextKeys also stores the token and error set by Verify and the AppClaims set
+// by Authenticate and Optional under the given context keys, for frameworks and code
+// reading them from keys of their own. A nil key stores nothing. The package functions,
+// e.g. TokenFromContext, keep reading the package keys. With WithLazyClaims no claims
+// are stored under claimsKey.
+func WithContextKeys(tokenKey, claimsKey, errKey interface{}) Option {
+	return func(ja *jwtAuth) {
+		ja.tokenCtxKey = tokenKey
+		ja.claimsCtxKey = claimsKey
+		ja.errCtxKey = errKey
+	}
+}
+
 // TokenFromContext extracts the JWT token from the request context
 func TokenFromContext(ctx context.Context) (*jwt.Token, jwt.MapClaims, error) {
 	token, _ := ctx.Value(TokenCtxKey).(*jwt.Token)
@@ -41,6 +58,36 @@ func TokenFromContext(ctx context.Context) (*jwt.Token, jwt.MapClaims, error) {
 	return token, claims, err
 }
 
+// ErrorFromContext returns the error Verify set on the request context, nil for
+// verified tokens. It is one of the library errors or wraps one, at least
+// ErrUnauthorized, so custom handlers can switch on it with errors.Is or AuthErrorCode.
+func ErrorFromContext(ctx context.Context) error {
+	err, _ := ctx.Value(ErrorCtxKey).(error)
+	return err
+}
+
+// RawClaimsFromCtx returns the JSON encoded claims of the token verified by Verify, as
+// sent, for handlers decoding large claims with a decoder of their own rather than
+// from the generic claims map. There are none with WithMinimalClaims.
+func RawClaimsFromCtx(ctx context.Context) ([]byte, bool) {
+	token, _ := ctx.Value(TokenCtxKey).(*jwt.Token)
+	if token == nil || !token.Valid || token.Raw == "" {
+		return nil, false
+	}
+	// Tokens of a trusted mesh are their payload only
+	seg := token.Raw
+	if parts := strings.Split(token.Raw, "."); len(parts) == 3 {
+		seg = parts[1]
+	} else if len(parts) != 1 {
+		return nil, false
+	}
+	data, err := decodeSegment(strings.TrimRight(seg, "="))
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
 // NewContext creates a new context with JWT token and error
 func NewContext(ctx context.Context, t *jwt.Token, err error) context.Context {
 	ctx = context.WithValue(ctx, TokenCtxKey, t)
@@ -48,7 +95,84 @@ func NewContext(ctx context.Context, t *jwt.Token, err error) context.Context {
 	return ctx
 }
 
-// AppClaimsFromCtx retrieves the parsed AppClaims from request context.
+// AppClaimsFromCtx retrieves the parsed AppClaims from request context. It returns
+// empty AppClaims when the Authenticate middleware hasn't run.
 func AppClaimsFromCtx(ctx context.Context) AppClaims {
-	return ctx.Value(AccessClaimsCtxKey).(AppClaims)
+	c, _ := appClaimsFromCtx(ctx)
+	return c
+}
+
+// ClaimsInto unmarshals the claims of the token verified by Verify into v, a pointer
+// to a struct of the caller's own, e.g.:
+//
+//	var c struct {
+//		jwt.StandardClaims
+//		TenantID string `json:"tenant_id"`
+//	}
+//	err := tokenAuth.ClaimsInto(r.Context(), &c)
+//
+// The claims are re-encoded to JSON, so the fields map to claims by their json tags.
+// It reads the full claims in minimal claims mode, like FullClaims.
+func (ja *jwtAuth) ClaimsInto(ctx context.Context, v interface{}) error {
+	ja = ja.current()
+	claims, err := ja.FullClaims(ctx)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// appClaimsFromCtx retrieves the AppClaims set by the Authenticate middleware, parsing
+// them on first access with WithLazyClaims.
+func appClaimsFromCtx(ctx context.Context) (AppClaims, bool) {
+	switch c := ctx.Value(AccessClaimsCtxKey).(type) {
+	case AppClaims:
+		return c, true
+	case *lazyClaims:
+		claims, err := c.get()
+		return claims, err == nil
+	}
+	return AppClaims{}, false
+}
+
+// lazyClaims parses the AppClaims of a verified token on first access, see
+// WithLazyClaims. It is safe for concurrent use.
+type lazyClaims struct {
+	once   sync.Once
+	parse  func() (AppClaims, error)
+	claims AppClaims
+	err    error
+}
+
+func (l *lazyClaims) get() (AppClaims, error) {
+	l.once.Do(func() {
+		l.claims, l.err = l.parse()
+	})
+	return l.claims, l.err
+}
+
+// Authorize runs check against the AppClaims set on the context by the Authenticate
+// middleware, for authorization decisions depending on data only known inside a
+// handler. It returns ErrUnauthorized when the context carries no AppClaims and
+// ErrForbidden when check fails.
+func Authorize(ctx context.Context, check func(AppClaims) bool) error {
+	claims, ok := appClaimsFromCtx(ctx)
+	if !ok {
+		return ErrUnauthorized
+	}
+	if !check(claims) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// TokenSourceFromCtx returns the source the Verify middleware found the token in,
+// one of the TokenSource constants.
+func TokenSourceFromCtx(ctx context.Context) (string, bool) {
+	source, ok := ctx.Value(TokenSourceCtxKey).(string)
+	return source, ok
 }
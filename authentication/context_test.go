@@ -0,0 +1,39 @@
+package authentication
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	owner := context.WithValue(context.Background(), AccessClaimsCtxKey, AppClaims{UserID: "123"})
+	lazy := context.WithValue(context.Background(), AccessClaimsCtxKey, &lazyClaims{parse: func() (AppClaims, error) {
+		return AppClaims{UserID: "123"}, nil
+	}})
+	broken := context.WithValue(context.Background(), AccessClaimsCtxKey, &lazyClaims{parse: func() (AppClaims, error) {
+		return AppClaims{}, errors.New("could not parse user id")
+	}})
+	isOwner := func(c AppClaims) bool {
+		return c.UserID == "123"
+	}
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want error
+	}{
+		{"no claims", context.Background(), ErrUnauthorized},
+		{"unparsable lazy claims", broken, ErrUnauthorized},
+		{"check fails", context.WithValue(context.Background(), AccessClaimsCtxKey, AppClaims{UserID: "456"}), ErrForbidden},
+		{"check passes", owner, nil},
+		{"lazy claims", lazy, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Authorize(tt.ctx, isOwner); err != tt.want {
+				t.Fatalf("Authorize() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package authentication
+
+import (
+	"fmt"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// WithCredentialInvalidation rejects tokens issued before their subject last changed
+// credentials, e.g. a password, with ErrCredentialsChanged, so a change logs the
+// subject out everywhere. lookup returns the time of the last change, the zero time
+// if there was none; its failures are reported as ErrCredentialsUnavailable, a system
+// error. Tokens without an issue time are rejected for subjects that changed
+// credentials.
+func WithCredentialInvalidation(lookup func(sub string) (time.Time, error)) Option {
+	return func(ja *jwtAuth) {
+		ja.credentialsChangedAt = lookup
+	}
+}
+
+// checkCredentials verifies the token was issued after the last credentials change
+// of its subject.
+func (ja *jwtAuth) checkCredentials(token *jwt.Token) error {
+	if ja.credentialsChangedAt == nil {
+		return nil
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	changed, err := ja.credentialsChangedAt(subjectClaim(ja.rootClaims(claims)))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCredentialsUnavailable, err)
+	}
+	if changed.IsZero() {
+		return nil
+	}
+	// iat has a precision of seconds
+	iat, ok := ja.issuedAt(claims)
+	if !ok || time.Unix(iat, 0).Before(changed.Truncate(time.Second)) {
+		return ErrCredentialsChanged
+	}
+	return nil
+}
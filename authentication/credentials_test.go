@@ -0,0 +1,64 @@
+package authentication
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestCredentialInvalidation(t *testing.T) {
+	changedAt := time.Now().Add(-time.Hour)
+	errLookup := errors.New("lookup failed")
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret},
+		WithCredentialInvalidation(func(sub string) (time.Time, error) {
+			switch sub {
+			case "changed":
+				return changedAt, nil
+			case "broken":
+				return time.Time{}, errLookup
+			}
+			return time.Time{}, nil
+		}))
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		err    error
+	}{
+		{"issued after change", jwt.MapClaims{"sub": "changed", "iat": changedAt.Add(time.Minute).Unix()}, nil},
+		{"issued at change", jwt.MapClaims{"sub": "changed", "iat": changedAt.Unix()}, nil},
+		{"issued before change", jwt.MapClaims{"sub": "changed", "iat": changedAt.Add(-time.Minute).Unix()}, ErrCredentialsChanged},
+		{"no issue time", jwt.MapClaims{"sub": "changed"}, ErrCredentialsChanged},
+		{"uid issued before change", jwt.MapClaims{"uid": "changed", "iat": changedAt.Add(-time.Minute).Unix()}, ErrCredentialsChanged},
+		{"never changed", jwt.MapClaims{"sub": "unchanged", "iat": changedAt.Add(-time.Minute).Unix()}, nil},
+		{"lookup error", jwt.MapClaims{"sub": "broken", "iat": changedAt.Unix()}, ErrCredentialsUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := jwt.MapClaims{"uid": "123", "roles": []string{}}
+			for k, v := range tt.claims {
+				claims[k] = v
+			}
+			_, err := ja.Parse(newJwtToken(TokenSecret, claims))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Parse() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	// Lookup failures deny the request as unavailable
+	h := ja.Verify()(ja.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header = newAuthHeader(jwt.MapClaims{"uid": "123", "roles": []string{}, "sub": "broken", "iat": changedAt.Unix()})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != 503 || rec.Header().Get(DenyReasonHeader) != ErrorCodeCredentialsUnavailable {
+		t.Fatalf("lookup error: got %d %q, want 503 %q", rec.Code, rec.Header().Get(DenyReasonHeader), ErrorCodeCredentialsUnavailable)
+	}
+}
@@ -0,0 +1,123 @@
+package authentication
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// DeepLink describes a signed link, e.g. sent by email, granting its subject access to
+// some paths and redirecting to one of them, see CreateDeepLinkJWT.
+type DeepLink struct {
+	Subject  string
+	Audience string
+
+	// Redirect is the local path the link redirects to, e.g. "/invoices/42"
+	Redirect string
+
+	// AllowedPaths restrict the token to these paths, see RequiresMatchingRequest.
+	// They default to the path of Redirect.
+	AllowedPaths []string
+
+	// TTL is the lifetime of the link, 15 minutes if zero
+	TTL time.Duration
+}
+
+// defaultDeepLinkTTL is the lifetime of deep links without a TTL.
+const defaultDeepLinkTTL = 15 * time.Minute
+
+// deepLinkTokenUse is the token use of deep link tokens, see checkDeepLink.
+const deepLinkTokenUse = "deep_link"
+
+// CreateDeepLinkJWT returns the token of link, to be sent in the "jwt" query parameter
+// of a link to DeepLinkHandler. Its token use is "deep_link", in the "token_use" claim
+// or the claim set with WithTokenUseClaim, so that it is only accepted on its allowed
+// paths, even by routes without RequiresMatchingRequest, and never by Parse.
+func (ja *jwtAuth) CreateDeepLinkJWT(link DeepLink) (string, error) {
+	ja = ja.current()
+	target, ok := localRedirect(link.Redirect)
+	if !ok {
+		return "", ErrInvalidRedirect
+	}
+	ttl := link.TTL
+	if ttl == 0 {
+		ttl = defaultDeepLinkTTL
+	}
+	paths := link.AllowedPaths
+	if len(paths) == 0 {
+		paths = []string{target.Path}
+	}
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"uid":            link.Subject,
+		"sub":            link.Subject,
+		"roles":          []Role{},
+		"iat":            now.Unix(),
+		"exp":            now.Add(ttl).Unix(),
+		"allowed_paths":  paths,
+		"redirect":       link.Redirect,
+		ja.tokenUseClaim: deepLinkTokenUse,
+	}
+	if link.Audience != "" {
+		claims["aud"] = link.Audience
+	}
+	_, tokenString, err := ja.Encode(claims)
+	return tokenString, err
+}
+
+// DeepLinkHandler serves the links of CreateDeepLinkJWT: it verifies the token of the
+// "jwt" query parameter, sets it as the token cookie, see SetTokenCookie, and redirects
+// to the "redirect" claim of the token. The cookie doesn't grant a session: the token
+// is rejected outside its allowed paths. The redirect must be a local path allowed by
+// the "allowed_paths" claim. Requests without a valid token get a 401 Unauthorized
+// response and tokens with another redirect a 403 Forbidden one.
+func (ja *jwtAuth) DeepLinkHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ja := ja.current()
+		tokenStr := ja.TokenFromQuery(r)
+		if tokenStr == "" {
+			deny(w, ErrorCodeNoToken, http.StatusText(401), 401)
+			return
+		}
+		token, err := ja.verifyToken(ja.tenantContext(r.Context(), r), tokenStr)
+		if err != nil {
+			deny(w, AuthErrorCode(contextError(err)), http.StatusText(401), 401)
+			return
+		}
+
+		claims, _ := token.Claims.(jwt.MapClaims)
+		redirect, _ := claims["redirect"].(string)
+		target, ok := localRedirect(redirect)
+		if !ok || !requestAllowed(&http.Request{Method: http.MethodGet, URL: target}, claims) {
+			deny(w, ErrorCodeRequestMismatch, http.StatusText(403), 403)
+			return
+		}
+		ja.SetTokenCookie(w, tokenStr)
+		http.Redirect(w, r, redirect, http.StatusFound)
+	})
+}
+
+// checkDeepLink rejects deep link tokens, see CreateDeepLinkJWT, on requests their
+// "allowed_paths" and "allowed_methods" claims don't allow with ErrTokenUseInvalid.
+func (ja *jwtAuth) checkDeepLink(r *http.Request, claims jwt.MapClaims) error {
+	if use, _ := claims[ja.tokenUseClaim].(string); use == deepLinkTokenUse && (r == nil || !requestAllowed(r, claims)) {
+		return ErrTokenUseInvalid
+	}
+	return nil
+}
+
+// localRedirect parses redirect, which must be a path on the same host, e.g.
+// "/invoices/42?tab=pdf", to prevent open redirects.
+func localRedirect(redirect string) (*url.URL, bool) {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		return nil, false
+	}
+	u, err := url.Parse(redirect)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return nil, false
+	}
+	return u, true
+}
@@ -0,0 +1,89 @@
+package authentication
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+)
+
+func TestDeepLink(t *testing.T) {
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}, WithAudience("web"))
+
+	r := chi.NewRouter()
+	r.Handle("/links", ja.DeepLinkHandler())
+	r.With(ja.Verify(), ja.Authenticate, ja.RequiresMatchingRequest()).Get("/invoices/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("invoice"))
+	})
+	r.With(ja.Verify(), ja.Authenticate).Get("/account", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("account"))
+	})
+	r.With(ja.Verify(), ja.RequiresSubjectMatch(func(r *http.Request) (string, error) {
+		return "user-1", nil
+	})).Get("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("user"))
+	})
+
+	valid, err := ja.CreateDeepLinkJWT(DeepLink{Subject: "user-1", Audience: "web", Redirect: "/invoices/42?tab=pdf"})
+	if err != nil {
+		t.Fatalf("CreateDeepLinkJWT() error = %v", err)
+	}
+	expired, _ := ja.CreateDeepLinkJWT(DeepLink{Subject: "user-1", Audience: "web", Redirect: "/invoices/42", TTL: -time.Minute})
+	otherAudience, _ := ja.CreateDeepLinkJWT(DeepLink{Subject: "user-1", Audience: "mobile", Redirect: "/invoices/42"})
+	otherRedirect := newJwtToken(TokenSecret, jwt.MapClaims{"uid": "user-1", "roles": []string{}, "aud": "web",
+		"allowed_paths": []string{"/invoices/42"}, "redirect": "/invoices/43"})
+	openRedirect := newJwtToken(TokenSecret, jwt.MapClaims{"uid": "user-1", "roles": []string{}, "aud": "web",
+		"allowed_paths": []string{"/*"}, "redirect": "//evil.example/"})
+
+	tests := []struct {
+		name     string
+		token    string
+		status   int
+		location string
+	}{
+		{"valid link", valid, 302, "/invoices/42?tab=pdf"},
+		{"expired link", expired, 401, ""},
+		{"other audience", otherAudience, 401, ""},
+		{"redirect not allowed", otherRedirect, 403, ""},
+		{"open redirect", openRedirect, 403, ""},
+		{"no token", "", 401, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/links?jwt="+url.QueryEscape(tt.token), nil)
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != tt.status || rec.Header().Get("Location") != tt.location {
+				t.Fatalf("got %d %q, want %d %q", rec.Code, rec.Header().Get("Location"), tt.status, tt.location)
+			}
+			if tt.status != 302 {
+				return
+			}
+
+			// The cookie set grants access to the redirect target only, even on
+			// routes not checking the allowed paths
+			for path, status := range map[string]int{"/invoices/42": 200, "/invoices/43": 401, "/account": 401, "/users/user-1": 401} {
+				req := httptest.NewRequest("GET", path, nil)
+				for _, c := range rec.Result().Cookies() {
+					req.AddCookie(c)
+				}
+				rec := httptest.NewRecorder()
+				r.ServeHTTP(rec, req)
+				if rec.Code != status {
+					t.Errorf("GET %s with the link cookie = %d, want %d", path, rec.Code, status)
+				}
+			}
+		})
+	}
+
+	if _, err := ja.Parse(valid); err != ErrTokenUseInvalid {
+		t.Fatalf("Parse() error = %v, want %v", err, ErrTokenUseInvalid)
+	}
+	if _, err := ja.CreateDeepLinkJWT(DeepLink{Subject: "user-1", Redirect: "https://evil.example/"}); err != ErrInvalidRedirect {
+		t.Fatalf("CreateDeepLinkJWT() error = %v, want %v", err, ErrInvalidRedirect)
+	}
+}
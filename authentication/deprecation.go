@@ -0,0 +1,55 @@
+package authentication
+
+import (
+	"net/http"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// DeprecatedToken describes a verified token issued by a deprecated issuer or signed
+// with a deprecated key, see WithDeprecationReporter.
+type DeprecatedToken struct {
+	// Subject of the token
+	Subject string
+	// Issuer of the token
+	Issuer string
+	// KeyID is the "kid" header of the token
+	KeyID string
+}
+
+// WithDeprecatedIssuers marks tokens issued by the given issuers as deprecated.
+func WithDeprecatedIssuers(issuers ...string) Option {
+	return func(ja *jwtAuth) {
+		ja.deprecatedIssuers = issuers
+	}
+}
+
+// WithDeprecatedKeyIDs marks tokens signed with the keys of the given "kid" headers
+// as deprecated.
+func WithDeprecatedKeyIDs(kids ...string) Option {
+	return func(ja *jwtAuth) {
+		ja.deprecatedKeyIDs = kids
+	}
+}
+
+// WithDeprecationReporter calls report for every request Verify verifies a deprecated
+// token for, e.g. to count and log the remaining users of an issuer or key before
+// retiring it. Deprecated tokens are accepted like any other.
+func WithDeprecationReporter(report func(r *http.Request, t DeprecatedToken)) Option {
+	return func(ja *jwtAuth) {
+		ja.deprecationReporter = report
+	}
+}
+
+// reportDeprecated reports the token if it is deprecated.
+func (ja *jwtAuth) reportDeprecated(r *http.Request, token *jwt.Token) {
+	claims, _ := token.Claims.(jwt.MapClaims)
+	t := DeprecatedToken{}
+	t.Subject, _ = ja.rootClaims(claims)["sub"].(string)
+	t.Issuer, _ = claims["iss"].(string)
+	t.KeyID, _ = token.Header["kid"].(string)
+	if t.Issuer != "" && containsString(ja.deprecatedIssuers, t.Issuer) ||
+		t.KeyID != "" && containsString(ja.deprecatedKeyIDs, t.KeyID) {
+		ja.deprecationReporter(r, t)
+	}
+}
@@ -0,0 +1,70 @@
+package authentication
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+)
+
+func TestDeprecationReporter(t *testing.T) {
+	var reported []DeprecatedToken
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+	}, WithDeprecatedIssuers("https://legacy.example"), WithDeprecatedKeyIDs("2019"), WithDeprecationReporter(func(r *http.Request, t DeprecatedToken) {
+		reported = append(reported, t)
+	}))
+
+	r := chi.NewRouter()
+	r.Use(TokenAuthHS256.Verify(), TokenAuthHS256.Authenticate)
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	token := func(kid string, claims jwt.MapClaims) http.Header {
+		claims["uid"] = "123"
+		claims["roles"] = []string{}
+		tok := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		if kid != "" {
+			tok.Header["kid"] = kid
+		}
+		tokenString, err := tok.SignedString(TokenSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := http.Header{}
+		h.Set("Authorization", "BEARER "+tokenString)
+		return h
+	}
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   *DeprecatedToken
+	}{
+		{"current", token("2024", jwt.MapClaims{"sub": "user-1", "iss": "https://issuer.example"}), nil},
+		{"deprecated issuer", token("2024", jwt.MapClaims{"sub": "user-2", "iss": "https://legacy.example"}), &DeprecatedToken{"user-2", "https://legacy.example", "2024"}},
+		{"deprecated key", token("2019", jwt.MapClaims{"sub": "user-3", "iss": "https://issuer.example"}), &DeprecatedToken{"user-3", "https://issuer.example", "2019"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reported = nil
+			if status, _ := testRequest(t, ts, "GET", "/", tt.header, nil); status != 200 {
+				t.Fatalf("got %d, want 200", status)
+			}
+			switch {
+			case tt.want == nil && len(reported) != 0:
+				t.Fatalf("reported %v for a current token", reported)
+			case tt.want != nil && (len(reported) != 1 || reported[0] != *tt.want):
+				t.Fatalf("reported %v, want %v", reported, *tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package authentication
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrorHandler writes the response for a request the Authenticate or Optional
+// middleware rejects with err, see WithErrorHandler.
+type ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+
+// DefaultErrorHandler is the ErrorHandler used unless one is set with WithErrorHandler.
+// It sends a 503 Service Unavailable response for system errors, a 403 Forbidden
+// response for tokens not bound to the request, requests on hosts not allowed,
+// forwarded headers from untrusted sources, subjects over their session limit or
+// tokens over their usage cap, a 413 Request Entity Too Large response for bodies over
+// the WithMaxBodySize limit and a 401 Unauthorized response otherwise. 401
+// responses carry a WWW-Authenticate header describing the error, e.g.
+// error_description="token not yet valid" for ErrNBFInvalid. All responses name the
+// error code in the DenyReasonHeader, see AuthErrorCode.
+func DefaultErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	status := ErrorStatus(err)
+	w.Header().Set(DenyReasonHeader, AuthErrorCode(err))
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", wwwAuthenticate(err))
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+// AuthSchemesErrorHandler returns an ErrorHandler for routes accepting several
+// authentication schemes, e.g. "Bearer" and "ApiKey", so that clients using the wrong
+// one learn the others. It responds like DefaultErrorHandler, except that 401
+// responses carry a WWW-Authenticate challenge per scheme, in order, the Bearer one
+// describing the error, and a JSON body naming the error code and the schemes.
+func AuthSchemesErrorHandler(schemes ...string) ErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		status := ErrorStatus(err)
+		if status != http.StatusUnauthorized {
+			DefaultErrorHandler(w, r, err)
+			return
+		}
+		w.Header().Set(DenyReasonHeader, AuthErrorCode(err))
+		for _, scheme := range schemes {
+			if strings.EqualFold(scheme, "Bearer") {
+				w.Header().Add("WWW-Authenticate", wwwAuthenticate(err))
+			} else {
+				w.Header().Add("WWW-Authenticate", scheme)
+			}
+		}
+		body := authErrorBody{Error: AuthErrorCode(err), Schemes: schemes}
+		if !errors.Is(err, ErrNoTokenFound) {
+			body.Description = errorDescription(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}
+}
+
+// authErrorBody is the body of the 401 responses of AuthSchemesErrorHandler.
+type authErrorBody struct {
+	Error       string   `json:"error"`
+	Description string   `json:"error_description,omitempty"`
+	Schemes     []string `json:"schemes"`
+}
+
+// ErrorStatus returns the http status code DefaultErrorHandler responds with for err.
+func ErrorStatus(err error) int {
+	switch {
+	case IsSystemError(err):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrForbidden),
+		errors.Is(err, ErrFingerprintMismatch),
+		errors.Is(err, ErrIPMismatch),
+		errors.Is(err, ErrBodyHashMismatch),
+		errors.Is(err, ErrCSRFTokenMismatch),
+		errors.Is(err, ErrUntrustedProxy),
+		errors.Is(err, ErrSessionLimitExceeded),
+		errors.Is(err, ErrUsageCapExceeded),
+		errors.Is(err, ErrHostNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, ErrBodyTooLarge):
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusUnauthorized
+}
+
+// wwwAuthenticate returns the RFC 6750 WWW-Authenticate challenge for err.
+func wwwAuthenticate(err error) string {
+	if errors.Is(err, ErrNoTokenFound) {
+		return "Bearer"
+	}
+	return fmt.Sprintf("Bearer error=\"invalid_token\", error_description=%q", errorDescription(err))
+}
+
+// errorDescription returns the description of err sent to clients.
+func errorDescription(err error) string {
+	switch {
+	case errors.Is(err, ErrExpired):
+		return "token is expired"
+	case errors.Is(err, ErrNBFInvalid):
+		return "token not yet valid"
+	case errors.Is(err, ErrIATInvalid):
+		return "token issued in the future"
+	case errors.Is(err, ErrAlgoInvalid):
+		return "unexpected signing algorithm"
+	case errors.Is(err, ErrAudienceInvalid):
+		return "token audience mismatch"
+	case errors.Is(err, ErrIssuerInvalid):
+		return "token issuer mismatch"
+	case errors.Is(err, ErrInvalidSubject):
+		return "token subject is invalid"
+	case errors.Is(err, ErrMissingExpiry):
+		return "token has no expiry"
+	case errors.Is(err, ErrTokenLifetimeExceeded):
+		return "token lifetime too long"
+	case errors.Is(err, ErrX5CChainInvalid):
+		return "certificate chain not trusted"
+	case errors.Is(err, ErrReplay):
+		return "token already used"
+	case errors.Is(err, ErrMissingNonce):
+		return "token has no nonce"
+	case errors.Is(err, ErrTypInvalid):
+		return "unexpected token type"
+	case errors.Is(err, ErrUnsupportedCritHeader):
+		return "unsupported critical header"
+	case errors.Is(err, ErrUnsupportedSerialization):
+		return "unsupported token serialization"
+	}
+	return "token is invalid"
+}
+
+// Stable error codes returned by AuthErrorCode, safe to switch on and to send to
+// clients. They name the reason a request is denied in the DenyReasonHeader.
+const (
+	ErrorCodeNoToken                  = "no_token"
+	ErrorCodeExpired                  = "token_expired"
+	ErrorCodeNotYetValid              = "token_not_yet_valid"
+	ErrorCodeIssuedInFuture           = "token_issued_in_future"
+	ErrorCodeAlgorithmMismatch        = "algorithm_mismatch"
+	ErrorCodeAudienceMismatch         = "audience_mismatch"
+	ErrorCodeIssuerMismatch           = "issuer_mismatch"
+	ErrorCodeInvalidSubject           = "invalid_subject"
+	ErrorCodeCredentialsChanged       = "credentials_changed"
+	ErrorCodeTokenVersionStale        = "token_version_stale"
+	ErrorCodeDisallowedSource         = "disallowed_source"
+	ErrorCodeCookieSignature          = "cookie_signature_invalid"
+	ErrorCodeFingerprintMismatch      = "fingerprint_mismatch"
+	ErrorCodeIPMismatch               = "ip_mismatch"
+	ErrorCodeBodyHashMismatch         = "body_hash_mismatch"
+	ErrorCodeCSRFMismatch             = "csrf_mismatch"
+	ErrorCodeTokenUseInvalid          = "token_use_invalid"
+	ErrorCodeSchemaViolation          = "claims_schema_violation"
+	ErrorCodeClaimsTooLarge           = "claims_too_large"
+	ErrorCodeMissingExpiry            = "missing_expiry"
+	ErrorCodeLifetimeExceeded         = "lifetime_exceeded"
+	ErrorCodeX5CChainInvalid          = "x5c_chain_invalid"
+	ErrorCodeReplay                   = "replay"
+	ErrorCodeMissingNonce             = "missing_nonce"
+	ErrorCodeTokenAlreadyUsed         = "token_already_used"
+	ErrorCodeMissingJTI               = "missing_jti"
+	ErrorCodeInvalidLogoutToken       = "invalid_logout_token"
+	ErrorCodeTypInvalid               = "typ_invalid"
+	ErrorCodeUnsupportedCritHeader    = "unsupported_crit_header"
+	ErrorCodeUnsupportedSerialization = "unsupported_serialization"
+	ErrorCodeUntrustedProxy           = "untrusted_proxy"
+	ErrorCodeSessionLimitExceeded     = "session_limit_exceeded"
+	ErrorCodeUsageCapExceeded         = "usage_cap_exceeded"
+	ErrorCodeHostNotAllowed           = "host_not_allowed"
+	ErrorCodeBodyTooLarge             = "body_too_large"
+	ErrorCodeKeyUnavailable           = "key_unavailable"
+	ErrorCodeRolesUnavailable         = "roles_unavailable"
+	ErrorCodeTokenVersionUnavailable  = "token_version_unavailable"
+	ErrorCodeCredentialsUnavailable   = "credentials_unavailable"
+	ErrorCodeSessionsUnavailable      = "sessions_unavailable"
+	ErrorCodeUsageUnavailable         = "usage_unavailable"
+	ErrorCodeForbidden                = "forbidden"
+	ErrorCodeRoleMissing              = "role_missing"
+	ErrorCodeScopeMissing             = "scope_missing"
+	ErrorCodeFeatureMissing           = "feature_missing"
+	ErrorCodeSubjectMismatch          = "subject_mismatch"
+	ErrorCodeAuthorizedPartyMismatch  = "authorized_party_mismatch"
+	ErrorCodeRequestMismatch          = "request_mismatch"
+	ErrorCodeRegionMismatch           = "region_mismatch"
+	ErrorCodeUnauthorized             = "unauthorized"
+)
+
+// errorCodes maps the library errors to their codes. ErrUnauthorized comes last, as
+// it matches every error the verification wraps, see contextError.
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrNoTokenFound, ErrorCodeNoToken},
+	{ErrExpired, ErrorCodeExpired},
+	{ErrNBFInvalid, ErrorCodeNotYetValid},
+	{ErrIATInvalid, ErrorCodeIssuedInFuture},
+	{ErrAlgoInvalid, ErrorCodeAlgorithmMismatch},
+	{ErrAudienceInvalid, ErrorCodeAudienceMismatch},
+	{ErrIssuerInvalid, ErrorCodeIssuerMismatch},
+	{ErrInvalidSubject, ErrorCodeInvalidSubject},
+	{ErrCredentialsChanged, ErrorCodeCredentialsChanged},
+	{ErrTokenVersionStale, ErrorCodeTokenVersionStale},
+	{ErrTokenInDisallowedSource, ErrorCodeDisallowedSource},
+	{ErrCookieSignatureInvalid, ErrorCodeCookieSignature},
+	{ErrFingerprintMismatch, ErrorCodeFingerprintMismatch},
+	{ErrIPMismatch, ErrorCodeIPMismatch},
+	{ErrBodyHashMismatch, ErrorCodeBodyHashMismatch},
+	{ErrCSRFTokenMismatch, ErrorCodeCSRFMismatch},
+	{ErrTokenUseInvalid, ErrorCodeTokenUseInvalid},
+	{ErrClaimsSchemaViolation, ErrorCodeSchemaViolation},
+	{ErrClaimsTooLarge, ErrorCodeClaimsTooLarge},
+	{ErrMissingExpiry, ErrorCodeMissingExpiry},
+	{ErrTokenLifetimeExceeded, ErrorCodeLifetimeExceeded},
+	{ErrX5CChainInvalid, ErrorCodeX5CChainInvalid},
+	{ErrReplay, ErrorCodeReplay},
+	{ErrMissingNonce, ErrorCodeMissingNonce},
+	{ErrTokenAlreadyUsed, ErrorCodeTokenAlreadyUsed},
+	{ErrMissingJTI, ErrorCodeMissingJTI},
+	{ErrInvalidLogoutToken, ErrorCodeInvalidLogoutToken},
+	{ErrTypInvalid, ErrorCodeTypInvalid},
+	{ErrUnsupportedCritHeader, ErrorCodeUnsupportedCritHeader},
+	{ErrUnsupportedSerialization, ErrorCodeUnsupportedSerialization},
+	{ErrUntrustedProxy, ErrorCodeUntrustedProxy},
+	{ErrSessionLimitExceeded, ErrorCodeSessionLimitExceeded},
+	{ErrUsageCapExceeded, ErrorCodeUsageCapExceeded},
+	{ErrHostNotAllowed, ErrorCodeHostNotAllowed},
+	{ErrBodyTooLarge, ErrorCodeBodyTooLarge},
+	{ErrKeyUnavailable, ErrorCodeKeyUnavailable},
+	{ErrRolesUnavailable, ErrorCodeRolesUnavailable},
+	{ErrTokenVersionUnavailable, ErrorCodeTokenVersionUnavailable},
+	{ErrCredentialsUnavailable, ErrorCodeCredentialsUnavailable},
+	{ErrSessionsUnavailable, ErrorCodeSessionsUnavailable},
+	{ErrUsageUnavailable, ErrorCodeUsageUnavailable},
+	{ErrForbidden, ErrorCodeForbidden},
+	{ErrUnauthorized, ErrorCodeUnauthorized},
+}
+
+// AuthErrorCode returns the stable code of err, e.g. ErrorCodeExpired for ErrExpired,
+// ErrorCodeUnauthorized for errors of no more specific code and "" for nil.
+func AuthErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return ErrorCodeUnauthorized
+}
+
+// SourceError is the error Verify sets on the request context for tokens failing
+// verification, naming the source the token was found in, one of the TokenSource
+// constants. Its message is the one of the library error it unwraps to, so compare
+// it with errors.Is rather than ==, e.g.:
+//
+//	var serr *authentication.SourceError
+//	if errors.As(err, &serr) && errors.Is(err, authentication.ErrExpired) {
+//		log.Printf("expired token from %s", serr.Source)
+//	}
+type SourceError struct {
+	Source string
+	Err    error
+}
+
+func (e *SourceError) Error() string { return e.Err.Error() }
+
+func (e *SourceError) Unwrap() error { return e.Err }
+
+// unauthorizedError wraps a verification failure of no more specific library error,
+// e.g. a malformed token or a bad signature, so that it matches ErrUnauthorized.
+type unauthorizedError struct {
+	err error
+}
+
+func (e *unauthorizedError) Error() string { return ErrUnauthorized.Error() + ": " + e.err.Error() }
+
+func (e *unauthorizedError) Unwrap() error { return e.err }
+
+func (e *unauthorizedError) Is(target error) bool { return target == ErrUnauthorized }
+
+// contextError returns err as stored on the request context by Verify: the library
+// errors as they are and any other error wrapped to match ErrUnauthorized, still
+// unwrapping to the cause, e.g. a *jwt.ValidationError.
+func contextError(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return err
+		}
+	}
+	return &unauthorizedError{err}
+}
+
+// sourceError wraps err in a SourceError naming source, if the token was found.
+func sourceError(source string, err error) error {
+	if err == nil || source == "" {
+		return err
+	}
+	return &SourceError{Source: source, Err: err}
+}
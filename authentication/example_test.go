@@ -0,0 +1,37 @@
+package authentication_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/distributed-go/go-toolkit/authentication"
+)
+
+func ExampleJWTAuth_WrapHandlerFunc() {
+	tokenAuth := authentication.NewJWTAuth(authentication.Config{
+		JwtAuthAlgo: "HS256",
+		JwtExpiry:   time.Hour,
+		JwtParser:   &jwt.Parser{},
+		SignKey:     []byte("secretpass"),
+	})
+
+	admin := tokenAuth.WrapHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := authentication.AppClaimsFromCtx(r.Context())
+		fmt.Fprintf(w, "welcome %s", claims.UserID)
+	}, "ADMIN")
+
+	for _, roles := range [][]authentication.Role{{"ADMIN"}, {"USER"}} {
+		token, _ := tokenAuth.CreateJWT(&authentication.AppClaims{UserID: "123", Roles: roles})
+		req := httptest.NewRequest("GET", "/admin", nil)
+		req.Header.Set("Authorization", "BEARER "+token)
+		rec := httptest.NewRecorder()
+		admin(rec, req)
+		fmt.Println(rec.Code, rec.Body.String())
+	}
+	// Output:
+	// 200 welcome 123
+	// 401 Unauthorized
+}
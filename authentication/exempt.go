@@ -0,0 +1,33 @@
+package authentication
+
+import (
+	"net/http"
+	"strings"
+)
+
+// WithExemptPaths passes requests for the given paths, e.g. health checks and metrics,
+// straight through Verify, Authenticate, Optional and the Requires middlewares without
+// looking for a token. A pattern ending in "/" matches every path below it, other
+// patterns match the path exactly.
+func WithExemptPaths(patterns ...string) Option {
+	return func(ja *jwtAuth) {
+		ja.exemptPaths = patterns
+	}
+}
+
+// WithExemptFunc is like WithExemptPaths but exempts the requests exempt reports true for.
+func WithExemptFunc(exempt func(r *http.Request) bool) Option {
+	return func(ja *jwtAuth) {
+		ja.exemptFunc = exempt
+	}
+}
+
+// isExempt reports whether the request skips authentication.
+func (ja *jwtAuth) isExempt(r *http.Request) bool {
+	for _, pattern := range ja.exemptPaths {
+		if r.URL.Path == pattern || strings.HasSuffix(pattern, "/") && strings.HasPrefix(r.URL.Path, pattern) {
+			return true
+		}
+	}
+	return ja.exemptFunc != nil && ja.exemptFunc(r)
+}
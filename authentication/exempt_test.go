@@ -0,0 +1,58 @@
+package authentication
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+)
+
+func TestExemptPaths(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+	}, WithExemptPaths("/healthz", "/metrics/"), WithExemptFunc(func(r *http.Request) bool {
+		return strings.HasSuffix(r.URL.Path, ".css")
+	}))
+
+	r := chi.NewRouter()
+	r.Use(TokenAuthHS256.Verify(), TokenAuthHS256.Authenticate, TokenAuthHS256.RequiresRole("ADMIN"))
+	r.Get("/*", func(w http.ResponseWriter, r *http.Request) {
+		if token, _, _ := TokenFromContext(r.Context()); token != nil {
+			w.Write([]byte("verified"))
+			return
+		}
+		w.Write([]byte("skipped"))
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	admin := newAuthHeader(jwt.MapClaims{"uid": "1", "roles": []string{"ADMIN"}})
+	tests := []struct {
+		path   string
+		header http.Header
+		status int
+		resp   string
+	}{
+		{"/healthz", nil, 200, "skipped"},
+		{"/healthz", admin, 200, "skipped"},
+		{"/metrics/", nil, 200, "skipped"},
+		{"/metrics/process", nil, 200, "skipped"},
+		{"/static/site.css", nil, 200, "skipped"},
+		{"/healthz/details", nil, 401, "Unauthorized\n"},
+		{"/healthzz", nil, 401, "Unauthorized\n"},
+		{"/metrics", nil, 401, "Unauthorized\n"},
+		{"/admin", nil, 401, "Unauthorized\n"},
+		{"/admin", admin, 200, "verified"},
+	}
+	for _, tt := range tests {
+		if status, resp := testRequest(t, ts, "GET", tt.path, tt.header, nil); status != tt.status || resp != tt.resp {
+			t.Errorf("GET %s = %d %q, want %d %q", tt.path, status, resp, tt.status, tt.resp)
+		}
+	}
+}
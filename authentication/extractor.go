@@ -0,0 +1,41 @@
+package authentication
+
+import (
+	"context"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// TokenExtractor finds the token of a request received over a transport other
+// than net/http, e.g. a custom RPC framework, for ValidateFrom.
+type TokenExtractor interface {
+	// Extract returns the token string and the name of the source it was found
+	// in. An empty token string means the request carries no token.
+	Extract() (token string, source string, err error)
+}
+
+// ValidateFrom verifies the token returned by extractor as Verify does for http
+// requests. It returns errors as Verify stores them on the request context: the
+// library errors, others wrapped to match ErrUnauthorized, in a *SourceError if the
+// source is named.
+func (ja *jwtAuth) ValidateFrom(ctx context.Context, extractor TokenExtractor) (*jwt.Token, error) {
+	ja = ja.current()
+	tokenStr, source, err := extractor.Extract()
+	if err == nil && tokenStr == "" {
+		err = ErrNoTokenFound
+	}
+	if err != nil {
+		return nil, sourceError(source, contextError(err))
+	}
+	token, err := ja.verifySource(ctx, tokenStr, source)
+	return token, sourceError(source, contextError(err))
+}
+
+// verifySource verifies the token string found in source, the transport agnostic
+// part of Verify and ValidateFrom.
+func (ja *jwtAuth) verifySource(ctx context.Context, tokenStr, source string) (*jwt.Token, error) {
+	if source == TokenSourceMeshPayload {
+		return ja.meshPayloadToken(tokenStr)
+	}
+	return ja.verifyToken(ctx, tokenStr)
+}
@@ -0,0 +1,52 @@
+package authentication
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// rpcExtractor extracts tokens from the metadata of a fake RPC request.
+type rpcExtractor struct {
+	metadata map[string]string
+	err      error
+}
+
+func (e rpcExtractor) Extract() (string, string, error) {
+	return e.metadata["authorization"], "metadata", e.err
+}
+
+func TestValidateFrom(t *testing.T) {
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret})
+	errTransport := errors.New("metadata unreadable")
+
+	claims := jwt.MapClaims{"uid": "123", "roles": []string{}}
+	tests := []struct {
+		name      string
+		extractor rpcExtractor
+		err       error
+	}{
+		{"valid", rpcExtractor{metadata: map[string]string{"authorization": newJwtToken(TokenSecret, claims)}}, nil},
+		{"no token", rpcExtractor{}, ErrNoTokenFound},
+		{"wrong secret", rpcExtractor{metadata: map[string]string{"authorization": newJwtToken([]byte("wrong"), claims)}}, ErrUnauthorized},
+		{"expired", rpcExtractor{metadata: map[string]string{"authorization": newJwtToken(TokenSecret, jwt.MapClaims{"exp": 1})}}, ErrExpired},
+		{"extractor error", rpcExtractor{err: errTransport}, errTransport},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := ja.ValidateFrom(context.Background(), tt.extractor)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("ValidateFrom() error = %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && (token == nil || token.Claims.(jwt.MapClaims)["uid"] != "123") {
+				t.Fatalf("ValidateFrom() token = %v", token)
+			}
+			var serr *SourceError
+			if tt.err != nil && (!errors.As(err, &serr) || serr.Source != "metadata") {
+				t.Fatalf("ValidateFrom() error = %#v, want a metadata SourceError", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package authentication
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// WithAllowedHosts restricts the authenticator to requests for the given hosts, e.g.
+// "admin.internal" or "admin.internal:8443" to require the port too: Authenticate
+// rejects requests whose Host header names another host with ErrHostNotAllowed, even
+// with a valid token. Host names compare case insensitively. The Host header is set by
+// the client, not by the listener the request came in on, so this only filters what
+// clients claim: it binds tokens to a listener only behind a proxy routing requests to
+// the service by host and rejecting unknown ones.
+func WithAllowedHosts(hosts ...string) Option {
+	return func(ja *jwtAuth) {
+		ja.allowedHosts = hosts
+	}
+}
+
+// WithRequiredScheme binds the authenticator to the listeners serving scheme, "https"
+// for requests received over TLS, as told by r.TLS, or "http": Authenticate rejects
+// requests received over the other with ErrHostNotAllowed, even with a valid token.
+func WithRequiredScheme(scheme string) Option {
+	return func(ja *jwtAuth) {
+		ja.requiredScheme = scheme
+	}
+}
+
+// checkHost rejects requests received over a scheme, or naming a host in their Host
+// header, the authenticator isn't bound to.
+func (ja *jwtAuth) checkHost(r *http.Request) error {
+	if ja.requiredScheme != "" && !strings.EqualFold(requestScheme(r), ja.requiredScheme) {
+		return ErrHostNotAllowed
+	}
+	if ja.allowedHosts == nil {
+		return nil
+	}
+	hostname, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		hostname = r.Host
+	}
+	for _, host := range ja.allowedHosts {
+		if strings.EqualFold(host, r.Host) || strings.EqualFold(host, hostname) {
+			return nil
+		}
+	}
+	return ErrHostNotAllowed
+}
+
+// requestScheme returns the scheme the request was received over.
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
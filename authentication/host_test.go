@@ -0,0 +1,47 @@
+package authentication
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestAllowedHosts(t *testing.T) {
+	config := Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}
+	admin := NewJWTAuth(config, WithAllowedHosts("admin.internal", "10.0.0.5:8443"), WithRequiredScheme("https"))
+	h := admin.Verify()(admin.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})))
+
+	tests := []struct {
+		name   string
+		host   string
+		tls    bool
+		status int
+	}{
+		{"internal host", "admin.internal", true, 200},
+		{"internal host with port", "ADMIN.internal:443", true, 200},
+		{"internal address", "10.0.0.5:8443", true, 200},
+		{"internal address other port", "10.0.0.5:443", true, 403},
+		{"external host", "api.example.com", true, 403},
+		{"plain http", "admin.internal", false, 403},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Host = tt.host
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			req.Header = newAuthHeader(jwt.MapClaims{"uid": "1", "roles": []string{"ADMIN"}})
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("got %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
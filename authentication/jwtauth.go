@@ -1,36 +1,228 @@
 package authentication
 
 import (
+	"context"
+	"crypto/cipher"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 )
 
 type jwtAuth struct {
-	signKey          interface{}
-	verifyKey        interface{}
-	signer           jwt.SigningMethod
-	parser           *jwt.Parser
-	jwtExpiry        time.Duration
-	jwtRefreshExpiry time.Duration
+	signKey              interface{}
+	verifyKey            interface{}
+	algorithm            string
+	signer               jwt.SigningMethod
+	parser               *jwt.Parser
+	jwtExpiry            time.Duration
+	jwtRefreshExpiry     time.Duration
+	cookieName           string
+	cookieSecret         []byte
+	fingerprint          func(r *http.Request) string
+	csrfCookieName       string
+	baggage              BaggageFunc
+	baggageClaims        []string
+	expiryGrace          time.Duration
+	audience             []string
+	audienceFunc         func(r *http.Request) []string
+	audienceMode         AudienceMatchMode
+	tokenSources         []string
+	strictSources        bool
+	claimsSchema         *jsonSchema
+	nativeHMAC           bool
+	tokenUseClaim        string
+	rolesDelimiter       string
+	maxRoles             int
+	maxClaimsSize        int
+	maxBodySize          int64
+	credentialsChangedAt func(sub string) (time.Time, error)
+	tokenVersion         func(sub string) (int, error)
+	errorHandler         ErrorHandler
+	issuers              []string
+	leeway               time.Duration
+	keyFuncCtx           KeyFuncCtx
+	issuerKeyFunc        IssuerKeyFunc
+	requireExpiry        bool
+	relativeExpiryClaim  string
+	maxLifetime          time.Duration
+	caseInsensitiveRoles bool
+	roleScopes           map[Role][]string
+	roleResolver         *roleCache
+	regionFunc           func(r *http.Request) string
+	trustMeshPayload     bool
+	featuresClaim        string
+	claimsAEAD           cipher.AEAD
+	maxFutureSkew        time.Duration
+	deprecatedIssuers    []string
+	deprecatedKeyIDs     []string
+	deprecationReporter  func(r *http.Request, t DeprecatedToken)
+	x5cPool              *x509.CertPool
+	nonceStore           NonceStore
+	requireNonce         bool
+	debugTrace           *debugTracer
+	typs                 []string
+	exemptPaths          []string
+	exemptFunc           func(r *http.Request) bool
+	trustedProxies       []*net.IPNet
+	lazyClaims           bool
+	lenientBase64        bool
+	allowedHosts         []string
+	requiredScheme       string
+	hmacSecretFunc       HMACSecretFunc
+	tenantFunc           func(r *http.Request) string
+	subjectValidator     func(sub string) error
+	issuedAtClaim        string
+	issuedAtLayout       string
+	postAuthHooks        []PostAuthHook
+	claimsRoot           string
+	challengeURL         string
+	extractIP            func(r *http.Request) string
+	bodyHashBinding      bool
+	bodyHashHeaders      []string
+	sessionLimit         int
+	sessionStore         SessionStore
+	sessionEviction      bool
+	usageCap             int
+	usageStore           UsageStore
+	sourceFinders        []tokenFinder
+	tokenCtxKey          interface{}
+	claimsCtxKey         interface{}
+	errCtxKey            interface{}
+
+	// opts and live support Reconfigure
+	opts []Option
+	live atomic.Value
 }
 
 // NewJWTAuth creates a JWTAuth authenticator instance that provides middleware handlers
 // and encoding/decoding functions for JWT signing.
 // *jwt.Parser is custom parser settings introduced in jwt-go/v2.4.0.
-func NewJWTAuth(config Config) JWTAuth {
-	return &jwtAuth{
+func NewJWTAuth(config Config, opts ...Option) JWTAuth {
+	return newJWTAuth(config, opts...)
+}
+
+func newJWTAuth(config Config, opts ...Option) *jwtAuth {
+	ja := &jwtAuth{
 		signKey:          config.SignKey,
 		verifyKey:        config.VerifyKey,
+		algorithm:        config.JwtAuthAlgo,
 		signer:           jwt.GetSigningMethod(config.JwtAuthAlgo),
 		parser:           config.JwtParser,
 		jwtExpiry:        config.JwtExpiry,
 		jwtRefreshExpiry: config.JwtRefreshExpiry,
+		cookieName:       "jwt",
+		tokenUseClaim:    "token_use",
+		featuresClaim:    "features",
+		rolesDelimiter:   defaultRolesDelimiter,
+		maxBodySize:      defaultMaxBodySize,
+		errorHandler:     DefaultErrorHandler,
+		tokenSources:     []string{TokenSourceQuery, TokenSourceHeader, TokenSourceCookie},
+		issuers:          config.Issuers,
+		audience:         config.Audiences,
+		leeway:           config.Leeway,
+	}
+	if config.CookieName != "" {
+		ja.cookieName = config.CookieName
+	}
+	if config.TokenSources != nil {
+		ja.tokenSources = config.TokenSources
 	}
+	for _, opt := range opts {
+		opt(ja)
+	}
+	ja.opts = opts
+	ja.sourceFinders = ja.tokenFinders()
+	return ja
+}
+
+// NewFromConfig is like NewJWTAuth but for configuration loaded from a file: it
+// also reads the HMAC secret or the PEM encoded RSA or ECDSA keys of the config,
+// defaults to a parser accepting only the configured algorithm and validates the
+// result, see Validate.
+func NewFromConfig(config Config, opts ...Option) (JWTAuth, error) {
+	if config.JwtParser == nil {
+		config.JwtParser = &jwt.Parser{ValidMethods: []string{config.JwtAuthAlgo}}
+	}
+	if config.Secret != "" {
+		config.SignKey = []byte(config.Secret)
+	}
+	if config.SignKeyPEM != "" {
+		key, public, err := parsePrivateKeyPEM([]byte(config.SignKeyPEM))
+		if err != nil {
+			return nil, fmt.Errorf("authentication: sign key: %w", err)
+		}
+		config.SignKey = key
+		if config.VerifyKey == nil && config.VerifyKeyPEM == "" {
+			config.VerifyKey = public
+		}
+	}
+	if config.VerifyKeyPEM != "" {
+		key, err := parsePublicKeyPEM([]byte(config.VerifyKeyPEM))
+		if err != nil {
+			return nil, fmt.Errorf("authentication: verify key: %w", err)
+		}
+		config.VerifyKey = key
+	}
+
+	ja := NewJWTAuth(config, opts...)
+	if err := ja.Validate(); err != nil {
+		return nil, err
+	}
+	return ja, nil
+}
+
+// UnmarshalJSON decodes the config, accepting the durations as a number of
+// nanoseconds or as a string parsed by time.ParseDuration, e.g. "30s".
+func (c *Config) UnmarshalJSON(data []byte) error {
+	type config Config
+	aux := struct {
+		*config
+		JwtExpiry        jsonDuration `json:"jwtExpiry"`
+		JwtRefreshExpiry jsonDuration `json:"jwtRefreshExpiry"`
+		Leeway           jsonDuration `json:"leeway"`
+	}{
+		config:           (*config)(c),
+		JwtExpiry:        jsonDuration(c.JwtExpiry),
+		JwtRefreshExpiry: jsonDuration(c.JwtRefreshExpiry),
+		Leeway:           jsonDuration(c.Leeway),
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	c.JwtExpiry = time.Duration(aux.JwtExpiry)
+	c.JwtRefreshExpiry = time.Duration(aux.JwtRefreshExpiry)
+	c.Leeway = time.Duration(aux.Leeway)
+	return nil
+}
+
+// jsonDuration is a time.Duration decoded from a JSON number or duration string.
+type jsonDuration time.Duration
+
+func (d *jsonDuration) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return json.Unmarshal(data, (*time.Duration)(d))
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("authentication: %w", err)
+	}
+	*d = jsonDuration(v)
+	return nil
 }
 
 // GenTokenPair returns both an access token and a refresh token.
 func (ja *jwtAuth) GenTokenPair(accessClaims *AppClaims, refreshClaims *RefreshClaims) (string, string, error) {
+	ja = ja.current()
 	access, err := ja.CreateJWT(accessClaims)
 	if err != nil {
 		return "", "", err
@@ -42,18 +234,50 @@ func (ja *jwtAuth) GenTokenPair(accessClaims *AppClaims, refreshClaims *RefreshC
 	return access, refresh, nil
 }
 
-// CreateJWT returns an access token for provided account claims.
+// CreateJWT returns an access token for provided account claims, encoded as ToMap
+// returns them.
 func (ja *jwtAuth) CreateJWT(c *AppClaims) (string, error) {
+	ja = ja.current()
 	c.IssuedAt = time.Now().Unix()
 	c.ExpiresAt = time.Now().Add(ja.jwtExpiry).Unix()
-	_, tokenString, err := ja.Encode(c)
+	_, tokenString, err := ja.Encode(jwt.MapClaims(c.ToMap()))
 	return tokenString, err
 }
 
 // CreateRefreshJWT returns a refresh token for provided token Claims.
 func (ja *jwtAuth) CreateRefreshJWT(c *RefreshClaims) (string, error) {
+	ja = ja.current()
 	c.IssuedAt = time.Now().Unix()
 	c.ExpiresAt = time.Now().Add(ja.jwtExpiry).Unix()
 	_, tokenString, err := ja.Encode(c)
 	return tokenString, err
 }
+
+// Parse validates a token string outside of a http request, e.g. one received from a
+// message queue, like Verify does: it checks the signature, algorithm, times, issuer,
+// audience and the other token policies, uses up the nonce like Authenticate, see
+// WithNonceStore, and returns the parsed AppClaims or the library error the token
+// failed with, e.g. ErrExpired. The checks Authenticate runs on the request don't
+// apply: WithAudienceFunc, WithAllowedHosts, WithRequiredScheme, WithFingerprint,
+// WithIPBinding, WithBodyHashBinding, WithCSRFProtection, WithSessionLimit,
+// WithUsageCap and the WithPostAuth hooks. Deep link tokens, see CreateDeepLinkJWT,
+// fail with ErrTokenUseInvalid.
+func (ja *jwtAuth) Parse(tokenString string) (AppClaims, error) {
+	ja = ja.current()
+	token, err := ja.verifyToken(context.Background(), tokenString)
+	if err != nil {
+		return AppClaims{}, err
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	if err := ja.checkDeepLink(nil, claims); err != nil {
+		return AppClaims{}, err
+	}
+	var c AppClaims
+	if err := ja.parseClaims(&c, claims); err != nil {
+		return AppClaims{}, err
+	}
+	if err := ja.useNonce(token); err != nil {
+		return AppClaims{}, err
+	}
+	return c, nil
+}
@@ -1,8 +1,13 @@
 package authentication
 
 import (
+	"bytes"
+	"context"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,6 +15,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -125,7 +132,8 @@ func TestSimple(t *testing.T) {
 	}
 
 	// sending authorized requests
-	if status, resp := testRequest(t, ts, "GET", "/", newAuthHeader(), nil); status != 200 || resp != "welcome" {
+	h = newAuthHeader(jwt.MapClaims{"uid": "123", "roles": []string{"USER"}})
+	if status, resp := testRequest(t, ts, "GET", "/", h, nil); status != 200 || resp != "welcome" {
 		t.Fatalf(resp)
 	}
 }
@@ -148,18 +156,16 @@ func TestMore(t *testing.T) {
 				token, _, err := TokenFromContext(r.Context())
 
 				if err != nil {
-					switch err {
+					switch {
 					default:
 						http.Error(w, http.StatusText(401), 401)
 						return
-					case ErrExpired:
+					case errors.Is(err, ErrExpired):
 						http.Error(w, "expired", 401)
 						return
-					case ErrUnauthorized:
+					case errors.Is(err, ErrUnauthorized):
 						http.Error(w, http.StatusText(401), 401)
 						return
-					case nil:
-						// no error
 					}
 				}
 
@@ -237,6 +243,2083 @@ func TestMore(t *testing.T) {
 	}
 }
 
+func TestOptional(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+	})
+	TokenAuthNoKey := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+	})
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, ok := r.Context().Value(AccessClaimsCtxKey).(AppClaims); ok {
+			w.Write([]byte("hi " + c.UserID))
+			return
+		}
+		w.Write([]byte("welcome anonymous"))
+	})
+
+	r := chi.NewRouter()
+	r.With(TokenAuthHS256.Verify(), TokenAuthHS256.Optional).Get("/", handler)
+	r.With(TokenAuthNoKey.Verify(), TokenAuthNoKey.Optional).Get("/nokey", handler)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	if status, resp := testRequest(t, ts, "GET", "/", nil, nil); status != 200 || resp != "welcome anonymous" {
+		t.Fatalf(resp)
+	}
+
+	h := newAuthHeader(jwt.MapClaims{"exp": time.Now().UTC().Unix() - 1000})
+	if status, resp := testRequest(t, ts, "GET", "/", h, nil); status != 200 || resp != "welcome anonymous" {
+		t.Fatalf(resp)
+	}
+
+	h = newAuthHeader(jwt.MapClaims{"uid": "123", "roles": []string{"USER"}})
+	if status, resp := testRequest(t, ts, "GET", "/", h, nil); status != 200 || resp != "hi 123" {
+		t.Fatalf(resp)
+	}
+
+	// the verifier has no key to check the token with
+	if status, resp := testRequest(t, ts, "GET", "/nokey", h, nil); status != 503 {
+		t.Fatalf(resp)
+	}
+	if status, resp := testRequest(t, ts, "GET", "/nokey", nil, nil); status != 200 || resp != "welcome anonymous" {
+		t.Fatalf(resp)
+	}
+}
+
+func TestCookieSignature(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+	}, WithCookieSignature([]byte("cookiesecret")))
+
+	r := chi.NewRouter()
+	r.Use(TokenAuthHS256.Verify())
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		_, _, err := TokenFromContext(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), 401)
+			return
+		}
+		w.Write([]byte("welcome"))
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	rec := httptest.NewRecorder()
+	TokenAuthHS256.SetTokenCookie(rec, newJwtToken(TokenSecret))
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 2 || cookies[0].Name != "jwt" || cookies[1].Name != "jwt.sig" {
+		t.Fatalf("unexpected cookies %v", cookies)
+	}
+
+	token, sig := "jwt="+cookies[0].Value, "jwt.sig="+cookies[1].Value
+
+	h := http.Header{}
+	h.Set("Cookie", token+"; "+sig)
+	if status, resp := testRequest(t, ts, "GET", "/", h, nil); status != 200 || resp != "welcome" {
+		t.Fatalf(resp)
+	}
+
+	// truncated token cookie
+	h.Set("Cookie", token[:len(token)-4]+"; "+sig)
+	if status, resp := testRequest(t, ts, "GET", "/", h, nil); status != 401 || resp != ErrCookieSignatureInvalid.Error()+"\n" {
+		t.Fatalf(resp)
+	}
+
+	// missing signature cookie
+	h.Set("Cookie", token)
+	if status, resp := testRequest(t, ts, "GET", "/", h, nil); status != 401 || resp != ErrCookieSignatureInvalid.Error()+"\n" {
+		t.Fatalf(resp)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	fingerprint := func(r *http.Request) string {
+		return r.Header.Get("User-Agent") + "|" + r.Header.Get("Sec-CH-UA-Platform")
+	}
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+	}, WithFingerprint(fingerprint))
+
+	r := chi.NewRouter()
+	r.Use(TokenAuthHS256.Verify(), TokenAuthHS256.Authenticate)
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		status int
+	}{
+		{"match", jwt.MapClaims{"uid": "123", "roles": []string{}, "fp": "test-agent|Linux"}, 200},
+		{"mismatch", jwt.MapClaims{"uid": "123", "roles": []string{}, "fp": "other-agent|Linux"}, 403},
+		{"absent", jwt.MapClaims{"uid": "123", "roles": []string{}}, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newAuthHeader(tt.claims)
+			h.Set("User-Agent", "test-agent")
+			h.Set("Sec-CH-UA-Platform", "Linux")
+			if status, resp := testRequest(t, ts, "GET", "/", h, nil); status != tt.status {
+				t.Fatalf("status = %d, want %d: %s", status, tt.status, resp)
+			}
+		})
+	}
+}
+
+func TestCSRFProtection(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+	}, WithCSRFProtection("csrf"))
+
+	r := chi.NewRouter()
+	r.Use(TokenAuthHS256.Verify(), TokenAuthHS256.Authenticate)
+	r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	token := newJwtToken(TokenSecret, jwt.MapClaims{"uid": "123", "roles": []string{}})
+
+	tests := []struct {
+		name   string
+		method string
+		header http.Header
+		status int
+	}{
+		{"cookie token with matching header", "POST", http.Header{"Cookie": {"jwt=" + token + "; csrf=abc"}, CSRFHeader: {"abc"}}, 200},
+		{"cookie token with wrong header", "POST", http.Header{"Cookie": {"jwt=" + token + "; csrf=abc"}, CSRFHeader: {"xyz"}}, 403},
+		{"cookie token without header", "POST", http.Header{"Cookie": {"jwt=" + token + "; csrf=abc"}}, 403},
+		{"cookie token without csrf cookie", "POST", http.Header{"Cookie": {"jwt=" + token}, CSRFHeader: {"abc"}}, 403},
+		{"cookie token on safe method", "GET", http.Header{"Cookie": {"jwt=" + token}}, 200},
+		{"header token", "POST", http.Header{"Authorization": {"BEARER " + token}}, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, resp := testRequest(t, ts, tt.method, "/", tt.header, nil); status != tt.status {
+				t.Fatalf("status = %d, want %d: %s", status, tt.status, resp)
+			}
+		})
+	}
+}
+
+func TestBaggage(t *testing.T) {
+	type baggageKey struct{}
+	set := func(ctx context.Context, members map[string]string) context.Context {
+		return context.WithValue(ctx, baggageKey{}, members)
+	}
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+	}, WithBaggage(set, "sub", "tenant_id"))
+
+	r := chi.NewRouter()
+	r.Use(TokenAuthHS256.Verify(), TokenAuthHS256.Authenticate)
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		members, _ := r.Context().Value(baggageKey{}).(map[string]string)
+		w.Write([]byte(fmt.Sprintf("%v", members)))
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	h := newAuthHeader(jwt.MapClaims{"uid": "123", "roles": []string{}, "sub": "user-1", "tenant_id": "acme", "email": "mike@example.com"})
+	if status, resp := testRequest(t, ts, "GET", "/", h, nil); status != 200 || resp != "map[sub:user-1 tenant_id:acme]" {
+		t.Fatalf(resp)
+	}
+}
+
+func TestExpiryGrace(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+	}, WithExpiryGrace(5*time.Minute))
+
+	r := chi.NewRouter()
+	r.Use(TokenAuthHS256.Verify(), TokenAuthHS256.Authenticate)
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(w.Header().Get(RefreshRecommendedHeader)))
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		exp    time.Duration
+		status int
+		resp   string
+	}{
+		{"not expired", time.Minute, 200, ""},
+		{"within grace", -time.Minute, 200, "true"},
+		{"beyond grace", -10 * time.Minute, 401, "Unauthorized\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newAuthHeader(jwt.MapClaims{"uid": "123", "roles": []string{}, "exp": time.Now().Add(tt.exp).Unix()})
+			if status, resp := testRequest(t, ts, "GET", "/", h, nil); status != tt.status || resp != tt.resp {
+				t.Fatalf("got %d %q, want %d %q", status, resp, tt.status, tt.resp)
+			}
+		})
+	}
+}
+
+func TestAudienceFunc(t *testing.T) {
+	audiences := map[string][]string{
+		"api.example.com":   {"https://api.example.com"},
+		"admin.example.com": {"https://admin.example.com", "admin"},
+	}
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+	}, WithAudienceFunc(func(r *http.Request) []string {
+		return audiences[r.Host]
+	}))
+
+	r := chi.NewRouter()
+	r.Use(TokenAuthHS256.Verify())
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		if _, _, err := TokenFromContext(r.Context()); err != nil {
+			http.Error(w, err.Error(), 401)
+			return
+		}
+		w.Write([]byte("welcome"))
+	})
+	r.With(TokenAuthHS256.Authenticate).Get("/authenticated", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome " + AppClaimsFromCtx(r.Context()).UserID))
+	})
+
+	tests := []struct {
+		name   string
+		host   string
+		aud    interface{}
+		status int
+	}{
+		{"matching string audience", "api.example.com", "https://api.example.com", 200},
+		{"matching array audience", "admin.example.com", []string{"other", "admin"}, 200},
+		{"audience of another host", "admin.example.com", "https://api.example.com", 401},
+		{"unknown host", "evil.example.com", "https://api.example.com", 401},
+		{"no audience", "api.example.com", nil, 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := jwt.MapClaims{"uid": "123", "roles": []string{}}
+			if tt.aud != nil {
+				claims["aud"] = tt.aud
+			}
+			for _, path := range []string{"/", "/authenticated"} {
+				req := httptest.NewRequest("GET", path, nil)
+				req.Host = tt.host
+				req.Header = newAuthHeader(claims)
+				rec := httptest.NewRecorder()
+				r.ServeHTTP(rec, req)
+				if rec.Code != tt.status {
+					t.Fatalf("GET %s: status = %d, want %d", path, rec.Code, tt.status)
+				}
+			}
+		})
+	}
+}
+
+func TestStrictSources(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+	}, WithTokenSources(TokenSourceHeader), WithStrictSources())
+
+	r := chi.NewRouter()
+	r.Use(TokenAuthHS256.Verify())
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		if _, _, err := TokenFromContext(r.Context()); err != nil {
+			http.Error(w, err.Error(), 401)
+			return
+		}
+		w.Write([]byte("welcome"))
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	token := newJwtToken(TokenSecret)
+	if status, resp := testRequest(t, ts, "GET", "/", newAuthHeader(), nil); status != 200 || resp != "welcome" {
+		t.Fatalf(resp)
+	}
+	if status, resp := testRequest(t, ts, "GET", "/?jwt="+token, nil, nil); status != 401 || resp != ErrTokenInDisallowedSource.Error()+"\n" {
+		t.Fatalf(resp)
+	}
+	h := newAuthHeader()
+	h.Set("Cookie", "jwt="+token)
+	if status, resp := testRequest(t, ts, "GET", "/", h, nil); status != 401 || resp != ErrTokenInDisallowedSource.Error()+"\n" {
+		t.Fatalf(resp)
+	}
+}
+
+func TestAutoRefresh(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+		JwtExpiry:   time.Hour,
+	})
+
+	r := chi.NewRouter()
+	r.Use(TokenAuthHS256.Verify(), TokenAuthHS256.Authenticate, TokenAuthHS256.AutoRefresh(5*time.Minute))
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})
+	r.With(TokenAuthHS256.RequiresRole("ADMIN")).Get("/admin", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome admin"))
+	})
+	r.Get("/silent", func(w http.ResponseWriter, r *http.Request) {})
+
+	claims := func(exp time.Duration) jwt.MapClaims {
+		return jwt.MapClaims{"uid": "123", "roles": []string{"USER"}, "iat": time.Now().Unix(), "exp": time.Now().Add(exp).Unix()}
+	}
+	var serveAt func(path string, h http.Header) *http.Response
+	serve := func(h http.Header) *http.Response {
+		return serveAt("/", h)
+	}
+	serveAt = func(path string, h http.Header) *http.Response {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header = h
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+
+	// token far from expiry
+	resp := serve(newAuthHeader(claims(time.Hour)))
+	if resp.StatusCode != 200 || resp.Header.Get(RefreshedTokenHeader) != "" {
+		t.Fatalf("token far from expiry should not be refreshed")
+	}
+
+	// token close to expiry
+	resp = serve(newAuthHeader(claims(2 * time.Minute)))
+	refreshed := resp.Header.Get(RefreshedTokenHeader)
+	if resp.StatusCode != 200 || refreshed == "" {
+		t.Fatalf("token close to expiry should be refreshed")
+	}
+	token, err := TokenAuthHS256.Decode(refreshed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh := token.Claims.(jwt.MapClaims)
+	if exp, _ := toInt64(fresh["exp"]); exp < time.Now().Add(59*time.Minute).Unix() {
+		t.Fatalf("refreshed token exp = %v, want about an hour from now", fresh["exp"])
+	}
+	if fresh["uid"] != "123" || !reflect.DeepEqual(fresh["roles"], []interface{}{"USER"}) || len(fresh) != 4 {
+		t.Fatalf("refreshed token claims = %v", fresh)
+	}
+
+	// token sent in a cookie is refreshed with a cookie
+	h := http.Header{}
+	h.Set("Cookie", "jwt="+newJwtToken(TokenSecret, claims(time.Minute)))
+	resp = serve(h)
+	if cookies := resp.Cookies(); resp.StatusCode != 200 || len(cookies) != 1 || cookies[0].Name != "jwt" {
+		t.Fatalf("cookie token should be refreshed with a cookie, got %v", cookies)
+	}
+
+	// token of a request denied further down the chain
+	resp = serveAt("/admin", newAuthHeader(claims(2*time.Minute)))
+	if resp.StatusCode != 401 || resp.Header.Get(RefreshedTokenHeader) != "" {
+		t.Fatalf("denied request: got %d with refreshed token %q, want 401 without", resp.StatusCode, resp.Header.Get(RefreshedTokenHeader))
+	}
+
+	// token of a request served without a body
+	resp = serveAt("/silent", newAuthHeader(claims(2*time.Minute)))
+	if resp.StatusCode != 200 || resp.Header.Get(RefreshedTokenHeader) == "" {
+		t.Fatalf("empty response: token close to expiry should be refreshed")
+	}
+}
+
+func TestAudienceMatchMode(t *testing.T) {
+	config := Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}
+	anyAuth := NewJWTAuth(config, WithAudience("billing", "accounts")).(*jwtAuth)
+	allAuth := NewJWTAuth(config, WithAudience("billing", "accounts"), WithAudienceMatchMode(AudienceMatchAll)).(*jwtAuth)
+
+	tests := []struct {
+		name    string
+		aud     interface{}
+		wantAny error
+		wantAll error
+	}{
+		{"single string", "billing", nil, ErrAudienceInvalid},
+		{"array with one", []string{"accounts"}, nil, ErrAudienceInvalid},
+		{"array with all", []string{"accounts", "billing", "reports"}, nil, nil},
+		{"unrelated string", "reports", ErrAudienceInvalid, ErrAudienceInvalid},
+		{"unrelated array", []string{"reports"}, ErrAudienceInvalid, ErrAudienceInvalid},
+		{"absent", nil, ErrAudienceInvalid, ErrAudienceInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := jwt.MapClaims{}
+			if tt.aud != nil {
+				claims["aud"] = tt.aud
+			}
+			tokenString := newJwtToken(TokenSecret, claims)
+			if _, err := anyAuth.verifyToken(context.Background(), tokenString); err != tt.wantAny {
+				t.Errorf("AudienceMatchAny error = %v, want %v", err, tt.wantAny)
+			}
+			if _, err := allAuth.verifyToken(context.Background(), tokenString); err != tt.wantAll {
+				t.Errorf("AudienceMatchAll error = %v, want %v", err, tt.wantAll)
+			}
+		})
+	}
+
+	// Accepted array audiences authenticate too
+	h := allAuth.Verify()(allAuth.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome " + AppClaimsFromCtx(r.Context()).UserID))
+	})))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header = newAuthHeader(jwt.MapClaims{"uid": "123", "roles": []string{}, "aud": []string{"accounts", "billing"}})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != 200 || rec.Body.String() != "welcome 123" {
+		t.Fatalf("Authenticate: got %d %q, want 200", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRequiresTokenUse(t *testing.T) {
+	config := Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}
+	tests := []struct {
+		name   string
+		opts   []Option
+		claims jwt.MapClaims
+		status int
+	}{
+		{"cognito access token", nil, jwt.MapClaims{"token_use": "access"}, 200},
+		{"cognito id token", nil, jwt.MapClaims{"token_use": "id"}, 401},
+		{"custom claim name", []Option{WithTokenUseClaim("use")}, jwt.MapClaims{"use": "id", "token_use": "access"}, 401},
+		{"inferred id token from azp", nil, jwt.MapClaims{"aud": "client-1", "azp": "client-1"}, 401},
+		{"inferred id token from nonce", nil, jwt.MapClaims{"aud": "api", "nonce": "n-0S6_WzA2Mj"}, 401},
+		{"inferred access token", nil, jwt.MapClaims{"aud": "api", "azp": "client-1"}, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ja := NewJWTAuth(config, tt.opts...)
+			r := chi.NewRouter()
+			r.Use(ja.Verify(), ja.RequiresTokenUse("access"))
+			r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("welcome"))
+			})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header = newAuthHeader(tt.claims)
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestRequiresRoleOrdering(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+	})
+	welcome := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	}
+
+	r := chi.NewRouter()
+	r.With(TokenAuthHS256.Verify(), TokenAuthHS256.Authenticate, TokenAuthHS256.RequiresRole("ADMIN")).Get("/authenticated", welcome)
+	r.With(TokenAuthHS256.Verify(), TokenAuthHS256.RequiresRole("ADMIN")).Get("/verified", welcome)
+	r.With(TokenAuthHS256.RequiresRole("ADMIN")).Get("/unverified", welcome)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	admin := newAuthHeader(jwt.MapClaims{"uid": "1", "roles": []string{"ADMIN"}})
+	user := newAuthHeader(jwt.MapClaims{"uid": "2", "roles": []string{"USER"}})
+	tests := []struct {
+		path   string
+		header http.Header
+		status int
+	}{
+		{"/authenticated", admin, 200},
+		{"/authenticated", user, 401},
+		{"/authenticated", nil, 401},
+		{"/verified", admin, 200},
+		{"/verified", user, 401},
+		{"/verified", nil, 401},
+		{"/unverified", admin, 401},
+	}
+	for _, tt := range tests {
+		if status, resp := testRequest(t, ts, "GET", tt.path, tt.header, nil); status != tt.status {
+			t.Errorf("GET %s = %d %q, want %d", tt.path, status, resp, tt.status)
+		}
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	config := Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}
+	notYetValid := newAuthHeader(jwt.MapClaims{"uid": "123", "roles": []string{}, "nbf": time.Now().Add(time.Minute).Unix()})
+
+	// default error handler
+	TokenAuthHS256 := NewJWTAuth(config)
+	r := chi.NewRouter()
+	r.Use(TokenAuthHS256.Verify(), TokenAuthHS256.Authenticate)
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header = notYetValid
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	want := `Bearer error="invalid_token", error_description="token not yet valid"`
+	if rec.Code != 401 || rec.Header().Get("WWW-Authenticate") != want {
+		t.Fatalf("got %d %q, want 401 %q", rec.Code, rec.Header().Get("WWW-Authenticate"), want)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != 401 || rec.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Fatalf("got %d %q, want 401 \"Bearer\"", rec.Code, rec.Header().Get("WWW-Authenticate"))
+	}
+
+	// custom error handler
+	var handled error
+	TokenAuthHS256 = NewJWTAuth(config, WithErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+		handled = err
+		http.Error(w, "retry later", 401)
+	}))
+	r = chi.NewRouter()
+	r.Use(TokenAuthHS256.Verify(), TokenAuthHS256.Authenticate)
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header = notYetValid
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if !errors.Is(handled, ErrNBFInvalid) || rec.Body.String() != "retry later\n" {
+		t.Fatalf("error handler got %v, want %v", handled, ErrNBFInvalid)
+	}
+}
+
+func TestAuthSchemesErrorHandler(t *testing.T) {
+	config := Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}
+	TokenAuthHS256 := NewJWTAuth(config, WithErrorHandler(AuthSchemesErrorHandler("ApiKey", "Bearer")))
+	r := chi.NewRouter()
+	r.Use(TokenAuthHS256.Verify(), TokenAuthHS256.Authenticate)
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})
+
+	tests := []struct {
+		name      string
+		header    http.Header
+		challenge []string
+		body      string
+	}{
+		{"no token", nil, []string{"ApiKey", "Bearer"}, `{"error":"no_token","schemes":["ApiKey","Bearer"]}`},
+		{"expired", newAuthHeader(jwt.MapClaims{"uid": "123", "roles": []string{}, "exp": 1}),
+			[]string{"ApiKey", `Bearer error="invalid_token", error_description="token is expired"`},
+			`{"error":"token_expired","error_description":"token is expired","schemes":["ApiKey","Bearer"]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.header != nil {
+				req.Header = tt.header
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != 401 || !reflect.DeepEqual(rec.Header()["Www-Authenticate"], tt.challenge) {
+				t.Fatalf("got %d %q, want 401 %q", rec.Code, rec.Header()["Www-Authenticate"], tt.challenge)
+			}
+			if body := strings.TrimSpace(rec.Body.String()); body != tt.body || rec.Header().Get("Content-Type") != "application/json" {
+				t.Fatalf("got body %s, want %s", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestIssuerAndLeeway(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+		Issuers:     []string{"https://issuer.example"},
+		Leeway:      time.Minute,
+	})
+
+	r := chi.NewRouter()
+	r.Use(TokenAuthHS256.Verify(), TokenAuthHS256.Authenticate)
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		status int
+	}{
+		{"accepted issuer", jwt.MapClaims{"iss": "https://issuer.example"}, 200},
+		{"other issuer", jwt.MapClaims{"iss": "https://other.example"}, 401},
+		{"no issuer", jwt.MapClaims{}, 401},
+		{"expired within leeway", jwt.MapClaims{"iss": "https://issuer.example", "exp": time.Now().Add(-30 * time.Second).Unix()}, 200},
+		{"expired beyond leeway", jwt.MapClaims{"iss": "https://issuer.example", "exp": time.Now().Add(-2 * time.Minute).Unix()}, 401},
+		{"not yet valid within leeway", jwt.MapClaims{"iss": "https://issuer.example", "nbf": time.Now().Add(30 * time.Second).Unix()}, 200},
+		{"not yet valid beyond leeway", jwt.MapClaims{"iss": "https://issuer.example", "nbf": time.Now().Add(2 * time.Minute).Unix()}, 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.claims["uid"] = "123"
+			tt.claims["roles"] = []string{}
+			if status, _ := testRequest(t, ts, "GET", "/", newAuthHeader(tt.claims), nil); status != tt.status {
+				t.Fatalf("got %d, want %d", status, tt.status)
+			}
+		})
+	}
+}
+
+func TestKeyFuncCtx(t *testing.T) {
+	type tenantKey struct{}
+	tenantSecrets := map[string][]byte{
+		"acme":   []byte("acme-secret"),
+		"globex": []byte("globex-secret"),
+	}
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+	}, WithKeyFuncCtx(func(ctx context.Context, kid string) (interface{}, error) {
+		tenant, _ := ctx.Value(tenantKey{}).(string)
+		if secret, ok := tenantSecrets[tenant]; ok {
+			return secret, nil
+		}
+		return nil, ErrKeyUnavailable
+	}))
+	if err := TokenAuthHS256.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tenant := strings.SplitN(r.Host, ".", 2)[0]
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, tenant)))
+		})
+	})
+	r.Use(TokenAuthHS256.Verify(), TokenAuthHS256.Authenticate)
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})
+
+	claims := jwt.MapClaims{"uid": "123", "roles": []string{}}
+	tests := []struct {
+		name   string
+		host   string
+		secret []byte
+		status int
+	}{
+		{"acme token for acme", "acme.example.com", tenantSecrets["acme"], 200},
+		{"globex token for globex", "globex.example.com", tenantSecrets["globex"], 200},
+		{"acme token for globex", "globex.example.com", tenantSecrets["acme"], 401},
+		{"unknown tenant", "initech.example.com", tenantSecrets["acme"], 503},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://"+tt.host+"/", nil)
+			req.Header.Set("Authorization", "BEARER "+newJwtToken(tt.secret, claims))
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("got %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestTokenLifetime(t *testing.T) {
+	config := Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}
+	requireExpiry := NewJWTAuth(config, WithRequireExpiry()).(*jwtAuth)
+	maxLifetime := NewJWTAuth(config, WithMaxTokenLifetime(time.Hour)).(*jwtAuth)
+
+	now := time.Now()
+	tests := []struct {
+		name              string
+		claims            jwt.MapClaims
+		wantRequireExpiry error
+		wantMaxLifetime   error
+	}{
+		{"no exp", jwt.MapClaims{"iat": now.Unix()}, ErrMissingExpiry, ErrTokenLifetimeExceeded},
+		{"short lifetime", jwt.MapClaims{"iat": now.Unix(), "exp": now.Add(time.Minute).Unix()}, nil, nil},
+		{"over-long lifetime", jwt.MapClaims{"iat": now.Unix(), "exp": now.Add(24 * time.Hour).Unix()}, nil, ErrTokenLifetimeExceeded},
+		{"over-long remaining lifetime without iat", jwt.MapClaims{"exp": now.Add(24 * time.Hour).Unix()}, nil, ErrTokenLifetimeExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokenString := newJwtToken(TokenSecret, tt.claims)
+			if _, err := requireExpiry.verifyToken(context.Background(), tokenString); err != tt.wantRequireExpiry {
+				t.Errorf("WithRequireExpiry: got %v, want %v", err, tt.wantRequireExpiry)
+			}
+			if _, err := maxLifetime.verifyToken(context.Background(), tokenString); err != tt.wantMaxLifetime {
+				t.Errorf("WithMaxTokenLifetime: got %v, want %v", err, tt.wantMaxLifetime)
+			}
+		})
+	}
+}
+
+func TestIssuerKeyFunc(t *testing.T) {
+	issuerKeys := map[string]map[string][]byte{
+		"https://a.example": {"k1": []byte("issuer-a-secret")},
+		"https://b.example": {"k1": []byte("issuer-b-secret")},
+	}
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}},
+		WithIssuerKeyFunc(func(ctx context.Context, iss, kid string) (interface{}, error) {
+			keys, ok := issuerKeys[iss]
+			if !ok {
+				return nil, ErrIssuerInvalid
+			}
+			if key, ok := keys[kid]; ok {
+				return key, nil
+			}
+			return nil, ErrKeyUnavailable
+		}))
+	if err := ja.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	newToken := func(iss string, secret []byte) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"uid": "123", "roles": []string{}, "iss": iss})
+		token.Header["kid"] = "k1"
+		tokenStr, err := token.SignedString(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokenStr
+	}
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"issuer a", newToken("https://a.example", issuerKeys["https://a.example"]["k1"]), nil},
+		{"issuer b", newToken("https://b.example", issuerKeys["https://b.example"]["k1"]), nil},
+		{"issuer a signed by b", newToken("https://a.example", issuerKeys["https://b.example"]["k1"]), ErrUnauthorized},
+		{"issuer b signed by a", newToken("https://b.example", issuerKeys["https://a.example"]["k1"]), ErrUnauthorized},
+		{"unknown issuer", newToken("https://c.example", issuerKeys["https://a.example"]["k1"]), ErrIssuerInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ja.Parse(tt.token); !errors.Is(contextError(err), tt.err) {
+				t.Fatalf("Parse() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCaseInsensitiveRoles(t *testing.T) {
+	config := Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}
+	exact := NewJWTAuth(config)
+	folded := NewJWTAuth(config, WithCaseInsensitiveRoles())
+	welcome := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	}
+
+	r := chi.NewRouter()
+	r.With(exact.Verify(), exact.Authenticate, exact.RequiresRole("ADMIN")).Get("/exact", welcome)
+	r.With(folded.Verify(), folded.Authenticate, folded.RequiresRole("ADMIN")).Get("/folded", welcome)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	tests := []struct {
+		role         string
+		exactStatus  int
+		foldedStatus int
+	}{
+		{"ADMIN", 200, 200},
+		{"Admin", 401, 200},
+		{"admin", 401, 200},
+		{"administrator", 401, 401},
+	}
+	for _, tt := range tests {
+		h := newAuthHeader(jwt.MapClaims{"uid": "1", "roles": []string{tt.role}})
+		if status, _ := testRequest(t, ts, "GET", "/exact", h, nil); status != tt.exactStatus {
+			t.Errorf("role %q: GET /exact = %d, want %d", tt.role, status, tt.exactStatus)
+		}
+		if status, _ := testRequest(t, ts, "GET", "/folded", h, nil); status != tt.foldedStatus {
+			t.Errorf("role %q: GET /folded = %d, want %d", tt.role, status, tt.foldedStatus)
+		}
+	}
+}
+
+func TestCapDeadlineToExpiry(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+	})
+
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	tests := []struct {
+		name         string
+		claims       jwt.MapClaims
+		deadline     time.Time
+		wantDeadline time.Time
+	}{
+		{"no deadline", jwt.MapClaims{"exp": exp.Unix()}, time.Time{}, exp},
+		{"later deadline", jwt.MapClaims{"exp": exp.Unix()}, exp.Add(time.Hour), exp},
+		{"sooner deadline", jwt.MapClaims{"exp": exp.Unix()}, exp.Add(-time.Minute), exp.Add(-time.Minute)},
+		{"no expiry", jwt.MapClaims{}, time.Time{}, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got time.Time
+			h := TokenAuthHS256.Verify()(TokenAuthHS256.Authenticate(TokenAuthHS256.CapDeadlineToExpiry()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, _ = r.Context().Deadline()
+			}))))
+
+			tt.claims["uid"] = "123"
+			tt.claims["roles"] = []string{}
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header = newAuthHeader(tt.claims)
+			if !tt.deadline.IsZero() {
+				ctx, cancel := context.WithDeadline(req.Context(), tt.deadline)
+				defer cancel()
+				req = req.WithContext(ctx)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+			if !got.Equal(tt.wantDeadline) {
+				t.Fatalf("deadline = %v, want %v", got, tt.wantDeadline)
+			}
+		})
+	}
+
+	// A token accepted past its expiry keeps its authorization until then
+	expired := time.Now().Add(-10 * time.Second).Truncate(time.Second)
+	for name, opt := range map[string]Option{"leeway": WithLeeway(time.Minute), "grace": WithExpiryGrace(time.Minute)} {
+		ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}, WithLeeway(time.Second), opt)
+		var got time.Time
+		h := ja.Verify()(ja.Authenticate(ja.CapDeadlineToExpiry()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ = r.Context().Deadline()
+		}))))
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header = newAuthHeader(jwt.MapClaims{"uid": "123", "roles": []string{}, "exp": expired.Unix()})
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if want := expired.Add(time.Minute); !got.Equal(want) {
+			t.Fatalf("%s: deadline = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestTokenSourceFromCtx(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+	})
+
+	r := chi.NewRouter()
+	r.Use(TokenAuthHS256.Verify())
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		source, ok := TokenSourceFromCtx(r.Context())
+		w.Write([]byte(fmt.Sprintf("%s %v", source, ok)))
+	})
+
+	tokenString := newJwtToken(TokenSecret, jwt.MapClaims{"uid": "123", "roles": []string{}})
+	tests := []struct {
+		name    string
+		request func(req *http.Request)
+		want    string
+	}{
+		{"query", func(req *http.Request) { req.URL.RawQuery = "jwt=" + tokenString }, "query true"},
+		{"header", func(req *http.Request) { req.Header.Set("Authorization", "BEARER "+tokenString) }, "header true"},
+		{"cookie", func(req *http.Request) { req.AddCookie(&http.Cookie{Name: "jwt", Value: tokenString}) }, "cookie true"},
+		{"invalid header token", func(req *http.Request) { req.Header.Set("Authorization", "BEARER invalid") }, "header true"},
+		{"no token", func(req *http.Request) {}, " false"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			tt.request(req)
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Body.String() != tt.want {
+				t.Fatalf("got %q, want %q", rec.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestAlgorithmDowngrade(t *testing.T) {
+	for _, native := range []bool{false, true} {
+		t.Run(fmt.Sprintf("native HMAC %v", native), func(t *testing.T) {
+			var opts []Option
+			if native {
+				opts = append(opts, WithNativeHMAC())
+			}
+			TokenAuthHS512 := NewJWTAuth(Config{
+				JwtAuthAlgo: "HS512",
+				JwtParser:   &jwt.Parser{ValidMethods: []string{"HS256", "HS512"}},
+				SignKey:     TokenSecret,
+			}, opts...).(*jwtAuth)
+
+			claims := jwt.MapClaims{"uid": "123", "roles": []string{}}
+			if _, err := TokenAuthHS512.verifyToken(context.Background(), newJwtToken(TokenSecret, claims)); err != ErrAlgoInvalid {
+				t.Fatalf("HS256 token: got %v, want %v", err, ErrAlgoInvalid)
+			}
+			if _, err := TokenAuthHS512.verifyToken(context.Background(), newJwt512Token(TokenSecret, claims)); err != nil {
+				t.Fatalf("HS512 token: got %v", err)
+			}
+		})
+	}
+}
+
+func TestMeshSources(t *testing.T) {
+	config := Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}
+	sources := WithTokenSources(TokenSourceMeshPayload, TokenSourceForwardedAccessToken)
+	trusted := NewJWTAuth(config, sources, WithTrustedMeshPayload())
+	untrusted := NewJWTAuth(config, sources)
+	welcome := func(w http.ResponseWriter, r *http.Request) {
+		source, _ := TokenSourceFromCtx(r.Context())
+		w.Write([]byte(source))
+	}
+
+	r := chi.NewRouter()
+	r.With(trusted.Verify(), trusted.Authenticate).Get("/trusted", welcome)
+	r.With(untrusted.Verify(), untrusted.Authenticate).Get("/untrusted", welcome)
+
+	payload := func(claims jwt.MapClaims) string {
+		b, _ := json.Marshal(claims)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	valid := jwt.MapClaims{"uid": "123", "roles": []string{}, "exp": time.Now().Add(time.Minute).Unix()}
+	expired := jwt.MapClaims{"uid": "123", "roles": []string{}, "exp": time.Now().Add(-time.Minute).Unix()}
+
+	tests := []struct {
+		name   string
+		path   string
+		header http.Header
+		status int
+		resp   string
+	}{
+		{"trusted payload", "/trusted", http.Header{MeshPayloadHeader: {payload(valid)}}, 200, TokenSourceMeshPayload},
+		{"expired payload", "/trusted", http.Header{MeshPayloadHeader: {payload(expired)}}, 401, "Unauthorized\n"},
+		{"malformed payload", "/trusted", http.Header{MeshPayloadHeader: {"{nope"}}, 401, "Unauthorized\n"},
+		{"untrusted payload", "/untrusted", http.Header{MeshPayloadHeader: {payload(valid)}}, 401, "Unauthorized\n"},
+		{"forwarded access token", "/untrusted", http.Header{ForwardedAccessTokenHeader: {newJwtToken(TokenSecret, valid)}}, 200, TokenSourceForwardedAccessToken},
+		{"forged forwarded access token", "/untrusted", http.Header{ForwardedAccessTokenHeader: {newJwtToken([]byte("forged"), valid)}}, 401, "Unauthorized\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.Header = tt.header
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != tt.status || rec.Body.String() != tt.resp {
+				t.Fatalf("got %d %q, want %d %q", rec.Code, rec.Body.String(), tt.status, tt.resp)
+			}
+		})
+	}
+
+	if err := untrusted.Validate(); err == nil {
+		t.Fatal("Validate() accepted the mesh payload source without a trusted mesh")
+	}
+	if err := trusted.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+}
+
+func TestRequiresFeature(t *testing.T) {
+	config := Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}
+	features := NewJWTAuth(config)
+	entitlements := NewJWTAuth(config, WithFeaturesClaim("entitlements"))
+	welcome := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	}
+
+	r := chi.NewRouter()
+	r.With(features.Verify(), features.RequiresFeature("beta")).Get("/features", welcome)
+	r.With(entitlements.Verify(), entitlements.RequiresFeature("beta")).Get("/entitlements", welcome)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		header http.Header
+		status int
+	}{
+		{"feature in array", "/features", newAuthHeader(jwt.MapClaims{"features": []string{"reports", "beta"}}), 200},
+		{"feature as string", "/features", newAuthHeader(jwt.MapClaims{"features": "beta"}), 200},
+		{"feature missing", "/features", newAuthHeader(jwt.MapClaims{"features": []string{"reports"}}), 403},
+		{"claim absent", "/features", newAuthHeader(jwt.MapClaims{}), 403},
+		{"claim malformed", "/features", newAuthHeader(jwt.MapClaims{"features": 1}), 403},
+		{"no token", "/features", nil, 401},
+		{"custom claim", "/entitlements", newAuthHeader(jwt.MapClaims{"entitlements": []string{"beta"}}), 200},
+		{"default claim ignored", "/entitlements", newAuthHeader(jwt.MapClaims{"features": []string{"beta"}}), 403},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, _ := testRequest(t, ts, "GET", tt.path, tt.header, nil); status != tt.status {
+				t.Fatalf("got %d, want %d", status, tt.status)
+			}
+		})
+	}
+}
+
+func TestRequiresScopes(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret})
+	welcome := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	}
+
+	r := chi.NewRouter()
+	r.Use(TokenAuthHS256.Verify())
+	r.With(TokenAuthHS256.RequiresScopes(MatchAll, "read:accounts", "write:accounts")).Get("/all", welcome)
+	r.With(TokenAuthHS256.RequiresScopes(MatchAny, "read:accounts", "read:billing")).Get("/any", welcome)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		header http.Header
+		status int
+		body   string
+	}{
+		{"all granted", "/all", newAuthHeader(jwt.MapClaims{"scope": "write:accounts openid read:accounts"}), 200, "welcome"},
+		{"all partial", "/all", newAuthHeader(jwt.MapClaims{"scope": "read:accounts"}), 403, "Forbidden: missing scopes write:accounts\n"},
+		{"all none", "/all", newAuthHeader(jwt.MapClaims{}), 403, "Forbidden: missing scopes read:accounts write:accounts\n"},
+		{"any partial", "/any", newAuthHeader(jwt.MapClaims{"scp": []string{"read:billing"}}), 200, "welcome"},
+		{"any none", "/any", newAuthHeader(jwt.MapClaims{"scope": "write:accounts"}), 403, "Forbidden: missing scopes read:accounts read:billing\n"},
+		{"no token", "/any", nil, 401, "Unauthorized\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, body := testRequest(t, ts, "GET", tt.path, tt.header, nil); status != tt.status || body != tt.body {
+				t.Fatalf("got %d %q, want %d %q", status, body, tt.status, tt.body)
+			}
+		})
+	}
+}
+
+func TestRoleScopeMap(t *testing.T) {
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret},
+		WithRoleScopeMap(map[Role][]string{"BILLING_ADMIN": {"billing:read", "billing:write"}}))
+	welcome := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	}
+
+	r := chi.NewRouter()
+	r.Use(ja.Verify())
+	r.With(ja.RequiresScope("billing:write")).Get("/scope", welcome)
+	r.With(ja.RequiresScopes(MatchAll, "billing:read", "billing:write")).Get("/scopes", welcome)
+	r.With(ja.Authenticate, ja.RequiresRole("BILLING_ADMIN")).Get("/role", welcome)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		claims jwt.MapClaims
+		status int
+	}{
+		{"scope granted", "/scope", jwt.MapClaims{"scope": "billing:write"}, 200},
+		{"scope implied by role", "/scope", jwt.MapClaims{"roles": []string{"BILLING_ADMIN"}}, 200},
+		{"scope not implied by role", "/scope", jwt.MapClaims{"roles": []string{"ADMIN"}}, 403},
+		{"scopes implied by role", "/scopes", jwt.MapClaims{"roles": []string{"BILLING_ADMIN"}}, 200},
+		{"role granted", "/role", jwt.MapClaims{"uid": "1", "roles": []string{"BILLING_ADMIN"}}, 200},
+		{"role implied by scopes", "/role", jwt.MapClaims{"uid": "1", "roles": []string{}, "scope": "openid billing:read billing:write"}, 200},
+		{"role not implied by some scopes", "/role", jwt.MapClaims{"uid": "1", "roles": []string{}, "scope": "openid billing:read"}, 401},
+		{"role not implied by scope", "/role", jwt.MapClaims{"uid": "1", "roles": []string{}, "scope": "accounts:read"}, 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, _ := testRequest(t, ts, "GET", tt.path, newAuthHeader(tt.claims), nil); status != tt.status {
+				t.Fatalf("GET %s = %d, want %d", tt.path, status, tt.status)
+			}
+		})
+	}
+}
+
+func TestTokenSources(t *testing.T) {
+	config := Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}
+
+	tests := []struct {
+		name string
+		ja   JWTAuth
+		want []string
+	}{
+		{"default", NewJWTAuth(config), []string{TokenSourceQuery, TokenSourceHeader, TokenSourceCookie}},
+		{"option", NewJWTAuth(config, WithTokenSources(TokenSourceCookie, TokenSourceHeader)), []string{TokenSourceCookie, TokenSourceHeader}},
+		{"config", NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret, TokenSources: []string{TokenSourceHeader}}), []string{TokenSourceHeader}},
+		{"unknown left out", NewJWTAuth(config, WithTokenSources("body", TokenSourceHeader)), []string{TokenSourceHeader}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.ja.TokenSources(); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorFromContext(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret})
+
+	r := chi.NewRouter()
+	r.Use(TokenAuthHS256.Verify())
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		err := ErrorFromContext(r.Context())
+		if err != nil && !errors.Is(err, ErrUnauthorized) && AuthErrorCode(err) == ErrorCodeUnauthorized {
+			t.Errorf("error %v is not a library error", err)
+		}
+		w.Write([]byte(AuthErrorCode(err)))
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		header http.Header
+		code   string
+	}{
+		{"valid", newAuthHeader(jwt.MapClaims{}), ""},
+		{"no token", nil, ErrorCodeNoToken},
+		{"expired", newAuthHeader(jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}), ErrorCodeExpired},
+		{"wrong algorithm", http.Header{"Authorization": {"BEARER " + newJwt512Token(TokenSecret, jwt.MapClaims{})}}, ErrorCodeAlgorithmMismatch},
+		{"bad signature", http.Header{"Authorization": {"BEARER " + newJwtToken([]byte("wrong"), jwt.MapClaims{})}}, ErrorCodeUnauthorized},
+		{"malformed", http.Header{"Authorization": {"BEARER not.a.token"}}, ErrorCodeUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, code := testRequest(t, ts, "GET", "/", tt.header, nil); code != tt.code {
+				t.Fatalf("got %q, want %q", code, tt.code)
+			}
+		})
+	}
+}
+
+func TestContextErrorUnwraps(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}).(*jwtAuth)
+	_, err := TokenAuthHS256.verifyToken(context.Background(), newJwtToken([]byte("wrong"), jwt.MapClaims{}))
+	err = contextError(err)
+	var verr *jwt.ValidationError
+	if !errors.Is(err, ErrUnauthorized) || !errors.As(err, &verr) || verr.Errors&jwt.ValidationErrorSignatureInvalid == 0 {
+		t.Fatalf("got %#v, want an ErrUnauthorized wrapping the signature error", err)
+	}
+	if AuthErrorCode(nil) != "" {
+		t.Fatalf("nil error has code %q", AuthErrorCode(nil))
+	}
+}
+
+func TestLenientBase64(t *testing.T) {
+	config := Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}
+	strict := NewJWTAuth(config)
+	lenient := NewJWTAuth(config, WithLenientBase64())
+
+	segments := strings.Split(newJwtToken(TokenSecret, jwt.MapClaims{"uid": "123"}), ".")
+	for i, seg := range segments {
+		if l := len(seg) % 4; l > 0 {
+			segments[i] += strings.Repeat("=", 4-l)
+		}
+	}
+	padded := strings.Join(segments, ".")
+	if !strings.Contains(padded, "=") {
+		t.Fatalf("token %q has no padding", padded)
+	}
+
+	if _, err := strict.Decode(padded); err == nil {
+		t.Fatalf("strict: padded token accepted")
+	}
+	if _, err := lenient.Decode(padded); err != nil {
+		t.Fatalf("lenient: got %v", err)
+	}
+}
+
+func TestDenyReason(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret})
+	welcome := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	}
+
+	r := chi.NewRouter()
+	r.Use(TokenAuthHS256.Verify())
+	r.With(TokenAuthHS256.Authenticate).Get("/authenticated", welcome)
+	r.With(TokenAuthHS256.RequiresRole("ADMIN")).Get("/role", welcome)
+	r.With(TokenAuthHS256.RequiresScope("read:accounts")).Get("/scope", welcome)
+	r.With(TokenAuthHS256.RequiresFeature("beta")).Get("/feature", welcome)
+
+	tests := []struct {
+		name   string
+		path   string
+		header http.Header
+		status int
+		reason string
+	}{
+		{"allowed", "/role", newAuthHeader(jwt.MapClaims{"uid": "1", "roles": []string{"ADMIN"}}), 200, ""},
+		{"role missing", "/role", newAuthHeader(jwt.MapClaims{"uid": "1", "roles": []string{"USER"}}), 401, ErrorCodeRoleMissing},
+		{"scope missing", "/scope", newAuthHeader(jwt.MapClaims{"scope": "openid"}), 403, ErrorCodeScopeMissing},
+		{"feature missing", "/feature", newAuthHeader(jwt.MapClaims{}), 403, ErrorCodeFeatureMissing},
+		{"token expired", "/scope", newAuthHeader(jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}), 401, ErrorCodeExpired},
+		{"no token", "/role", nil, 401, ErrorCodeNoToken},
+		{"authenticate expired", "/authenticated", newAuthHeader(jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}), 401, ErrorCodeExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != tt.status || rec.Header().Get(DenyReasonHeader) != tt.reason {
+				t.Fatalf("got %d %q, want %d %q", rec.Code, rec.Header().Get(DenyReasonHeader), tt.status, tt.reason)
+			}
+		})
+	}
+}
+
+func TestRequiresMatchingRequest(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret})
+	welcome := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	}
+
+	r := chi.NewRouter()
+	r.Use(TokenAuthHS256.Verify(), TokenAuthHS256.RequiresMatchingRequest())
+	r.Get("/hooks/{id}", welcome)
+	r.Post("/hooks/{id}", welcome)
+	r.Post("/admin", welcome)
+	r.Get("/users/{id}/avatar", welcome)
+	r.Get("/users/{id}/email", welcome)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	webhook := newAuthHeader(jwt.MapClaims{"allowed_methods": []string{"POST"}, "allowed_paths": "/hooks/*"})
+	avatar := newAuthHeader(jwt.MapClaims{"allowed_paths": []string{"/users/*/avatar"}})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header http.Header
+		status int
+	}{
+		{"unrestricted", "GET", "/users/1/email", newAuthHeader(jwt.MapClaims{}), 200},
+		{"prefix", "POST", "/hooks/42", webhook, 200},
+		{"method mismatch", "GET", "/hooks/42", webhook, 403},
+		{"path traversal", "POST", "/hooks/../admin", webhook, 403},
+		{"encoded path traversal", "POST", "/hooks/%2e%2e/admin", webhook, 403},
+		{"prefix mismatch", "GET", "/users/1/avatar", newAuthHeader(jwt.MapClaims{"allowed_paths": "/hooks/*"}), 403},
+		{"pattern", "GET", "/users/1/avatar", avatar, 200},
+		{"pattern mismatch", "GET", "/users/1/email", avatar, 403},
+		{"malformed claim", "GET", "/users/1/email", newAuthHeader(jwt.MapClaims{"allowed_paths": 1}), 403},
+		{"no token", "GET", "/users/1/email", nil, 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, _ := testRequest(t, ts, tt.method, tt.path, tt.header, nil); status != tt.status {
+				t.Fatalf("got %d, want %d", status, tt.status)
+			}
+		})
+	}
+}
+
+func TestClaimsInto(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret})
+
+	type userClaims struct {
+		jwt.StandardClaims
+		TenantID string   `json:"tenant_id"`
+		Roles    []string `json:"roles"`
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+
+	var got userClaims
+	var gotErr error
+	h := TokenAuthHS256.Verify()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotErr = TokenAuthHS256.ClaimsInto(r.Context(), &got)
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header = newAuthHeader(jwt.MapClaims{"sub": "alice", "exp": exp, "tenant_id": "acme", "roles": []string{"ADMIN"}})
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if gotErr != nil {
+		t.Fatalf("ClaimsInto: %v", gotErr)
+	}
+	want := userClaims{StandardClaims: jwt.StandardClaims{Subject: "alice", ExpiresAt: exp}, TenantID: "acme", Roles: []string{"ADMIN"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if gotErr != ErrNoTokenFound {
+		t.Fatalf("no token: got %v, want %v", gotErr, ErrNoTokenFound)
+	}
+}
+
+func TestAuthenticateIdempotent(t *testing.T) {
+	config := Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}
+	parent := NewJWTAuth(config)
+	other := NewJWTAuth(config)
+
+	// marker replaces the AppClaims on the context, which a repeated authentication
+	// parses again from the token
+	marker := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), AccessClaimsCtxKey, AppClaims{UserID: "marker"})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+	userID := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(AppClaimsFromCtx(r.Context()).UserID))
+	}
+
+	r := chi.NewRouter()
+	r.Use(parent.Verify(), parent.Authenticate, marker)
+	r.With(parent.Authenticate).Get("/nested", userID)
+	r.With(parent.ForceAuthenticate).Get("/forced", userID)
+	r.With(other.Authenticate).Get("/other", userID)
+	r.With(parent.Verify(), parent.Authenticate).Get("/reverified", userID)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/nested", "marker"},
+		{"/forced", "123"},
+		{"/other", "123"},
+		{"/reverified", "123"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			_, body := testRequest(t, ts, "GET", tt.path, newAuthHeader(jwt.MapClaims{"uid": "123", "roles": []string{}}), nil)
+			if body != tt.want {
+				t.Fatalf("got %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPBinding(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret},
+		WithIPBinding(func(r *http.Request) string { return r.Header.Get("X-Client-IP") }))
+	h := TokenAuthHS256.Verify()(TokenAuthHS256.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})))
+
+	tests := []struct {
+		name   string
+		cip    interface{}
+		client string
+		status int
+	}{
+		{"match", "203.0.113.7", "203.0.113.7", 200},
+		{"match mapped ipv4", "203.0.113.7", "::ffff:203.0.113.7", 200},
+		{"mismatch", "203.0.113.7", "198.51.100.1", 403},
+		{"no client ip", "203.0.113.7", "", 403},
+		{"malformed claim", 7, "203.0.113.7", 403},
+		{"absent claim", nil, "198.51.100.1", 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := jwt.MapClaims{"uid": "123", "roles": []string{}}
+			if tt.cip != nil {
+				claims["cip"] = tt.cip
+			}
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header = newAuthHeader(claims)
+			req.Header.Set("X-Client-IP", tt.client)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("got %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestSourceError(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret})
+	var got error
+	h := TokenAuthHS256.Verify()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = ErrorFromContext(r.Context())
+	}))
+
+	expired := newJwtToken(TokenSecret, jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()})
+	tests := []struct {
+		name   string
+		target string
+		header http.Header
+		source string
+		err    error
+	}{
+		{"expired from cookie", "/", http.Header{"Cookie": {"jwt=" + expired}}, TokenSourceCookie, ErrExpired},
+		{"malformed from query", "/?jwt=asdf", nil, TokenSourceQuery, ErrUnauthorized},
+		{"expired from header", "/", http.Header{"Authorization": {"BEARER " + expired}}, TokenSourceHeader, ErrExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.target, nil)
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+			var serr *SourceError
+			if !errors.As(got, &serr) || serr.Source != tt.source || !errors.Is(got, tt.err) {
+				t.Fatalf("got %#v, want a %s error from %s", got, tt.err, tt.source)
+			}
+		})
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if got != ErrNoTokenFound {
+		t.Fatalf("no token: got %v, want %v", got, ErrNoTokenFound)
+	}
+}
+
+func TestServiceName(t *testing.T) {
+	config := Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}
+	token := newJwtToken(TokenSecret, jwt.MapClaims{"uid": "123", "roles": []string{}, "aud": []string{"billing", "accounts"}})
+
+	tests := []struct {
+		service string
+		err     error
+	}{
+		{"billing", nil},
+		{"accounts", nil},
+		{"reports", ErrAudienceInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.service, func(t *testing.T) {
+			ja := NewJWTAuth(config, WithServiceName(tt.service))
+			if _, err := ja.Parse(token); err != tt.err {
+				t.Fatalf("Parse() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestClaimsTooLarge(t *testing.T) {
+	config := Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}
+	roles := make([]string, 1000)
+	for i := range roles {
+		roles[i] = fmt.Sprintf("ROLE_%d", i)
+	}
+
+	tests := []struct {
+		name  string
+		ja    JWTAuth
+		roles []string
+		err   error
+	}{
+		{"roles within limit", NewJWTAuth(config, WithMaxRoles(100)), roles[:100], nil},
+		{"roles over limit", NewJWTAuth(config, WithMaxRoles(100)), roles, ErrClaimsTooLarge},
+		{"size within limit", NewJWTAuth(config, WithMaxClaimsSize(4096)), roles[:10], nil},
+		{"size over limit", NewJWTAuth(config, WithMaxClaimsSize(4096)), roles, ErrClaimsTooLarge},
+		{"no limits", NewJWTAuth(config), roles, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := newJwtToken(TokenSecret, jwt.MapClaims{"uid": "123", "roles": tt.roles})
+			if _, err := tt.ja.Parse(token); err != tt.err {
+				t.Fatalf("Parse() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestUnsupportedSerialization(t *testing.T) {
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret})
+	compact := strings.Split(newJwtToken(TokenSecret, jwt.MapClaims{"uid": "123", "roles": []string{}}), ".")
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"multiple signatures", `{"payload":"` + compact[1] + `","signatures":[` +
+			`{"protected":"` + compact[0] + `","signature":"` + compact[2] + `"},` +
+			`{"protected":"` + compact[0] + `","header":{"kid":"partner"},"signature":"` + compact[2] + `"}]}`},
+		{"flattened", ` {"payload":"` + compact[1] + `","protected":"` + compact[0] + `","signature":"` + compact[2] + `"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ja.Decode(tt.token); err != ErrUnsupportedSerialization {
+				t.Fatalf("Decode() error = %v, want %v", err, ErrUnsupportedSerialization)
+			}
+		})
+	}
+}
+
+func TestContextKeys(t *testing.T) {
+	type frameworkKey string
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret},
+		WithContextKeys(frameworkKey("user.token"), frameworkKey("user.claims"), frameworkKey("user.error")))
+
+	var token *jwt.Token
+	var claims AppClaims
+	var verifyErr error
+	h := ja.Verify()(ja.Optional(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ = r.Context().Value(frameworkKey("user.token")).(*jwt.Token)
+		claims, _ = r.Context().Value(frameworkKey("user.claims")).(AppClaims)
+		verifyErr, _ = r.Context().Value(frameworkKey("user.error")).(error)
+		if AppClaimsFromCtx(r.Context()).UserID != claims.UserID {
+			t.Errorf("AppClaimsFromCtx() = %+v, want %+v", AppClaimsFromCtx(r.Context()), claims)
+		}
+	})))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header = newAuthHeader(jwt.MapClaims{"uid": "123", "roles": []string{"ADMIN"}})
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if token == nil || !token.Valid || claims.UserID != "123" || !hasRole("ADMIN", claims.Roles, false) || verifyErr != nil {
+		t.Fatalf("got token %v, claims %+v, error %v", token, claims, verifyErr)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header = newAuthHeader(jwt.MapClaims{"uid": "123", "roles": []string{}, "exp": 1})
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if claims.UserID != "" || !errors.Is(verifyErr, ErrExpired) {
+		t.Fatalf("got claims %+v, error %v, want none and %v", claims, verifyErr, ErrExpired)
+	}
+}
+
+func TestRelativeExpiry(t *testing.T) {
+	config := Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}
+	ja := NewJWTAuth(config, WithRelativeExpiry("expires_in"), WithRequireExpiry())
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		err    error
+	}{
+		{"valid", jwt.MapClaims{"iat": now.Add(-time.Minute).Unix(), "expires_in": 3600}, nil},
+		{"expired", jwt.MapClaims{"iat": now.Add(-2 * time.Hour).Unix(), "expires_in": 3600}, ErrExpired},
+		{"exp takes precedence", jwt.MapClaims{"iat": now.Add(-2 * time.Hour).Unix(), "expires_in": 3600, "exp": now.Add(time.Hour).Unix()}, nil},
+		{"expired exp takes precedence", jwt.MapClaims{"iat": now.Add(-time.Minute).Unix(), "expires_in": 3600, "exp": now.Add(-time.Second).Unix()}, ErrExpired},
+		{"no issue time", jwt.MapClaims{"expires_in": 3600}, ErrMissingExpiry},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := jwt.MapClaims{"uid": "123", "roles": []string{}}
+			for k, v := range tt.claims {
+				claims[k] = v
+			}
+			if _, err := ja.Parse(newJwtToken(TokenSecret, claims)); err != tt.err {
+				t.Fatalf("Parse() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	// The derived expiry is subject to the leeway
+	lenient := NewJWTAuth(config, WithRelativeExpiry("expires_in"), WithLeeway(time.Minute))
+	token := newJwtToken(TokenSecret, jwt.MapClaims{"uid": "123", "roles": []string{}, "iat": now.Add(-time.Hour - 10*time.Second).Unix(), "expires_in": 3600})
+	if _, err := lenient.Parse(token); err != nil {
+		t.Fatalf("Parse() error = %v within the leeway", err)
+	}
+	token = newJwtToken(TokenSecret, jwt.MapClaims{"uid": "123", "roles": []string{}, "iat": now.Add(-50 * time.Hour).Unix(), "expires_in": 7200})
+	if _, err := lenient.Parse(token); err != ErrExpired {
+		t.Fatalf("Parse() error = %v beyond the leeway, want %v", err, ErrExpired)
+	}
+
+	// Without the option the relative expiry is ignored
+	token = newJwtToken(TokenSecret, jwt.MapClaims{"uid": "123", "roles": []string{}, "iat": now.Add(-2 * time.Hour).Unix(), "expires_in": 3600})
+	if _, err := NewJWTAuth(config).Parse(token); err != nil {
+		t.Fatalf("Parse() error = %v without WithRelativeExpiry", err)
+	}
+}
+
+func TestRawClaimsFromCtx(t *testing.T) {
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret})
+	token := newJwtToken(TokenSecret, jwt.MapClaims{"uid": "123", "roles": []string{},
+		"permissions": map[string]interface{}{"billing": []string{"read", "write"}}})
+
+	var raw []byte
+	var ok bool
+	h := ja.Verify()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, ok = RawClaimsFromCtx(r.Context())
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "BEARER "+token)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	payload, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || !bytes.Equal(raw, payload) {
+		t.Fatalf("RawClaimsFromCtx() = %s, %v, want %s", raw, ok, payload)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "BEARER "+newJwtToken([]byte("wrong"), jwt.MapClaims{"uid": "123"}))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if ok {
+		t.Fatalf("RawClaimsFromCtx() = %s for an unverified token", raw)
+	}
+}
+
+func TestMinimalClaims(t *testing.T) {
+	minimal, err := WithMinimalClaims()
+	if err != nil {
+		t.Fatal(err)
+	}
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+	}, minimal)
+
+	r := chi.NewRouter()
+	r.Use(TokenAuthHS256.Verify(), TokenAuthHS256.Authenticate, TokenAuthHS256.RequiresFeature("beta"))
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		_, claims, _ := TokenFromContext(r.Context())
+		if _, ok := claims["email"]; ok || claims["sub"] != "user-1" || len(claims) != 3 {
+			t.Errorf("context token claims = %v, want only uid, sub and roles", claims)
+		}
+		if c := AppClaimsFromCtx(r.Context()); c.UserID != "123" || c.Subject != "user-1" || c.Name != "" || len(c.Roles) != 1 {
+			t.Errorf("context AppClaims = %+v, want only UserID, Subject and Roles", c)
+		}
+		full, err := TokenAuthHS256.FullClaims(r.Context())
+		if err != nil {
+			t.Fatalf("FullClaims() error = %v", err)
+		}
+		w.Write([]byte(fmt.Sprintf("%v %v", full["name"], full["email"])))
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	h := newAuthHeader(jwt.MapClaims{"uid": "123", "sub": "user-1", "roles": []string{"USER"}, "name": "Mike", "email": "mike@example.com", "features": []string{"beta"}})
+	if status, resp := testRequest(t, ts, "GET", "/", h, nil); status != 200 || resp != "Mike mike@example.com" {
+		t.Fatalf("got %d %q, want 200 %q", status, resp, "Mike mike@example.com")
+	}
+	if _, err := TokenAuthHS256.FullClaims(context.Background()); err != ErrNoTokenFound {
+		t.Fatalf("FullClaims() error = %v, want %v", err, ErrNoTokenFound)
+	}
+}
+
+func TestMaxFutureSkew(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+	}, WithLeeway(time.Hour), WithMaxFutureSkew(time.Minute)).(*jwtAuth)
+
+	now := time.Now()
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		want   error
+	}{
+		{"issued 3 seconds ahead", jwt.MapClaims{"iat": now.Add(3 * time.Second).Unix()}, nil},
+		{"issued 10 minutes ahead", jwt.MapClaims{"iat": now.Add(10 * time.Minute).Unix()}, ErrIATInvalid},
+		{"valid from 10 minutes ahead", jwt.MapClaims{"nbf": now.Add(10 * time.Minute).Unix()}, ErrIATInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := TokenAuthHS256.verifyToken(context.Background(), newJwtToken(TokenSecret, tt.claims)); err != tt.want {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+	}, WithIssuer("https://issuer.example"))
+
+	now := time.Now()
+	valid := jwt.MapClaims{"uid": "123", "roles": []string{"USER"}, "iss": "https://issuer.example"}
+	tests := []struct {
+		name        string
+		tokenString string
+		want        error
+	}{
+		{"valid", newJwtToken(TokenSecret, valid), nil},
+		{"expired", newJwtToken(TokenSecret, jwt.MapClaims{"uid": "123", "roles": []string{}, "iss": "https://issuer.example", "exp": now.Add(-time.Minute).Unix()}), ErrExpired},
+		{"other issuer", newJwtToken(TokenSecret, jwt.MapClaims{"uid": "123", "roles": []string{}, "iss": "https://other.example"}), ErrIssuerInvalid},
+		{"wrong algorithm", newJwt512Token(TokenSecret, valid), ErrAlgoInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := TokenAuthHS256.Parse(tt.tokenString)
+			if err != tt.want {
+				t.Fatalf("Parse() error = %v, want %v", err, tt.want)
+			}
+			if err == nil && (c.UserID != "123" || len(c.Roles) != 1 || c.Issuer != "https://issuer.example") {
+				t.Fatalf("Parse() = %+v", c)
+			}
+		})
+	}
+
+	if _, err := TokenAuthHS256.Parse(newJwtToken([]byte("forged"), valid)); err == nil {
+		t.Fatal("Parse() accepted a forged token")
+	}
+	if _, err := TokenAuthHS256.Parse(newJwtToken(TokenSecret, jwt.MapClaims{"iss": "https://issuer.example"})); err == nil {
+		t.Fatal("Parse() accepted a token without uid and roles")
+	}
+}
+
+func TestRequiresSubjectMatch(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+	}, WithMaxBodySize(64))
+	userID := func(r *http.Request) (string, error) {
+		var body struct {
+			UserID string `json:"user_id"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		return body.UserID, err
+	}
+
+	r := chi.NewRouter()
+	r.Use(TokenAuthHS256.Verify(), TokenAuthHS256.RequiresSubjectMatch(userID))
+	r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	h := newAuthHeader(jwt.MapClaims{"sub": "user-1"})
+	tests := []struct {
+		name   string
+		header http.Header
+		body   string
+		status int
+		resp   string
+	}{
+		{"match", h, `{"user_id":"user-1"}`, 200, `{"user_id":"user-1"}`},
+		{"mismatch", h, `{"user_id":"user-2"}`, 403, "Forbidden\n"},
+		{"unreadable body", h, `{"user_id":`, 400, "Bad Request\n"},
+		{"body too large", h, `{"user_id":"user-1","padding":"` + strings.Repeat("x", 64) + `"}`, 413, "Request Entity Too Large\n"},
+		{"no subject", newAuthHeader(jwt.MapClaims{}), `{"user_id":""}`, 403, "Forbidden\n"},
+		{"no token", nil, `{"user_id":"user-1"}`, 401, "Unauthorized\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, resp := testRequest(t, ts, "POST", "/", tt.header, strings.NewReader(tt.body)); status != tt.status || resp != tt.resp {
+				t.Fatalf("got %d %q, want %d %q", status, resp, tt.status, tt.resp)
+			}
+		})
+	}
+}
+
+func TestRequiresAuthorizedParty(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+	})
+
+	r := chi.NewRouter()
+	r.Use(TokenAuthHS256.Verify(), TokenAuthHS256.RequiresAuthorizedParty("mobile-app", "web-app"))
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		header http.Header
+		status int
+	}{
+		{"allowed azp", newAuthHeader(jwt.MapClaims{"azp": "mobile-app", "aud": []string{"api", "mobile-app"}}), 200},
+		{"mismatched azp", newAuthHeader(jwt.MapClaims{"azp": "partner-app", "aud": "mobile-app"}), 403},
+		{"absent azp with allowed single audience", newAuthHeader(jwt.MapClaims{"aud": "web-app"}), 200},
+		{"absent azp with other single audience", newAuthHeader(jwt.MapClaims{"aud": "partner-app"}), 403},
+		{"absent azp with several audiences", newAuthHeader(jwt.MapClaims{"aud": []string{"web-app", "api"}}), 403},
+		{"absent azp and audience", newAuthHeader(jwt.MapClaims{}), 403},
+		{"no token", nil, 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, _ := testRequest(t, ts, "GET", "/", tt.header, nil); status != tt.status {
+				t.Fatalf("got %d, want %d", status, tt.status)
+			}
+		})
+	}
+}
+
+func TestRequiresRegion(t *testing.T) {
+	config := Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}
+	fixed := NewJWTAuth(config)
+	byHost := NewJWTAuth(config, WithRegionFunc(func(r *http.Request) string {
+		if strings.HasSuffix(r.Host, ".eu.example.com") {
+			return "eu"
+		}
+		return ""
+	}))
+	welcome := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	}
+
+	r := chi.NewRouter()
+	r.With(fixed.Verify(), fixed.RequiresRegion("eu")).Get("/fixed", welcome)
+	r.With(byHost.Verify(), byHost.RequiresRegion("us")).Get("/host", welcome)
+
+	tests := []struct {
+		name   string
+		host   string
+		path   string
+		claims jwt.MapClaims
+		status int
+	}{
+		{"matching region", "api.example.com", "/fixed", jwt.MapClaims{"region": "eu"}, 200},
+		{"mismatching region", "api.example.com", "/fixed", jwt.MapClaims{"region": "us"}, 403},
+		{"absent region", "api.example.com", "/fixed", jwt.MapClaims{}, 403},
+		{"region of the host", "api.eu.example.com", "/host", jwt.MapClaims{"region": "eu"}, 200},
+		{"other region than the host", "api.eu.example.com", "/host", jwt.MapClaims{"region": "us"}, 403},
+		{"default region", "api.example.com", "/host", jwt.MapClaims{"region": "us"}, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://"+tt.host+tt.path, nil)
+			req.Header = newAuthHeader(tt.claims)
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("got %d, want %d", rec.Code, tt.status)
+			}
+			if tt.status == 403 && rec.Header().Get(DenyReasonHeader) != ErrorCodeRegionMismatch {
+				t.Fatalf("deny reason %q, want %q", rec.Header().Get(DenyReasonHeader), ErrorCodeRegionMismatch)
+			}
+		})
+	}
+}
+
+func TestRequiredTyp(t *testing.T) {
+	config := Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}
+	accessOnly := NewJWTAuth(config, WithRequiredTyp("at+jwt"))
+	either := NewJWTAuth(config, WithRequiredTyp("at+jwt", "JWT"))
+
+	token := func(typ interface{}) string {
+		tok := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"uid": "123", "roles": []string{}})
+		if typ == nil {
+			delete(tok.Header, "typ")
+		} else {
+			tok.Header["typ"] = typ
+		}
+		tokenString, err := tok.SignedString(TokenSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokenString
+	}
+
+	tests := []struct {
+		name           string
+		typ            interface{}
+		wantAccessOnly error
+		wantEither     error
+	}{
+		{"at+jwt", "at+jwt", nil, nil},
+		{"media type", "application/AT+JWT", nil, nil},
+		{"JWT", "JWT", ErrTypInvalid, nil},
+		{"lowercase jwt", "jwt", ErrTypInvalid, nil},
+		{"id token", "id+jwt", ErrTypInvalid, ErrTypInvalid},
+		{"no typ", nil, ErrTypInvalid, ErrTypInvalid},
+		{"malformed typ", 1, ErrTypInvalid, ErrTypInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokenString := token(tt.typ)
+			if _, err := accessOnly.Decode(tokenString); err != tt.wantAccessOnly {
+				t.Errorf("at+jwt only: Decode() error = %v, want %v", err, tt.wantAccessOnly)
+			}
+			if _, err := either.Decode(tokenString); err != tt.wantEither {
+				t.Errorf("at+jwt or JWT: Decode() error = %v, want %v", err, tt.wantEither)
+			}
+		})
+	}
+
+	// The leeway doesn't accept an expired token of another type
+	lenient := NewJWTAuth(config, WithRequiredTyp("at+jwt"), WithLeeway(time.Minute))
+	expired := newJwtToken(TokenSecret, jwt.MapClaims{"uid": "123", "roles": []string{}, "exp": time.Now().Add(-10 * time.Second).Unix()})
+	if _, err := lenient.Parse(expired); err != ErrTypInvalid {
+		t.Errorf("expired within leeway: Parse() error = %v, want %v", err, ErrTypInvalid)
+	}
+}
+
+func TestLazyClaims(t *testing.T) {
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+	}, WithLazyClaims())
+
+	r := chi.NewRouter()
+	r.Use(TokenAuthHS256.Verify(), TokenAuthHS256.Authenticate)
+	r.Get("/user", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(AccessClaimsCtxKey).(AppClaims); ok {
+			t.Error("claims parsed before first access")
+		}
+		var wg sync.WaitGroup
+		ids := make([]string, 8)
+		for i := range ids {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				ids[i] = AppClaimsFromCtx(r.Context()).UserID
+			}(i)
+		}
+		wg.Wait()
+		for _, id := range ids {
+			if id != ids[0] {
+				t.Errorf("concurrent accesses got %v", ids)
+			}
+		}
+		w.Write([]byte(fmt.Sprintf("%s %v", ids[0], Authorize(r.Context(), func(AppClaims) bool { return true }))))
+	})
+	r.With(TokenAuthHS256.RequiresRole("ADMIN")).Get("/admin", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	admin := newAuthHeader(jwt.MapClaims{"uid": "123", "roles": []string{"ADMIN"}})
+	noClaims := newAuthHeader(jwt.MapClaims{})
+	tests := []struct {
+		path   string
+		header http.Header
+		status int
+		resp   string
+	}{
+		{"/user", admin, 200, "123 <nil>"},
+		{"/user", noClaims, 200, " " + ErrUnauthorized.Error()},
+		{"/user", nil, 401, "Unauthorized\n"},
+		{"/admin", admin, 200, "welcome"},
+		{"/admin", noClaims, 401, "Unauthorized\n"},
+	}
+	for _, tt := range tests {
+		if status, resp := testRequest(t, ts, "GET", tt.path, tt.header, nil); status != tt.status || resp != tt.resp {
+			t.Errorf("GET %s = %d %q, want %d %q", tt.path, status, resp, tt.status, tt.resp)
+		}
+	}
+}
+
+// fakeSigningMethod stands in for a custom method such as one backed by a HSM: it
+// signs like HS256 under a name of its own.
+type fakeSigningMethod struct{}
+
+func (fakeSigningMethod) Alg() string { return "XHSM256" }
+
+func (fakeSigningMethod) Sign(signingString string, key interface{}) (string, error) {
+	return jwt.SigningMethodHS256.Sign(signingString, key)
+}
+
+func (fakeSigningMethod) Verify(signingString, signature string, key interface{}) error {
+	return jwt.SigningMethodHS256.Verify(signingString, signature, key)
+}
+
+func TestCustomSigningMethod(t *testing.T) {
+	jwt.RegisterSigningMethod("XHSM256", func() jwt.SigningMethod { return fakeSigningMethod{} })
+
+	// The parser resolves the registered method itself, so it is a different value than
+	// the one passed in, compared by name.
+	TokenAuthCustom := NewJWTAuth(Config{
+		JwtParser: &jwt.Parser{},
+		SignKey:   TokenSecret,
+	}, WithSigningMethod(&fakeSigningMethod{})).(*jwtAuth)
+	if err := TokenAuthCustom.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	token, tokenString, err := TokenAuthCustom.Encode(jwt.MapClaims{"uid": "123", "roles": []string{}})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if alg := token.Header["alg"]; alg != "XHSM256" {
+		t.Fatalf("token alg: got %v, want XHSM256", alg)
+	}
+	if _, err := TokenAuthCustom.verifyToken(context.Background(), tokenString); err != nil {
+		t.Fatalf("XHSM256 token: got %v", err)
+	}
+	if _, err := TokenAuthCustom.verifyToken(context.Background(), newJwtToken(TokenSecret, jwt.MapClaims{"uid": "123"})); err != ErrAlgoInvalid {
+		t.Fatalf("HS256 token: got %v, want %v", err, ErrAlgoInvalid)
+	}
+}
+
+func TestUnregisteredSigningMethod(t *testing.T) {
+	ja := NewJWTAuth(Config{JwtParser: &jwt.Parser{}, SignKey: TokenSecret}, WithSigningMethod(unregisteredSigningMethod{}))
+	if err := ja.Validate(); err == nil || !strings.Contains(err.Error(), "not registered") {
+		t.Fatalf("Validate: got %v, want an unregistered method error", err)
+	}
+}
+
+type unregisteredSigningMethod struct{ fakeSigningMethod }
+
+func (unregisteredSigningMethod) Alg() string { return "XUNREGISTERED" }
+
+func BenchmarkVerifyNoToken(b *testing.B) {
+	TokenAuthHS256 := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret})
+	h := TokenAuthHS256.Verify()(TokenAuthHS256.Optional(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	// "no candidate" takes the shortcut, "query without token" runs every finder to
+	// the same result
+	for _, bb := range []struct{ name, target string }{
+		{"no candidate", "/"},
+		{"query without token", "/?page=2"},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			req := httptest.NewRequest("GET", bb.target, nil)
+			w := httptest.NewRecorder()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				h.ServeHTTP(w, req)
+			}
+		})
+	}
+}
+
 //
 // Test helper functions
 //
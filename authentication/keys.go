@@ -0,0 +1,166 @@
+package authentication
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+)
+
+// WithRSAPublicKeyPEM sets the key used to validate tokens from a PEM encoded RSA
+// public key. Both SPKI ("PUBLIC KEY") and PKCS1 ("RSA PUBLIC KEY") encodings are
+// supported.
+func WithRSAPublicKeyPEM(data []byte) (Option, error) {
+	key, err := parseRSAPublicKeyPEM(data)
+	if err != nil {
+		return nil, err
+	}
+	return func(ja *jwtAuth) {
+		ja.verifyKey = key
+	}, nil
+}
+
+// WithRSAPrivateKeyPEM sets the key used to sign tokens from a PEM encoded RSA
+// private key. Both PKCS1 ("RSA PRIVATE KEY") and PKCS8 ("PRIVATE KEY") encodings
+// are supported. Unless a public key is configured too, tokens are validated with
+// the public part of the private key.
+func WithRSAPrivateKeyPEM(data []byte) (Option, error) {
+	key, err := parseRSAPrivateKeyPEM(data)
+	if err != nil {
+		return nil, err
+	}
+	return func(ja *jwtAuth) {
+		ja.signKey = key
+		if ja.verifyKey == nil {
+			ja.verifyKey = &key.PublicKey
+		}
+	}, nil
+}
+
+// WithRSAPublicKeyPEMFile is like WithRSAPublicKeyPEM but reads the key from a file.
+func WithRSAPublicKeyPEMFile(path string) (Option, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("authentication: reading public key: %w", err)
+	}
+	return WithRSAPublicKeyPEM(data)
+}
+
+// WithRSAPrivateKeyPEMFile is like WithRSAPrivateKeyPEM but reads the key from a file.
+func WithRSAPrivateKeyPEMFile(path string) (Option, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("authentication: reading private key: %w", err)
+	}
+	return WithRSAPrivateKeyPEM(data)
+}
+
+func parseRSAPublicKeyPEM(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM block found", ErrKeyPEMInvalid)
+	}
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrKeyPEMInvalid, err)
+		}
+		return key, nil
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrKeyPEMInvalid, err)
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%w: %T is not a RSA public key", ErrKeyPEMInvalid, key)
+		}
+		return rsaKey, nil
+	}
+	return nil, fmt.Errorf("%w: unexpected PEM block type %q", ErrKeyPEMInvalid, block.Type)
+}
+
+func parseRSAPrivateKeyPEM(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM block found", ErrKeyPEMInvalid)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrKeyPEMInvalid, err)
+		}
+		return key, nil
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrKeyPEMInvalid, err)
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%w: %T is not a RSA private key", ErrKeyPEMInvalid, key)
+		}
+		return rsaKey, nil
+	}
+	return nil, fmt.Errorf("%w: unexpected PEM block type %q", ErrKeyPEMInvalid, block.Type)
+}
+
+// parsePublicKeyPEM parses a PEM encoded RSA or ECDSA public key, in the SPKI ("PUBLIC
+// KEY") or, for RSA, the PKCS1 ("RSA PUBLIC KEY") encoding.
+func parsePublicKeyPEM(data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM block found", ErrKeyPEMInvalid)
+	}
+	if block.Type != "PUBLIC KEY" {
+		return parseRSAPublicKeyPEM(data)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrKeyPEMInvalid, err)
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: %T is not a RSA or ECDSA public key", ErrKeyPEMInvalid, key)
+}
+
+// parsePrivateKeyPEM parses a PEM encoded RSA or ECDSA private key, in the PKCS8
+// ("PRIVATE KEY"), PKCS1 ("RSA PRIVATE KEY") or SEC 1 ("EC PRIVATE KEY") encoding,
+// and returns it with its public key.
+func parsePrivateKeyPEM(data []byte) (interface{}, interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, nil, fmt.Errorf("%w: no PEM block found", ErrKeyPEMInvalid)
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, nil, fmt.Errorf("%w: unexpected PEM block type %q", ErrKeyPEMInvalid, block.Type)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrKeyPEMInvalid, err)
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, &key.PublicKey, nil
+	case *ecdsa.PrivateKey:
+		return key, &key.PublicKey, nil
+	}
+	return nil, nil, fmt.Errorf("%w: %T is not a RSA or ECDSA private key", ErrKeyPEMInvalid, key)
+}
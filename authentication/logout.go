@@ -0,0 +1,77 @@
+package authentication
+
+import (
+	"context"
+	"fmt"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// BackchannelLogoutEvent is the member of the "events" claim of OIDC back-channel
+// logout tokens.
+const BackchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// LogoutClaims are the claims of an OIDC back-channel logout token naming the session
+// to terminate, by its "sid" claim, all the sessions of the subject, by its "sub"
+// claim, or both.
+type LogoutClaims struct {
+	Issuer    string
+	Subject   string
+	SessionID string
+	ID        string
+	IssuedAt  int64
+}
+
+// VerifyLogoutToken verifies an OIDC back-channel logout token. Like access tokens, it
+// must be signed with the configured key and algorithm and pass the issuer, audience,
+// expiry and subject checks. Unlike them, it must have an "iat" and a "jti" claim, an
+// "events" claim with the BackchannelLogoutEvent member, a "sub" or "sid" claim and no
+// "nonce" claim, or it fails with ErrInvalidLogoutToken. Required types and the checks
+// of access tokens, e.g. WithTokenVersion and WithClaimsSchema, don't apply.
+func (ja *jwtAuth) VerifyLogoutToken(tokenStr string) (LogoutClaims, error) {
+	ja = ja.current()
+	var typs []string
+	if len(ja.typs) > 0 {
+		typs = append(append(typs, ja.typs...), "logout+jwt")
+	}
+	token, err := ja.decode(context.Background(), tokenStr, typs)
+	token, err = ja.checkSignedToken(token, err)
+	if err != nil {
+		return LogoutClaims{}, err
+	}
+
+	claims, _ := token.Claims.(jwt.MapClaims)
+	if err := checkLogoutClaims(claims); err != nil {
+		return LogoutClaims{}, err
+	}
+	c := LogoutClaims{}
+	c.Issuer, _ = claims["iss"].(string)
+	c.Subject, _ = claims["sub"].(string)
+	c.SessionID, _ = claims["sid"].(string)
+	c.ID, _ = claims["jti"].(string)
+	c.IssuedAt, _ = toInt64(claims["iat"])
+	return c, nil
+}
+
+// checkLogoutClaims applies the OIDC back-channel logout token validation rules.
+func checkLogoutClaims(claims jwt.MapClaims) error {
+	if _, ok := toInt64(claims["iat"]); !ok {
+		return fmt.Errorf("%w: no iat claim", ErrInvalidLogoutToken)
+	}
+	if jti, _ := claims["jti"].(string); jti == "" {
+		return fmt.Errorf("%w: no jti claim", ErrInvalidLogoutToken)
+	}
+	events, _ := claims["events"].(map[string]interface{})
+	if _, ok := events[BackchannelLogoutEvent].(map[string]interface{}); !ok {
+		return fmt.Errorf("%w: no back-channel logout event", ErrInvalidLogoutToken)
+	}
+	sub, _ := claims["sub"].(string)
+	sid, _ := claims["sid"].(string)
+	if sub == "" && sid == "" {
+		return fmt.Errorf("%w: no sub or sid claim", ErrInvalidLogoutToken)
+	}
+	if _, ok := claims["nonce"]; ok {
+		return fmt.Errorf("%w: nonce claim present", ErrInvalidLogoutToken)
+	}
+	return nil
+}
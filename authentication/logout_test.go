@@ -0,0 +1,56 @@
+package authentication
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestVerifyLogoutToken(t *testing.T) {
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret})
+	logoutClaims := func(extra jwt.MapClaims) jwt.MapClaims {
+		claims := jwt.MapClaims{
+			"iss":    "https://idp.example.com",
+			"sub":    "alice",
+			"sid":    "08a5019c-17e1-4977-8f42-65a12843ea02",
+			"jti":    "bWJq",
+			"iat":    time.Now().Unix(),
+			"events": map[string]interface{}{BackchannelLogoutEvent: map[string]interface{}{}},
+		}
+		for k, v := range extra {
+			claims[k] = v
+		}
+		return claims
+	}
+
+	claims, err := ja.VerifyLogoutToken(newJwtToken(TokenSecret, logoutClaims(nil)))
+	if err != nil {
+		t.Fatalf("valid logout token: %v", err)
+	}
+	if claims.Subject != "alice" || claims.SessionID != "08a5019c-17e1-4977-8f42-65a12843ea02" || claims.ID != "bWJq" {
+		t.Fatalf("unexpected logout claims %+v", claims)
+	}
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+	}{
+		{"nonce", logoutClaims(jwt.MapClaims{"nonce": "n-0S6_WzA2Mj"})},
+		{"no events", logoutClaims(jwt.MapClaims{"events": nil})},
+		{"other event", logoutClaims(jwt.MapClaims{"events": map[string]interface{}{"urn:example:event": map[string]interface{}{}}})},
+		{"no sub or sid", logoutClaims(jwt.MapClaims{"sub": nil, "sid": nil})},
+		{"no jti", logoutClaims(jwt.MapClaims{"jti": nil})},
+		{"no iat", logoutClaims(jwt.MapClaims{"iat": nil})},
+	}
+	for _, tc := range tests {
+		if _, err := ja.VerifyLogoutToken(newJwtToken(TokenSecret, tc.claims)); !errors.Is(err, ErrInvalidLogoutToken) {
+			t.Fatalf("%s: expected ErrInvalidLogoutToken, got %v", tc.name, err)
+		}
+	}
+
+	if _, err := ja.VerifyLogoutToken(newJwtToken([]byte("wrong"), logoutClaims(nil))); err == nil {
+		t.Fatalf("expected a logout token with a bad signature to be rejected")
+	}
+}
@@ -1,8 +1,18 @@
 package authentication
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"path"
+	"strings"
+	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 )
@@ -10,128 +20,1458 @@ import (
 // Authenticate is a default authentication middleware to enforce access from the
 // Verifier middleware request context values. The Authenticate sends a 401 Unauthorized
 // response for any unverified tokens and passes the good ones through. It's just fine
-// until you decide to write something similar and customize your client response.
+// until you decide to write something similar and customize your client response,
+// or set your own ErrorHandler with WithErrorHandler.
+//
+// Requests this authenticator already authenticated the verified token of, e.g. in a
+// parent router group, pass through without being checked again, see ForceAuthenticate.
 func (ja *jwtAuth) Authenticate(next http.Handler) http.Handler {
+	return ja.authenticate(next, false)
+}
+
+// ForceAuthenticate is like Authenticate, but checks the token and parses the claims
+// again even when the request has been authenticated before.
+func (ja *jwtAuth) ForceAuthenticate(next http.Handler) http.Handler {
+	return ja.authenticate(next, true)
+}
+
+func (ja *jwtAuth) authenticate(next http.Handler, force bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token, claims, err := TokenFromContext(r.Context())
+		ja := ja.current()
+		if ja.isExempt(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !force && ja.isAuthenticated(r.Context()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, claims, err := ja.tokenFromContext(r.Context())
 
 		if err != nil {
-			http.Error(w, http.StatusText(401), 401)
+			ja.fail(w, r, err)
 			return
 		}
 
 		if token == nil || !token.Valid {
-			http.Error(w, http.StatusText(401), 401)
+			ja.fail(w, r, ErrUnauthorized)
+			return
+		}
+
+		if err := ja.checkRequest(r, claims); err != nil {
+			ja.fail(w, r, err)
+			return
+		}
+		ctx, err := ja.useToken(r.Context(), token)
+		if err != nil {
+			ja.fail(w, r, err)
 			return
 		}
 
 		// Token is authenticated, parse claims
-		var c AppClaims
-		err = c.ParseClaims(claims)
+		ctx = ja.authenticatedContext(ctx, token)
+		if ja.lazyClaims {
+			ctx = context.WithValue(ctx, AccessClaimsCtxKey, ja.newLazyClaims(claims))
+			ctx = ja.baggageContext(ctx, claims)
+		} else {
+			var c AppClaims
+			if err := ja.parseClaims(&c, claims); err != nil {
+				ja.fail(w, r, err)
+				return
+			}
+
+			// Set AppClaims on context
+			ctx = ja.claimsContext(ctx, claims, c)
+		}
+
+		ctx, err = ja.postAuth(ctx)
 		if err != nil {
-			http.Error(w, http.StatusText(401), 401)
+			ja.fail(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Optional is an authentication middleware for routes serving both anonymous and
+// authenticated requests. Requests with a missing, expired or otherwise invalid token
+// are passed through without AppClaims on the context, those rejected by the request
+// checks or the nonce store with ErrUnauthorized in place of the token, so that a
+// later Requires middleware rejects them too. System errors (see IsSystemError) and
+// failing WithPostAuth hooks abort the request, by default with a 503 Service
+// Unavailable and a 403 Forbidden response respectively.
+func (ja *jwtAuth) Optional(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ja := ja.current()
+		if ja.isExempt(r) {
+			next.ServeHTTP(w, r)
 			return
 		}
 
-		// Set AppClaims on context
-		ctx := context.WithValue(r.Context(), AccessClaimsCtxKey, c)
+		token, claims, err := ja.tokenFromContext(r.Context())
+
+		if err != nil {
+			if IsSystemError(err) {
+				ja.errorHandler(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if token == nil || !token.Valid {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if err := ja.checkRequest(r, claims); err != nil {
+			ja.serveAnonymous(w, r, next)
+			return
+		}
+		ctx, err := ja.useToken(r.Context(), token)
+		if err != nil {
+			ja.serveAnonymous(w, r, next)
+			return
+		}
+
+		var c AppClaims
+		if err := ja.parseClaims(&c, claims); err != nil {
+			ja.serveAnonymous(w, r, next)
+			return
+		}
+
+		ctx = ja.authenticatedContext(ctx, token)
+		ctx, err = ja.postAuth(ja.claimsContext(ctx, claims, c))
+		if err != nil {
+			ja.errorHandler(w, r, err)
+			return
+		}
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// serveAnonymous passes a request Optional rejected the token of on to next, with
+// ErrUnauthorized in place of the token so that later middlewares treat it as
+// anonymous too.
+func (ja *jwtAuth) serveAnonymous(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	next.ServeHTTP(w, r.WithContext(ja.newContext(r.Context(), nil, ErrUnauthorized)))
+}
+
+// usedCtxKey holds the token used up by the request, see useToken.
+var usedCtxKey = &contextKey{"Used"}
+
+// usedToken records the token a request used up and the stores it used it in.
+type usedToken struct {
+	nonceStore NonceStore
+	usageStore UsageStore
+	raw        string
+}
+
+// useToken counts the use of the token against its usage cap, see WithUsageCap, uses up
+// its nonce, see WithNonceStore, and returns a copy of ctx recording it, so that the
+// token is used once per request however many of the middlewares checking it are
+// stacked.
+func (ja *jwtAuth) useToken(ctx context.Context, token *jwt.Token) (context.Context, error) {
+	used := usedToken{ja.nonceStore, ja.usageStore, token.Raw}
+	if u, ok := ctx.Value(usedCtxKey).(usedToken); ok && u == used {
+		return ctx, nil
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	if err := ja.checkUsage(claims); err != nil {
+		return ctx, err
+	}
+	if err := ja.useNonce(token); err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, usedCtxKey, used), nil
+}
+
+// serveUsed passes a request the token of passed the checks of a middleware on to
+// next, once checkDeepLink accepted it and useToken used it up.
+func (ja *jwtAuth) serveUsed(w http.ResponseWriter, r *http.Request, next http.Handler, token *jwt.Token) {
+	claims, _ := token.Claims.(jwt.MapClaims)
+	if err := ja.checkDeepLink(r, claims); err != nil {
+		ja.fail(w, r, err)
+		return
+	}
+	ctx, err := ja.useToken(r.Context(), token)
+	if err != nil {
+		ja.fail(w, r, err)
+		return
+	}
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// authenticatedCtxKey holds the authentication of the request, see isAuthenticated.
+var authenticatedCtxKey = &contextKey{"Authenticated"}
+
+// authentication records the authenticator that authenticated a request and the
+// token it authenticated it with.
+type authentication struct {
+	ja    *jwtAuth
+	token *jwt.Token
+}
+
+// authenticatedContext returns a copy of ctx recording that ja authenticated token.
+func (ja *jwtAuth) authenticatedContext(ctx context.Context, token *jwt.Token) context.Context {
+	return context.WithValue(ctx, authenticatedCtxKey, authentication{ja, token})
+}
+
+// isAuthenticated reports whether ja already authenticated the token on ctx, which
+// a later Verify may have replaced.
+func (ja *jwtAuth) isAuthenticated(ctx context.Context) bool {
+	token, _ := ctx.Value(TokenCtxKey).(*jwt.Token)
+	a, ok := ctx.Value(authenticatedCtxKey).(authentication)
+	return ok && token != nil && a.ja == ja && a.token == token
+}
+
+// claimsContext returns a copy of ctx carrying the parsed AppClaims and, if configured,
+// the baggage members of the propagated claims.
+func (ja *jwtAuth) claimsContext(ctx context.Context, claims jwt.MapClaims, c AppClaims) context.Context {
+	ctx = context.WithValue(ctx, AccessClaimsCtxKey, ja.contextClaims(c))
+	if ja.claimsCtxKey != nil {
+		ctx = context.WithValue(ctx, ja.claimsCtxKey, ja.contextClaims(c))
+	}
+	return ja.baggageContext(ctx, claims)
+}
+
+// verifierCtxKey holds the authenticator that verified the token of the request, for
+// the package-level middlewares, e.g. AuditAccess.
+var verifierCtxKey = &contextKey{"Verifier"}
+
+// newContext is NewContext also storing the token and error under the keys set with
+// WithContextKeys, and ja as the verifier.
+func (ja *jwtAuth) newContext(ctx context.Context, t *jwt.Token, err error) context.Context {
+	ctx = NewContext(ctx, t, err)
+	ctx = context.WithValue(ctx, verifierCtxKey, ja)
+	if ja.tokenCtxKey != nil {
+		ctx = context.WithValue(ctx, ja.tokenCtxKey, t)
+	}
+	if ja.errCtxKey != nil {
+		ctx = context.WithValue(ctx, ja.errCtxKey, err)
+	}
+	return ctx
+}
+
+// contextClaims returns the part of c kept on the request context.
+func (ja *jwtAuth) contextClaims(c AppClaims) AppClaims {
+	if ja.claimsAEAD != nil {
+		return AppClaims{UserID: c.UserID, Roles: c.Roles, StandardClaims: jwt.StandardClaims{Subject: c.Subject}}
+	}
+	return c
+}
+
+// newLazyClaims returns the lazyClaims parsing claims on first access.
+func (ja *jwtAuth) newLazyClaims(claims jwt.MapClaims) *lazyClaims {
+	return &lazyClaims{parse: func() (AppClaims, error) {
+		var c AppClaims
+		if err := ja.parseClaims(&c, claims); err != nil {
+			return AppClaims{}, err
+		}
+		return ja.contextClaims(c), nil
+	}}
+}
+
+// baggageContext returns a copy of ctx carrying, if configured, the baggage members
+// of the propagated claims.
+func (ja *jwtAuth) baggageContext(ctx context.Context, claims jwt.MapClaims) context.Context {
+	if ja.baggage != nil && len(ja.baggageClaims) > 0 {
+		members := make(map[string]string, len(ja.baggageClaims))
+		for _, name := range ja.baggageClaims {
+			if v, ok := toString(claims[name]); ok {
+				members[name] = v
+			}
+		}
+		if len(members) > 0 {
+			ctx = ja.baggage(ctx, members)
+		}
+	}
+	return ctx
+}
+
 // Verify http middleware handler will verify a JWT string from a http request.
 //
 // Verify will search for a JWT token in a http request, in the order:
-//   1. 'jwt' URI query parameter
-//   2. 'Authorization: BEARER T' request header
-//   3. Cookie 'jwt' value
+//  1. 'jwt' URI query parameter
+//  2. 'Authorization: BEARER T' request header
+//  3. Cookie 'jwt' value
+//
+// The sources searched and their order can be changed with WithTokenSources.
 //
 // The first JWT string that is found as a query parameter, authorization header
 // or cookie header is then decoded by the `jwt-go` library and a *jwt.Token
 // object is set on the request context. In the case of a signature decoding error
-// the Verify will also set the error on the request context.
+// the Verify will also set the error on the request context, see ErrorFromContext.
 //
 // The Verify always calls the next http handler in sequence, which can either
 // be the generic `jwtauth.Authenticate` middleware or your own custom handler
 // which checks the request context jwt token and error to prepare a custom
 // http response.
-func (ja *jwtAuth) Verify() func(http.Handler) http.Handler {
+func (ja *jwtAuth) Verify() Middleware {
 	return func(next http.Handler) http.Handler {
-		return ja.verify(ja.TokenFromQuery, ja.TokenFromHeader, ja.TokenFromCookie)(next)
+		return ja.verify()(next)
+	}
+}
+
+// tokenFinder extracts a token string from the request source it is named after.
+type tokenFinder struct {
+	source string
+	find   func(r *http.Request) string
+}
+
+// finders returns the token finders of all supported sources, in the default order.
+func (ja *jwtAuth) finders() []tokenFinder {
+	return []tokenFinder{
+		{TokenSourceQuery, ja.TokenFromQuery},
+		{TokenSourceHeader, ja.TokenFromHeader},
+		{TokenSourceCookie, ja.TokenFromCookie},
+		{TokenSourceForwardedAccessToken, ja.tokenFromForwardedAccessToken},
+		{TokenSourceMeshPayload, ja.tokenFromMeshPayload},
 	}
 }
 
-func (ja *jwtAuth) verify(findTokenFns ...func(r *http.Request) string) func(http.Handler) http.Handler {
+// tokenFinders returns the token finders of the configured sources, in order.
+func (ja *jwtAuth) tokenFinders() []tokenFinder {
+	var finders []tokenFinder
+	for _, source := range ja.tokenSources {
+		for _, f := range ja.finders() {
+			if f.source == source {
+				finders = append(finders, f)
+			}
+		}
+	}
+	return finders
+}
+
+// TokenSources returns the sources Verify searches for a token, in order, e.g. to
+// check query tokens are disabled in production. Unknown sources are left out.
+func (ja *jwtAuth) TokenSources() []string {
+	ja = ja.current()
+	var sources []string
+	for _, f := range ja.tokenFinders() {
+		sources = append(sources, f.source)
+	}
+	return sources
+}
+
+func (ja *jwtAuth) verify() Middleware {
 	return func(next http.Handler) http.Handler {
 		hfn := func(w http.ResponseWriter, r *http.Request) {
+			ja := ja.current()
+			if ja.isExempt(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
 			ctx := r.Context()
-			token, err := ja.verifyRequest(r, findTokenFns...)
-			ctx = NewContext(ctx, token, err)
+			token, source, err := ja.verifyRequest(r, ja.sourceFinders...)
+			if err == nil && ja.expiryGrace > 0 && isExpired(token) {
+				w.Header().Set(RefreshRecommendedHeader, "true")
+			}
+			if err == nil && ja.deprecationReporter != nil {
+				ja.reportDeprecated(r, token)
+			}
+			verified := token
+			if token != nil && ja.claimsAEAD != nil {
+				ctx, token = ja.sealClaims(ctx, token)
+			}
+			ctx = ja.newContext(ctx, token, sourceError(source, contextError(err)))
+			if source != "" {
+				ctx = context.WithValue(ctx, TokenSourceCtxKey, source)
+			}
+			if ja.debugTrace != nil {
+				ja.debugTrace.trace(w, r.WithContext(ctx), next, verified, source, err)
+				return
+			}
 			next.ServeHTTP(w, r.WithContext(ctx))
 		}
 		return http.HandlerFunc(hfn)
 	}
 }
 
-func (ja *jwtAuth) verifyRequest(r *http.Request, findTokenFns ...func(r *http.Request) string) (*jwt.Token, error) {
-	var tokenStr string
-	var err error
+func (ja *jwtAuth) verifyRequest(r *http.Request, finders ...tokenFinder) (*jwt.Token, string, error) {
+	var tokenStr, source string
+
+	// Skip the finders for requests that can't carry a token, e.g. anonymous ones
+	if !mayCarryToken(r) {
+		return nil, "", ErrNoTokenFound
+	}
+
+	// Reject forwarded headers spoofed by clients
+	if err := ja.checkProxy(r); err != nil {
+		return nil, "", err
+	}
 
 	// Extract token string from the request by calling token find functions in
 	// the order they where provided. Further extraction stops if a function
 	// returns a non-empty string.
-	for _, fn := range findTokenFns {
-		tokenStr = fn(r)
+	for _, f := range finders {
+		tokenStr = f.find(r)
 		if tokenStr != "" {
+			source = f.source
 			break
 		}
 	}
+	// Reject tokens sent in sources the finders don't cover
+	if ja.strictSources {
+		for _, f := range ja.finders() {
+			if !hasFinder(finders, f.source) && f.find(r) != "" {
+				return nil, f.source, ErrTokenInDisallowedSource
+			}
+		}
+	}
+
 	if tokenStr == "" {
-		return nil, ErrNoTokenFound
+		return nil, "", ErrNoTokenFound
 	}
 
-	// Verify the token
-	token, err := ja.Decode(tokenStr)
+	// Verify the integrity of the token cookie before decoding it
+	if ja.cookieSecret != nil && source == TokenSourceCookie {
+		if err := ja.verifyCookieSignature(r); err != nil {
+			return nil, source, err
+		}
+	}
+
+	token, err := ja.verifySource(ja.tenantContext(r.Context(), r), tokenStr, source)
 	if err != nil {
-		if verr, ok := err.(*jwt.ValidationError); ok {
-			if verr.Errors&jwt.ValidationErrorExpired > 0 {
-				return token, ErrExpired
-			} else if verr.Errors&jwt.ValidationErrorIssuedAt > 0 {
-				return token, ErrIATInvalid
-			} else if verr.Errors&jwt.ValidationErrorNotValidYet > 0 {
-				return token, ErrNBFInvalid
-			}
+		return token, source, err
+	}
+
+	// Verify the audience expected for the request
+	if ja.audienceFunc != nil {
+		claims, _ := token.Claims.(jwt.MapClaims)
+		if !audienceMatches(audienceClaim(claims), ja.audienceFunc(r), ja.audienceMode) {
+			return token, source, ErrAudienceInvalid
+		}
+	}
+
+	return token, source, nil
+}
+
+// mayCarryToken reports whether any of the token sources of the request, configured
+// or not, may hold a value. It errs on the side of true, being only a shortcut for
+// requests without a query, an Authorization or Cookie header or forwarded headers.
+func mayCarryToken(r *http.Request) bool {
+	if r.URL != nil && r.URL.RawQuery != "" {
+		return true
+	}
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" {
+		return true
+	}
+	for _, h := range forwardedHeaders {
+		if r.Header.Get(h) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func hasFinder(finders []tokenFinder, source string) bool {
+	for _, f := range finders {
+		if f.source == source {
+			return true
 		}
+	}
+	return false
+}
+
+// verifyToken decodes the token string and maps validation failures to the library errors.
+func (ja *jwtAuth) verifyToken(ctx context.Context, tokenStr string) (*jwt.Token, error) {
+	// Verify the token
+	token, err := ja.decode(ctx, tokenStr, ja.typs)
+	return ja.checkToken(token, err)
+}
+
+// meshPayloadToken returns the token of a payload verified by a service mesh, see
+// WithTrustedMeshPayload. Only its claims are checked.
+func (ja *jwtAuth) meshPayloadToken(payload string) (*jwt.Token, error) {
+	if !ja.trustMeshPayload {
+		return nil, ErrTokenInDisallowedSource
+	}
+	data, err := decodeSegment(payload)
+	if err != nil {
+		return nil, jwt.NewValidationError(err.Error(), jwt.ValidationErrorMalformed)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if ja.parser != nil && ja.parser.UseJSONNumber {
+		dec.UseNumber()
+	}
+	claims := jwt.MapClaims{}
+	if err := dec.Decode(&claims); err != nil {
+		return nil, jwt.NewValidationError(err.Error(), jwt.ValidationErrorMalformed)
+	}
+
+	token := &jwt.Token{Raw: payload, Method: ja.signer, Header: map[string]interface{}{}, Claims: claims}
+	vErr := &jwt.ValidationError{}
+	if ja.parser == nil || !ja.parser.SkipClaimsValidation {
+		validateTimes(claims, time.Now().Unix(), vErr)
+	}
+	if vErr.Errors != 0 {
+		return ja.checkToken(token, vErr)
+	}
+	token.Valid = true
+	return ja.checkToken(token, nil)
+}
+
+// checkToken maps the validation failures of a decoded token to the library errors
+// and applies the checks beyond the signature and times.
+func (ja *jwtAuth) checkToken(token *jwt.Token, err error) (*jwt.Token, error) {
+	if token, err = ja.checkSignedToken(token, err); err != nil {
 		return token, err
 	}
+	return token, ja.checkAccessToken(token)
+}
+
+// checkSignedToken maps the validation failures of a decoded token to the library
+// errors and checks the registered claims and the subject, which apply to all tokens.
+func (ja *jwtAuth) checkSignedToken(token *jwt.Token, err error) (*jwt.Token, error) {
+	if err != nil {
+		verr, ok := err.(*jwt.ValidationError)
+		switch {
+		case !ok:
+			return token, err
+		case verr.Errors&^timeValidationErrors == 0 && ja.withinLeeway(token):
+			// the signature is good and the times are off by less than the leeway
+			token.Valid = true
+		case verr.Errors == jwt.ValidationErrorExpired && ja.withinExpiryGrace(token):
+			// the signature is good and the token expired within the grace period
+			token.Valid = true
+		case IsSystemError(verr.Inner):
+			return token, verr.Inner
+		case verr.Inner == ErrAlgoInvalid:
+			return token, ErrAlgoInvalid
+		case errors.Is(verr.Inner, ErrX5CChainInvalid), errors.Is(verr.Inner, ErrIssuerInvalid):
+			return token, verr.Inner
+		case verr.Errors&jwt.ValidationErrorExpired > 0:
+			return token, ErrExpired
+		case verr.Errors&jwt.ValidationErrorIssuedAt > 0:
+			return token, ErrIATInvalid
+		case verr.Errors&jwt.ValidationErrorNotValidYet > 0:
+			return token, ErrNBFInvalid
+		default:
+			return token, err
+		}
+	}
+
+	// Verify the token isn't dated too far ahead, whatever the leeway
+	if ja.maxFutureSkew > 0 && ja.datedAfter(token, time.Now().Add(ja.maxFutureSkew)) {
+		return token, ErrIATInvalid
+	}
+
+	// Verify the custom issue time like the parser does "iat"
+	if ja.issuedAtClaim != "" {
+		claims, _ := token.Claims.(jwt.MapClaims)
+		if iat, ok := ja.issuedAt(claims); ok && time.Unix(iat, 0).After(time.Now().Add(ja.leeway)) {
+			return token, ErrIATInvalid
+		}
+	}
 
 	// Verify signing algorithm
-	if token.Method != ja.signer {
+	if !ja.isSigner(token.Method) {
 		return token, ErrAlgoInvalid
 	}
 
-	// Valid!
+	// Verify the audience
+	if len(ja.audience) > 0 {
+		claims, _ := token.Claims.(jwt.MapClaims)
+		if !audienceMatches(audienceClaim(claims), ja.audience, ja.audienceMode) {
+			return token, ErrAudienceInvalid
+		}
+	}
+
+	// Verify the token expires in time
+	if err := ja.checkLifetime(token); err != nil {
+		return token, err
+	}
+
+	// Verify the issuer
+	if len(ja.issuers) > 0 {
+		claims, _ := token.Claims.(jwt.MapClaims)
+		iss, _ := claims["iss"].(string)
+		if !containsString(ja.issuers, iss) {
+			return token, ErrIssuerInvalid
+		}
+	}
+
+	// Verify the subject format
+	if ja.subjectValidator != nil {
+		claims, _ := token.Claims.(jwt.MapClaims)
+		sub, _ := ja.rootClaims(claims)["sub"].(string)
+		if err := ja.subjectValidator(sub); err != nil {
+			return token, fmt.Errorf("%w: %v", ErrInvalidSubject, err)
+		}
+	}
+
 	return token, nil
 }
 
+// checkAccessToken applies the checks of the tokens granting access, on top of those
+// of checkSignedToken.
+func (ja *jwtAuth) checkAccessToken(token *jwt.Token) error {
+	// Verify the credentials didn't change since the token was issued
+	if err := ja.checkCredentials(token); err != nil {
+		return err
+	}
+
+	// Verify the token has the current version
+	if err := ja.checkTokenVersion(token); err != nil {
+		return err
+	}
+
+	// Verify the token doesn't grant too many roles
+	if ja.maxRoles > 0 {
+		claims, _ := token.Claims.(jwt.MapClaims)
+		if roles, _ := parseRoles(ja.rootClaims(claims)["roles"], ja.rolesDelimiter); len(roles) > ja.maxRoles {
+			return ErrClaimsTooLarge
+		}
+	}
+
+	// Verify the claims conform to the schema
+	if ja.claimsSchema != nil {
+		claims, _ := token.Claims.(jwt.MapClaims)
+		if err := ja.claimsSchema.validate(map[string]interface{}(claims), ""); err != nil {
+			return err
+		}
+	}
+
+	// Verify the token has a nonce if required, which Authenticate uses up
+	return ja.checkNonce(token)
+}
+
+// audienceClaim returns the "aud" claim, which is either a single string or an array.
+func audienceClaim(claims jwt.MapClaims) []string {
+	switch aud := claims["aud"].(type) {
+	case string:
+		if aud == "" {
+			return nil
+		}
+		return []string{aud}
+	case []string:
+		return aud
+	case []interface{}:
+		list := make([]string, 0, len(aud))
+		for _, v := range aud {
+			if s, ok := v.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// audienceMatches reports whether the token audience contains any, or with
+// AudienceMatchAll every, of the accepted audiences.
+func audienceMatches(aud, accepted []string, mode AudienceMatchMode) bool {
+	if len(accepted) == 0 {
+		return false
+	}
+	for _, a := range accepted {
+		found := containsString(aud, a)
+		if found && mode == AudienceMatchAny {
+			return true
+		}
+		if !found && mode == AudienceMatchAll {
+			return false
+		}
+	}
+	return mode == AudienceMatchAll
+}
+
+// withinExpiryGrace reports whether the token expired less than the expiry grace ago.
+func (ja *jwtAuth) withinExpiryGrace(token *jwt.Token) bool {
+	if ja.expiryGrace <= 0 || token == nil {
+		return false
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return false
+	}
+	exp, ok := toInt64(claims["exp"])
+	return ok && time.Now().Before(time.Unix(exp, 0).Add(ja.expiryGrace))
+}
+
+// checkLifetime enforces the WithRequireExpiry and WithMaxTokenLifetime policies.
+func (ja *jwtAuth) checkLifetime(token *jwt.Token) error {
+	if !ja.requireExpiry && ja.maxLifetime <= 0 {
+		return nil
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	exp, ok := toInt64(claims["exp"])
+	if !ok {
+		if ja.requireExpiry {
+			return ErrMissingExpiry
+		}
+		return ErrTokenLifetimeExceeded
+	}
+	if ja.maxLifetime > 0 {
+		iat, ok := ja.issuedAt(claims)
+		if !ok {
+			iat = time.Now().Unix()
+		}
+		if time.Unix(exp, 0).Sub(time.Unix(iat, 0)) > ja.maxLifetime {
+			return ErrTokenLifetimeExceeded
+		}
+	}
+	return nil
+}
+
+// timeValidationErrors are the validation errors WithLeeway can tolerate.
+const timeValidationErrors = jwt.ValidationErrorExpired | jwt.ValidationErrorIssuedAt | jwt.ValidationErrorNotValidYet
+
+// withinLeeway reports whether the token times are valid allowing for the leeway.
+func (ja *jwtAuth) withinLeeway(token *jwt.Token) bool {
+	if ja.leeway <= 0 || token == nil {
+		return false
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return false
+	}
+	leeway := int64(ja.leeway / time.Second)
+	now := time.Now().Unix()
+	vErr := &jwt.ValidationError{}
+	validateTimes(claims, now-leeway, vErr)
+	expired := vErr.Errors & jwt.ValidationErrorExpired
+	vErr.Errors = 0
+	validateTimes(claims, now+leeway, vErr)
+	return expired == 0 && vErr.Errors&^jwt.ValidationErrorExpired == 0
+}
+
+// datedAfter reports whether the issue time or "nbf" claim of the token is after t.
+func (ja *jwtAuth) datedAfter(token *jwt.Token, t time.Time) bool {
+	claims, _ := token.Claims.(jwt.MapClaims)
+	if iat, ok := ja.issuedAt(claims); ok && iat > t.Unix() {
+		return true
+	}
+	nbf, ok := toInt64(claims["nbf"])
+	return ok && nbf > t.Unix()
+}
+
+// isExpired reports whether the "exp" claim of the token lies in the past.
+func isExpired(token *jwt.Token) bool {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return false
+	}
+	exp, ok := toInt64(claims["exp"])
+	return ok && exp < time.Now().Unix()
+}
+
+// checkRequest runs the checks binding a verified token to the request it was sent
+// with and the session limit.
+func (ja *jwtAuth) checkRequest(r *http.Request, claims jwt.MapClaims) error {
+	if err := ja.checkDeepLink(r, claims); err != nil {
+		return err
+	}
+	if err := ja.checkHost(r); err != nil {
+		return err
+	}
+	if err := ja.checkFingerprint(r, claims); err != nil {
+		return err
+	}
+	if err := ja.checkIP(r, claims); err != nil {
+		return err
+	}
+	if err := ja.checkBodyHash(r, claims); err != nil {
+		return err
+	}
+	if err := ja.checkCSRF(r); err != nil {
+		return err
+	}
+	return ja.checkSession(claims)
+}
+
+// checkCSRF enforces the double-submit CSRF defense for tokens sent in a cookie.
+// Safe methods are exempt, as are tokens from the other sources, which browsers
+// don't send automatically.
+func (ja *jwtAuth) checkCSRF(r *http.Request) error {
+	if ja.csrfCookieName == "" {
+		return nil
+	}
+	if source, _ := TokenSourceFromCtx(r.Context()); source != TokenSourceCookie {
+		return nil
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return nil
+	}
+	cookie, err := r.Cookie(ja.csrfCookieName)
+	if err != nil || cookie.Value == "" {
+		return ErrCSRFTokenMismatch
+	}
+	header := r.Header.Get(CSRFHeader)
+	if subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) != 1 {
+		return ErrCSRFTokenMismatch
+	}
+	return nil
+}
+
+// checkFingerprint compares the "fp" claim of a token with the fingerprint of the request.
+func (ja *jwtAuth) checkFingerprint(r *http.Request, claims jwt.MapClaims) error {
+	if ja.fingerprint == nil {
+		return nil
+	}
+	v, ok := claims["fp"]
+	if !ok {
+		return nil
+	}
+	fp, ok := v.(string)
+	if !ok || subtle.ConstantTimeCompare([]byte(fp), []byte(ja.fingerprint(r))) != 1 {
+		return ErrFingerprintMismatch
+	}
+	return nil
+}
+
+// checkIP compares the "cip" claim of a token with the client IP of the request.
+func (ja *jwtAuth) checkIP(r *http.Request, claims jwt.MapClaims) error {
+	if ja.extractIP == nil {
+		return nil
+	}
+	v, ok := claims["cip"]
+	if !ok {
+		return nil
+	}
+	cip, _ := v.(string)
+	bound, client := net.ParseIP(cip), net.ParseIP(ja.extractIP(r))
+	if bound == nil || client == nil || !bound.Equal(client) {
+		return ErrIPMismatch
+	}
+	return nil
+}
+
+// AutoRefresh middleware mints a fresh token for authenticated requests whose token
+// expires within the given duration. The new token carries the exact claims of the
+// current one with only "iat" and "exp" renewed, the lifetime being the configured
+// JWT expiry, or the lifetime of the current token when none is configured. It is
+// set with SetTokenCookie if the token was sent in a cookie, and in the
+// X-Refreshed-Token response header otherwise. Expired tokens are never refreshed, nor
+// are the tokens of requests denied further down the chain, e.g. by RequiresRole, with
+// a 401 Unauthorized or 403 Forbidden response: the token is minted once the response
+// status is known.
+func (ja *jwtAuth) AutoRefresh(within time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			ja := ja.current()
+			sw := &statusWriter{ResponseWriter: w}
+			sw.beforeHeader = func(status int) {
+				if status == http.StatusUnauthorized || status == http.StatusForbidden {
+					return
+				}
+				if tokenString, ok := ja.refreshToken(r, within); ok {
+					if source, _ := TokenSourceFromCtx(r.Context()); source == TokenSourceCookie {
+						ja.SetTokenCookie(w, tokenString)
+					} else {
+						w.Header().Set(RefreshedTokenHeader, tokenString)
+					}
+				}
+			}
+			next.ServeHTTP(sw, r)
+			if sw.status == 0 {
+				sw.WriteHeader(http.StatusOK)
+			}
+		}
+		return http.HandlerFunc(hfn)
+	}
+}
+
+// refreshToken returns a renewed token string for a valid token of the request
+// expiring within the given duration.
+func (ja *jwtAuth) refreshToken(r *http.Request, within time.Duration) (string, bool) {
+	token, claims, err := ja.tokenFromContext(r.Context())
+	if err != nil || token == nil || !token.Valid {
+		return "", false
+	}
+	exp, ok := toInt64(claims["exp"])
+	if !ok {
+		return "", false
+	}
+	now := time.Now()
+	expiresAt := time.Unix(exp, 0)
+	if !expiresAt.After(now) || expiresAt.Sub(now) > within {
+		return "", false
+	}
+
+	lifetime := ja.jwtExpiry
+	if lifetime <= 0 {
+		iat, ok := ja.issuedAt(claims)
+		if !ok || iat >= exp {
+			return "", false
+		}
+		lifetime = time.Duration(exp-iat) * time.Second
+	}
+
+	fresh := make(jwt.MapClaims, len(claims))
+	for k, v := range claims {
+		fresh[k] = v
+	}
+	fresh["iat"] = now.Unix()
+	fresh["exp"] = now.Add(lifetime).Unix()
+	_, tokenString, err := ja.Encode(fresh)
+	if err != nil {
+		return "", false
+	}
+	return tokenString, true
+}
+
+// deny replies to a request an authorization middleware rejects like http.Error,
+// naming the reason, one of the ErrorCode constants, in the DenyReasonHeader.
+func deny(w http.ResponseWriter, reason, msg string, status int) {
+	w.Header().Set(DenyReasonHeader, reason)
+	http.Error(w, msg, status)
+}
+
+// unauthorizedReason returns the deny reason for a request without a verified token,
+// which failed verification with err.
+func unauthorizedReason(err error) string {
+	if err == nil {
+		return ErrorCodeUnauthorized
+	}
+	return AuthErrorCode(err)
+}
+
 // RequiresRole middleware restricts access to accounts having role parameter in their jwt claims.
-func (ja *jwtAuth) RequiresRole(role Role) func(next http.Handler) http.Handler {
+// It can be mounted with or without Authenticate in front, as long as Verify is. Without
+// it, tokens failing the checks Authenticate runs are denied with the ErrorStatus of
+// their error.
+func (ja *jwtAuth) RequiresRole(role Role) Middleware {
 	return func(next http.Handler) http.Handler {
 		hfn := func(w http.ResponseWriter, r *http.Request) {
-			claims := AppClaimsFromCtx(r.Context())
-			if !hasRole(role, claims.Roles) {
-				http.Error(w, http.StatusText(401), 401)
+			ja := ja.current()
+			if ja.isExempt(r) {
+				next.ServeHTTP(w, r)
 				return
 			}
-			next.ServeHTTP(w, r)
+
+			claims, ctx, err := ja.claimsFromRequest(r)
+			if err != nil {
+				status := ErrorStatus(err)
+				deny(w, unauthorizedReason(err), http.StatusText(status), status)
+				return
+			}
+			roles, err := ja.currentRoles(r.Context(), claims)
+			if err != nil {
+				deny(w, AuthErrorCode(err), http.StatusText(503), 503)
+				return
+			}
+			if !hasRole(role, roles, ja.caseInsensitiveRoles) && !ja.impliedByScopes(role, scopesClaim(claims.custom)) {
+				deny(w, ErrorCodeRoleMissing, http.StatusText(401), 401)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+		return http.HandlerFunc(hfn)
+	}
+}
+
+// WrapHandlerFunc protects fn with the Verify and Authenticate middlewares and, for
+// each of the given roles, RequiresRole, so the request must carry all of them. It is
+// a shorthand for endpoints registered as plain http.HandlerFuncs:
+//
+//	http.HandleFunc("/admin", tokenAuth.WrapHandlerFunc(adminHandler, "ADMIN"))
+func (ja *jwtAuth) WrapHandlerFunc(fn http.HandlerFunc, roles ...Role) http.HandlerFunc {
+	var h http.Handler = fn
+	for i := len(roles) - 1; i >= 0; i-- {
+		h = ja.RequiresRole(roles[i])(h)
+	}
+	return ja.Verify()(ja.Authenticate(h)).ServeHTTP
+}
+
+// claimsFromRequest returns the AppClaims set on the request context by Authenticate,
+// or when Authenticate hasn't run, parses them from the token verified by Verify and
+// uses it up, returning the request context recording it.
+func (ja *jwtAuth) claimsFromRequest(r *http.Request) (AppClaims, context.Context, error) {
+	switch c := r.Context().Value(AccessClaimsCtxKey).(type) {
+	case AppClaims:
+		return c, r.Context(), nil
+	case *lazyClaims:
+		c2, err := c.get()
+		return c2, r.Context(), err
+	}
+
+	token, claims, err := ja.tokenFromContext(r.Context())
+	if err != nil {
+		return AppClaims{}, nil, err
+	}
+	if token == nil || !token.Valid {
+		return AppClaims{}, nil, ErrUnauthorized
+	}
+	if err := ja.checkRequest(r, claims); err != nil {
+		return AppClaims{}, nil, err
+	}
+
+	var c AppClaims
+	if err := ja.parseClaims(&c, claims); err != nil {
+		return AppClaims{}, nil, err
+	}
+	ctx, err := ja.useToken(r.Context(), token)
+	if err != nil {
+		return AppClaims{}, nil, err
+	}
+	return c, ctx, nil
+}
+
+// CapDeadlineToExpiry middleware caps the deadline of the request context at the
+// "exp" claim of the verified token, so that work on behalf of the user stops once
+// their authorization lapses. The authorization of tokens accepted past their expiry,
+// with WithLeeway or WithExpiryGrace, lapses when the longer of the two has passed
+// since the "exp" claim. A sooner existing deadline is kept and requests without
+// a valid, expiring token pass through unchanged. Context cancellation is cooperative:
+// handlers, and the calls they make, that don't observe ctx.Done() keep running past
+// the deadline, so the cap only bounds work that watches the context. It goes after
+// Authenticate in the chain.
+func (ja *jwtAuth) CapDeadlineToExpiry() Middleware {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			ja := ja.current()
+			token, claims, err := ja.tokenFromContext(r.Context())
+			if err != nil || token == nil || !token.Valid {
+				next.ServeHTTP(w, r)
+				return
+			}
+			exp, ok := toInt64(claims["exp"])
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			pastExpiry := ja.leeway
+			if ja.expiryGrace > pastExpiry {
+				pastExpiry = ja.expiryGrace
+			}
+			ctx, cancel := context.WithDeadline(r.Context(), time.Unix(exp, 0).Add(pastExpiry))
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+		return http.HandlerFunc(hfn)
+	}
+}
+
+// RequiresTokenUse middleware restricts access to tokens issued for the given use, e.g.
+// "access", so that OIDC ID tokens sent by mistake are rejected at API endpoints with
+// a 401 Unauthorized response. The use is read from the "token_use" claim, or the
+// claim set with WithTokenUseClaim. Without that claim a token is taken for an ID
+// token when its header "typ" is not "at+jwt" and it carries a "nonce" or "at_hash"
+// claim, or an "azp" claim equal to its single audience, and for an access token
+// otherwise.
+func (ja *jwtAuth) RequiresTokenUse(use string) Middleware {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			ja := ja.current()
+			if ja.isExempt(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token, claims, err := ja.tokenFromContext(r.Context())
+			if err != nil || token == nil || !token.Valid {
+				deny(w, unauthorizedReason(err), http.StatusText(401), 401)
+				return
+			}
+			if ja.tokenUse(token, claims) != use {
+				deny(w, ErrorCodeTokenUseInvalid, ErrTokenUseInvalid.Error(), 401)
+				return
+			}
+			ja.serveUsed(w, r, next, token)
+		}
+		return http.HandlerFunc(hfn)
+	}
+}
+
+// RequiresFeature middleware restricts access to tokens entitled to the given feature,
+// listed in the "features" claim, or the claim set with WithFeaturesClaim, as an array
+// or a single string. Requests without a verified token get a 401 Unauthorized
+// response, tokens without the feature a 403 Forbidden one.
+func (ja *jwtAuth) RequiresFeature(feature string) Middleware {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			ja := ja.current()
+			if ja.isExempt(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token, claims, err := ja.tokenFromContext(r.Context())
+			if err != nil || token == nil || !token.Valid {
+				deny(w, unauthorizedReason(err), http.StatusText(401), 401)
+				return
+			}
+			if !containsString(stringsClaim(claims[ja.featuresClaim]), feature) {
+				deny(w, ErrorCodeFeatureMissing, http.StatusText(403), 403)
+				return
+			}
+			ja.serveUsed(w, r, next, token)
+		}
+		return http.HandlerFunc(hfn)
+	}
+}
+
+// RequiresScope middleware restricts access to tokens granted the given scope, listed
+// in the space separated "scope" claim or the "scp" array claim. Requests without a
+// verified token get a 401 Unauthorized response, tokens without the scope a 403
+// Forbidden one.
+func (ja *jwtAuth) RequiresScope(scope string) Middleware {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			ja := ja.current()
+			if ja.isExempt(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token, claims, err := ja.tokenFromContext(r.Context())
+			if err != nil || token == nil || !token.Valid {
+				deny(w, unauthorizedReason(err), http.StatusText(401), 401)
+				return
+			}
+			granted, err := ja.grantedScopes(r.Context(), claims)
+			if err != nil {
+				deny(w, AuthErrorCode(err), http.StatusText(503), 503)
+				return
+			}
+			if !containsString(granted, scope) {
+				deny(w, ErrorCodeScopeMissing, http.StatusText(403), 403)
+				return
+			}
+			ja.serveUsed(w, r, next, token)
+		}
+		return http.HandlerFunc(hfn)
+	}
+}
+
+// RequiresScopes middleware restricts access to tokens granted any, or with MatchAll
+// every, of the given scopes. Requests without a verified token get a 401 Unauthorized
+// response and the others a 403 Forbidden one, its body listing the missing scopes.
+func (ja *jwtAuth) RequiresScopes(mode MatchMode, scopes ...string) Middleware {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			ja := ja.current()
+			if ja.isExempt(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token, claims, err := ja.tokenFromContext(r.Context())
+			if err != nil || token == nil || !token.Valid {
+				deny(w, unauthorizedReason(err), http.StatusText(401), 401)
+				return
+			}
+			granted, err := ja.grantedScopes(r.Context(), claims)
+			if err != nil {
+				deny(w, AuthErrorCode(err), http.StatusText(503), 503)
+				return
+			}
+			if missing := missingScopes(granted, scopes, mode); len(missing) > 0 {
+				deny(w, ErrorCodeScopeMissing, http.StatusText(403)+": missing scopes "+strings.Join(missing, " "), 403)
+				return
+			}
+			ja.serveUsed(w, r, next, token)
+		}
+		return http.HandlerFunc(hfn)
+	}
+}
+
+// missingScopes returns the required scopes not granted, or none when the granted
+// scopes satisfy the match mode.
+func missingScopes(granted, required []string, mode MatchMode) []string {
+	var missing []string
+	for _, scope := range required {
+		if !containsString(granted, scope) {
+			missing = append(missing, scope)
+		}
+	}
+	if mode == MatchAny && len(missing) < len(required) {
+		return nil
+	}
+	return missing
+}
+
+// scopesClaim returns the scopes granted by the "scope" or "scp" claim.
+func scopesClaim(claims jwt.MapClaims) []string {
+	if scope, ok := claims["scope"].(string); ok {
+		return strings.Fields(scope)
+	}
+	if scope, ok := claims["scp"].(string); ok {
+		return strings.Fields(scope)
+	}
+	scopes, _ := toStringSlice(claims["scp"])
+	return scopes
+}
+
+// grantedScopes returns the scopes granted by claims along with those implied by
+// their current roles, see WithRoleScopeMap and WithRoleResolver.
+func (ja *jwtAuth) grantedScopes(ctx context.Context, claims jwt.MapClaims) ([]string, error) {
+	scopes := scopesClaim(claims)
+	if len(ja.roleScopes) == 0 {
+		return scopes, nil
+	}
+	root := ja.rootClaims(claims)
+	roles, _ := parseRoles(root["roles"], ja.rolesDelimiter)
+	iat, _ := ja.issuedAt(claims)
+	roles, err := ja.resolveRoles(ctx, subjectClaim(root), iat, roles)
+	if err != nil {
+		return nil, err
+	}
+	for role, implied := range ja.roleScopes {
+		if hasRole(role, roles, ja.caseInsensitiveRoles) {
+			scopes = append(scopes, implied...)
+		}
+	}
+	return scopes, nil
+}
+
+// impliedByScopes reports whether scopes include every scope role implies.
+func (ja *jwtAuth) impliedByScopes(role Role, scopes []string) bool {
+	for r, implied := range ja.roleScopes {
+		if len(implied) == 0 || !hasRole(role, []Role{r}, ja.caseInsensitiveRoles) {
+			continue
+		}
+		if len(missingScopes(scopes, implied, MatchAll)) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// RequiresSubjectMatch middleware restricts access to requests acting on behalf of the
+// token subject: the value extract reads from the request, e.g. a "user_id" field of
+// the body, must equal the "sub" claim. The body is buffered, so extract may consume
+// it and the next handler still reads it in full. Requests without a verified token
+// get a 401 Unauthorized response, requests extract fails for a 400 Bad Request one,
+// bodies over the WithMaxBodySize limit a 413 Request Entity Too Large one and
+// mismatching requests a 403 Forbidden one.
+func (ja *jwtAuth) RequiresSubjectMatch(extract func(r *http.Request) (string, error)) Middleware {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			ja := ja.current()
+			if ja.isExempt(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token, claims, err := ja.tokenFromContext(r.Context())
+			if err != nil || token == nil || !token.Valid {
+				deny(w, unauthorizedReason(err), http.StatusText(401), 401)
+				return
+			}
+
+			var body []byte
+			if r.Body != nil {
+				if body, err = readBody(w, r, ja.maxBodySize); err == ErrBodyTooLarge {
+					deny(w, ErrorCodeBodyTooLarge, http.StatusText(413), 413)
+					return
+				} else if err != nil {
+					http.Error(w, http.StatusText(400), 400)
+					return
+				}
+				r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			}
+			subject, err := extract(r)
+			if err != nil {
+				http.Error(w, http.StatusText(400), 400)
+				return
+			}
+			if sub, ok := ja.rootClaims(claims)["sub"].(string); !ok || sub == "" || sub != subject {
+				deny(w, ErrorCodeSubjectMismatch, http.StatusText(403), 403)
+				return
+			}
+
+			if r.Body != nil {
+				r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			}
+			ja.serveUsed(w, r, next, token)
+		}
+		return http.HandlerFunc(hfn)
+	}
+}
+
+// readBody reads and closes the request body, failing with ErrBodyTooLarge if it is
+// over limit bytes.
+func readBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, error) {
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil && int64(len(body)) >= limit {
+		return nil, ErrBodyTooLarge
+	}
+	return body, err
+}
+
+// RequiresAuthorizedParty middleware restricts access to tokens requested by one of
+// the given clients, identified by the "azp" claim. Following OIDC, a token without
+// the claim was requested by its audience, when it has a single one. Requests without
+// a verified token get a 401 Unauthorized response, tokens of other clients a 403
+// Forbidden one.
+func (ja *jwtAuth) RequiresAuthorizedParty(azp ...string) Middleware {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			ja := ja.current()
+			if ja.isExempt(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token, claims, err := ja.tokenFromContext(r.Context())
+			if err != nil || token == nil || !token.Valid {
+				deny(w, unauthorizedReason(err), http.StatusText(401), 401)
+				return
+			}
+			if !containsString(azp, authorizedParty(claims)) {
+				deny(w, ErrorCodeAuthorizedPartyMismatch, http.StatusText(403), 403)
+				return
+			}
+			ja.serveUsed(w, r, next, token)
+		}
+		return http.HandlerFunc(hfn)
+	}
+}
+
+// RequiresRegion middleware restricts access to tokens whose "region" claim equals the
+// region serving the request, for data residency: the one WithRegionFunc derives from
+// the request, if set and not empty, or else region. Requests without a verified token
+// get a 401 Unauthorized response, tokens of another or no region a 403 Forbidden one.
+func (ja *jwtAuth) RequiresRegion(region string) Middleware {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			ja := ja.current()
+			if ja.isExempt(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token, claims, err := ja.tokenFromContext(r.Context())
+			if err != nil || token == nil || !token.Valid {
+				deny(w, unauthorizedReason(err), http.StatusText(401), 401)
+				return
+			}
+			expected := region
+			if ja.regionFunc != nil {
+				if rg := ja.regionFunc(r); rg != "" {
+					expected = rg
+				}
+			}
+			if rg, _ := claims["region"].(string); expected == "" || rg != expected {
+				deny(w, ErrorCodeRegionMismatch, http.StatusText(403), 403)
+				return
+			}
+			ja.serveUsed(w, r, next, token)
 		}
 		return http.HandlerFunc(hfn)
 	}
 }
 
-func hasRole(role Role, roles []Role) bool {
+// RequiresMatchingRequest middleware restricts fine-grained tokens to the requests
+// they were issued for: the request method must be listed in the "allowed_methods"
+// claim and the path match one of the "allowed_paths" claim, each an array or a single
+// string. Paths match exactly, by prefix when they end with "*", e.g. "/hooks/*", or
+// else as a path.Match pattern, e.g. "/users/*/avatar", against the cleaned request
+// path, so "/hooks/../admin" matches "/admin". Absent claims don't restrict the
+// request. Requests without a verified token get a 401 Unauthorized response,
+// mismatching requests a 403 Forbidden one.
+func (ja *jwtAuth) RequiresMatchingRequest() Middleware {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			ja := ja.current()
+			if ja.isExempt(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token, claims, err := ja.tokenFromContext(r.Context())
+			if err != nil || token == nil || !token.Valid {
+				deny(w, unauthorizedReason(err), http.StatusText(401), 401)
+				return
+			}
+			if !requestAllowed(r, claims) {
+				deny(w, ErrorCodeRequestMismatch, http.StatusText(403), 403)
+				return
+			}
+			ja.serveUsed(w, r, next, token)
+		}
+		return http.HandlerFunc(hfn)
+	}
+}
+
+// requestAllowed reports whether the request method and path are allowed by the
+// "allowed_methods" and "allowed_paths" claims.
+func requestAllowed(r *http.Request, claims jwt.MapClaims) bool {
+	if v, ok := claims["allowed_methods"]; ok {
+		allowed := false
+		for _, m := range stringsClaim(v) {
+			allowed = allowed || strings.EqualFold(m, r.Method)
+		}
+		if !allowed {
+			return false
+		}
+	}
+	if v, ok := claims["allowed_paths"]; ok {
+		// Cleaned, so that e.g. "/hooks/../admin" doesn't match "/hooks/*"
+		p := path.Clean("/" + r.URL.Path)
+		for _, pattern := range stringsClaim(v) {
+			if pathMatches(pattern, p) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// pathMatches reports whether p matches pattern, see RequiresMatchingRequest.
+func pathMatches(pattern, p string) bool {
+	if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern && !strings.ContainsAny(prefix, "*?[") {
+		return strings.HasPrefix(p, prefix)
+	}
+	matched, err := path.Match(pattern, p)
+	return err == nil && matched
+}
+
+// authorizedParty returns the client a token was requested by, empty if unknown.
+func authorizedParty(claims jwt.MapClaims) string {
+	if azp, ok := claims["azp"].(string); ok {
+		return azp
+	}
+	if aud := audienceClaim(claims); len(aud) == 1 {
+		return aud[0]
+	}
+	return ""
+}
+
+// stringsClaim returns the strings of a claim that is an array or a single string.
+func stringsClaim(v interface{}) []string {
+	if s, ok := v.(string); ok {
+		return []string{s}
+	}
+	list, _ := toStringSlice(v)
+	return list
+}
+
+// tokenUse returns the use a token was issued for, "access" or "id", or the one of its
+// token use claim, e.g. "deep_link".
+func (ja *jwtAuth) tokenUse(token *jwt.Token, claims jwt.MapClaims) string {
+	if use, ok := claims[ja.tokenUseClaim].(string); ok {
+		return use
+	}
+	if typ, _ := token.Header["typ"].(string); strings.EqualFold(typ, "at+jwt") || strings.EqualFold(typ, "application/at+jwt") {
+		return "access"
+	}
+	if _, ok := claims["nonce"]; ok {
+		return "id"
+	}
+	if _, ok := claims["at_hash"]; ok {
+		return "id"
+	}
+	if azp, ok := claims["azp"].(string); ok {
+		if aud := audienceClaim(claims); len(aud) == 1 && aud[0] == azp {
+			return "id"
+		}
+	}
+	return "access"
+}
+
+// hasRole reports whether roles contains role, ignoring case when fold is set.
+func hasRole(role Role, roles []Role, fold bool) bool {
 	for _, r := range roles {
-		if r == role {
+		if r == role || fold && strings.EqualFold(string(r), string(role)) {
 			return true
 		}
 	}
@@ -0,0 +1,87 @@
+package authentication
+
+import (
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// NonceStore records the "nonce" claims of single-use tokens, see WithNonceStore.
+type NonceStore interface {
+	// Use records nonce as used until expiry, the zero time for tokens that don't
+	// expire, and returns ErrReplay if it has been used before.
+	Use(nonce string, expiry time.Time) error
+}
+
+// WithNonceStore accepts tokens carrying a "nonce" claim only once, rejecting repeats
+// with ErrReplay. Tokens without the claim are accepted unless WithRequireNonce is set.
+// The nonce is used up once per request by the first of Authenticate, Optional and the
+// Requires middlewares the token passes, or by Parse, not by Verify, so that tokens
+// rejected by an earlier check stay usable.
+func WithNonceStore(store NonceStore) Option {
+	return func(ja *jwtAuth) {
+		ja.nonceStore = store
+	}
+}
+
+// WithRequireNonce rejects tokens without a "nonce" claim with ErrMissingNonce.
+func WithRequireNonce() Option {
+	return func(ja *jwtAuth) {
+		ja.requireNonce = true
+	}
+}
+
+// checkNonce enforces WithRequireNonce.
+func (ja *jwtAuth) checkNonce(token *jwt.Token) error {
+	if !ja.requireNonce {
+		return nil
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	if nonce, _ := claims["nonce"].(string); nonce == "" {
+		return ErrMissingNonce
+	}
+	return nil
+}
+
+// useNonce records the token nonce as used, once the token passed every check.
+func (ja *jwtAuth) useNonce(token *jwt.Token) error {
+	if ja.nonceStore == nil {
+		return nil
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	nonce, _ := claims["nonce"].(string)
+	if nonce == "" {
+		return nil
+	}
+	var expiry time.Time
+	if exp, ok := toInt64(claims["exp"]); ok {
+		expiry = time.Unix(exp, 0)
+	}
+	return ja.nonceStore.Use(nonce, expiry)
+}
+
+// memoryNonceStore is a NonceStore keeping the nonces in memory until their token expires.
+type memoryNonceStore struct {
+	mu     sync.Mutex
+	nonces *expiringMap
+}
+
+// NewMemoryNonceStore returns a NonceStore for a single instance service. A nonce is
+// kept until its token expires, after which the token is rejected anyway, and the
+// nonces of tokens without an expiry for the lifetime of the store. Instances behind
+// a load balancer need a shared store, or a token replays once per instance.
+func NewMemoryNonceStore() NonceStore {
+	return &memoryNonceStore{nonces: newExpiringMap()}
+}
+
+func (s *memoryNonceStore) Use(nonce string, expiry time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.nonces.get(nonce, time.Now()); ok {
+		return ErrReplay
+	}
+	s.nonces.set(nonce, struct{}{}, expiry)
+	return nil
+}
@@ -0,0 +1,126 @@
+package authentication
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+)
+
+func TestNonceStore(t *testing.T) {
+	config := Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}
+	optional := NewJWTAuth(config, WithNonceStore(NewMemoryNonceStore()))
+	required := NewJWTAuth(config, WithNonceStore(NewMemoryNonceStore()), WithRequireNonce())
+
+	exp := time.Now().Add(time.Minute).Unix()
+	once := newJwtToken(TokenSecret, jwt.MapClaims{"uid": "123", "roles": []string{}, "nonce": "n-1", "exp": exp})
+	noNonce := newJwtToken(TokenSecret, jwt.MapClaims{"uid": "123", "roles": []string{}, "exp": exp})
+
+	for _, ja := range []JWTAuth{optional, required} {
+		if _, err := ja.Parse(once); err != nil {
+			t.Fatalf("first use: Parse() error = %v", err)
+		}
+		if _, err := ja.Parse(once); err != ErrReplay {
+			t.Fatalf("replay: Parse() error = %v, want %v", err, ErrReplay)
+		}
+	}
+
+	if _, err := optional.Parse(noNonce); err != nil {
+		t.Fatalf("no nonce: Parse() error = %v", err)
+	}
+	if _, err := required.Parse(noNonce); err != ErrMissingNonce {
+		t.Fatalf("no nonce: Parse() error = %v, want %v", err, ErrMissingNonce)
+	}
+}
+
+func TestNonceUsedByAuthenticate(t *testing.T) {
+	config := Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}
+	ja := NewJWTAuth(config, WithNonceStore(NewMemoryNonceStore()),
+		WithAudienceFunc(func(r *http.Request) []string {
+			return []string{strings.TrimPrefix(r.URL.Path, "/")}
+		}))
+	welcome := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})
+
+	r := chi.NewRouter()
+	r.Use(ja.Verify())
+	r.With(ja.Verify(), ja.Authenticate).Get("/nested", welcome)
+	r.With(ja.Authenticate, ja.Verify(), ja.ForceAuthenticate).Get("/forced", welcome)
+	r.With(ja.Authenticate).Get("/other", welcome)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	exp := time.Now().Add(time.Minute).Unix()
+	token := func(nonce, aud string) http.Header {
+		return newAuthHeader(jwt.MapClaims{"uid": "123", "roles": []string{}, "nonce": nonce, "aud": aud, "exp": exp})
+	}
+
+	// Verifying the token repeatedly along the chain uses up its nonce once
+	for _, path := range []string{"/nested", "/forced"} {
+		h := token("n-"+path, path[1:])
+		if status, _ := testRequest(t, ts, "GET", path, h, nil); status != 200 {
+			t.Fatalf("%s: first use: status = %d, want 200", path, status)
+		}
+		if status, _ := testRequest(t, ts, "GET", path, h, nil); status != 401 {
+			t.Fatalf("%s: replay: status = %d, want 401", path, status)
+		}
+	}
+
+	// A token rejected for its audience keeps its nonce
+	if status, _ := testRequest(t, ts, "GET", "/nested", token("n-2", "other"), nil); status != 401 {
+		t.Fatalf("wrong audience: status = %d, want 401", status)
+	}
+	if status, _ := testRequest(t, ts, "GET", "/other", token("n-2", "other"), nil); status != 200 {
+		t.Fatalf("after a rejected request: status = %d, want 200", status)
+	}
+}
+
+func TestNonceUsedByOptional(t *testing.T) {
+	config := Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}
+	ja := NewJWTAuth(config, WithNonceStore(NewMemoryNonceStore()))
+	welcome := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})
+
+	r := chi.NewRouter()
+	r.Use(ja.Verify())
+	r.With(ja.Optional, ja.RequiresRole("ADMIN")).Get("/role", welcome)
+	r.With(ja.Optional, ja.RequiresScope("read")).Get("/scope", welcome)
+	r.With(ja.RequiresRole("ADMIN"), ja.RequiresScope("read")).Get("/stacked", welcome)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	exp := time.Now().Add(time.Minute).Unix()
+	for _, path := range []string{"/role", "/scope", "/stacked"} {
+		h := newAuthHeader(jwt.MapClaims{"uid": "123", "roles": []string{"ADMIN"}, "scope": "read", "nonce": "n-" + path, "exp": exp})
+		if status, _ := testRequest(t, ts, "GET", path, h, nil); status != 200 {
+			t.Fatalf("%s: first use: status = %d, want 200", path, status)
+		}
+		// Optional passes the replay on as anonymous and the role or scope check
+		// rejects it
+		if status, _ := testRequest(t, ts, "GET", path, h, nil); status != 401 {
+			t.Fatalf("%s: replay: status = %d, want 401", path, status)
+		}
+	}
+}
+
+func TestMemoryNonceStore(t *testing.T) {
+	store := NewMemoryNonceStore()
+	if err := store.Use("expired", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Use("expired", time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("nonce of an expired token: Use() error = %v", err)
+	}
+	if err := store.Use("forever", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Use("forever", time.Time{}); err != ErrReplay {
+		t.Fatalf("Use() error = %v, want %v", err, ErrReplay)
+	}
+}
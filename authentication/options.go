@@ -0,0 +1,411 @@
+package authentication
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// Option configures the optional behaviour of a JWTAuth authenticator.
+type Option func(ja *jwtAuth)
+
+// WithSigningMethod sets the signing method, instead of the built-in method named by
+// JwtAuthAlgo, e.g. a custom method backed by a HSM. Tokens verify only if the method
+// is registered with jwt.RegisterSigningMethod under its Alg name too, and the keys
+// are passed to its Sign and Verify methods as configured.
+func WithSigningMethod(method jwt.SigningMethod) Option {
+	return func(ja *jwtAuth) {
+		ja.signer = method
+		ja.algorithm = method.Alg()
+	}
+}
+
+// WithCookieName sets the name of the cookie holding the token, "jwt" by default.
+func WithCookieName(name string) Option {
+	return func(ja *jwtAuth) {
+		ja.cookieName = name
+	}
+}
+
+// WithCookieSignature enables the integrity check of token cookies. The token cookie
+// has to be accompanied by a "<cookiename>.sig" cookie holding the HMAC-SHA256 of its
+// value, as written by SetTokenCookie, otherwise the token is rejected before decoding.
+func WithCookieSignature(secret []byte) Option {
+	return func(ja *jwtAuth) {
+		ja.cookieSecret = secret
+	}
+}
+
+// WithFingerprint binds tokens to a client fingerprint. Tokens carrying a "fp" claim
+// are only accepted by Authenticate when compute returns the same fingerprint for the
+// request, otherwise a 403 Forbidden response is sent. Tokens without a "fp" claim
+// are not bound and pass as before.
+func WithFingerprint(compute func(r *http.Request) string) Option {
+	return func(ja *jwtAuth) {
+		ja.fingerprint = compute
+	}
+}
+
+// WithIPBinding binds tokens to the client IP address they were issued to. Tokens
+// carrying a "cip" claim are only accepted by Authenticate when extractIP returns the
+// same address for the request, otherwise ErrIPMismatch is returned, a 403 Forbidden
+// response by default. Tokens without the claim are not bound, so the issuer opts in
+// per token. Client addresses change on mobile networks and behind rotating NATs,
+// failing the bound sessions of their users, so bind short-lived sensitive sessions
+// only. Behind a proxy, extractIP must read the address the proxy forwards.
+func WithIPBinding(extractIP func(r *http.Request) string) Option {
+	return func(ja *jwtAuth) {
+		ja.extractIP = extractIP
+	}
+}
+
+// WithCSRFProtection enables the double-submit CSRF defense for tokens sent in a
+// cookie. Authenticate then requires unsafe requests (anything but GET, HEAD, OPTIONS
+// and TRACE) to carry a X-CSRF-Token header matching the value of the named cookie,
+// and sends a 403 Forbidden response otherwise. Tokens found in the query or the
+// Authorization header are exempt.
+func WithCSRFProtection(cookieName string) Option {
+	return func(ja *jwtAuth) {
+		ja.csrfCookieName = cookieName
+	}
+}
+
+// BaggageFunc returns a copy of ctx with members added to its trace baggage.
+type BaggageFunc func(ctx context.Context, members map[string]string) context.Context
+
+// WithBaggage propagates the named claims of authenticated requests downstream by
+// adding them to the trace baggage of the request context, e.g. "sub" and
+// "tenant_id". Only the listed claims are propagated, so keep sensitive claims out
+// of the list. The package has no tracing dependency, set adds the members to the
+// baggage of your tracing library. With OpenTelemetry:
+//
+//	set := func(ctx context.Context, members map[string]string) context.Context {
+//		b := baggage.FromContext(ctx)
+//		for k, v := range members {
+//			if m, err := baggage.NewMember(k, url.QueryEscape(v)); err == nil {
+//				b, _ = b.SetMember(m)
+//			}
+//		}
+//		return baggage.ContextWithBaggage(ctx, b)
+//	}
+//	auth := authentication.NewJWTAuth(config, authentication.WithBaggage(set, "sub", "tenant_id"))
+func WithBaggage(set BaggageFunc, claims ...string) Option {
+	return func(ja *jwtAuth) {
+		ja.baggage = set
+		ja.baggageClaims = claims
+	}
+}
+
+// WithExpiryGrace accepts tokens that expired less than d ago, for refreshing ahead
+// of a hard expiry. Verify sets the X-Token-Refresh-Recommended: true header on the
+// response to such requests. Tokens expired longer than d fail with ErrExpired.
+func WithExpiryGrace(d time.Duration) Option {
+	return func(ja *jwtAuth) {
+		ja.expiryGrace = d
+	}
+}
+
+// WithIssuer validates the "iss" claim against the accepted issuers. Tokens issued
+// by others fail with ErrIssuerInvalid.
+func WithIssuer(iss ...string) Option {
+	return func(ja *jwtAuth) {
+		ja.issuers = iss
+	}
+}
+
+// WithClaimsRoot parses the AppClaims from the object at path, e.g. "attributes", or
+// "a.b" for nested objects, for bridges nesting the user attributes such as "uid",
+// "sub" and "roles". Its members replace those at the top level, except for the
+// registered "exp", "nbf", "iat", "iss", "aud" and "jti" claims the token is validated
+// against, which are always read from the top level. The subject and roles checks,
+// e.g. WithSubjectValidator, RequiresSubjectMatch and WithTokenVersion, read the
+// nested members as well. Tokens without the object are parsed from the top level.
+func WithClaimsRoot(path string) Option {
+	return func(ja *jwtAuth) {
+		ja.claimsRoot = path
+	}
+}
+
+// WithIssuedAtClaim reads the issue time of tokens from the named claim rather than
+// "iat", for issuers using a custom one: a time string in layout, e.g. time.RFC3339
+// for a "created_at" claim, or seconds since the epoch if layout is empty. It feeds
+// the IssuedAt of AppClaims and the checks on the issue time, which reject tokens
+// issued in the future with ErrIATInvalid.
+func WithIssuedAtClaim(name, layout string) Option {
+	return func(ja *jwtAuth) {
+		ja.issuedAtClaim = name
+		ja.issuedAtLayout = layout
+	}
+}
+
+// WithSubjectValidator rejects tokens whose "sub" claim, empty if absent, fails
+// validate with ErrInvalidSubject, e.g. ValidateUUID for issuers using UUIDs.
+func WithSubjectValidator(validate func(sub string) error) Option {
+	return func(ja *jwtAuth) {
+		ja.subjectValidator = validate
+	}
+}
+
+// WithLeeway tolerates clock skew of up to d between the issuer and this service
+// when validating the "exp", "iat" and "nbf" claims.
+func WithLeeway(d time.Duration) Option {
+	return func(ja *jwtAuth) {
+		ja.leeway = d
+	}
+}
+
+// KeyFuncCtx resolves the key verifying a token from the context of the request
+// it was sent with and the "kid" header of the token, empty if it has none.
+type KeyFuncCtx func(ctx context.Context, kid string) (interface{}, error)
+
+// WithKeyFuncCtx resolves the verify key per request, e.g. to verify the tokens of
+// each tenant with the tenant's own key, instead of using the configured one. Tokens
+// the key isn't resolved for fail verification with the returned error; return
+// ErrKeyUnavailable to report the failure as a system error.
+func WithKeyFuncCtx(f KeyFuncCtx) Option {
+	return func(ja *jwtAuth) {
+		ja.keyFuncCtx = f
+	}
+}
+
+// IssuerKeyFunc resolves the key verifying a token from the context of the request
+// it was sent with, the unverified "iss" claim and the "kid" header of the token,
+// either empty if the token has none.
+type IssuerKeyFunc func(ctx context.Context, iss, kid string) (interface{}, error)
+
+// WithIssuerKeyFunc resolves the verify key per issuer, for federations whose issuers
+// use overlapping key ids: f selects the key set of the issuer before looking up the
+// key id in it, so a token only verifies with a key of the issuer it names. Tokens of
+// unknown issuers should fail with ErrIssuerInvalid; return ErrKeyUnavailable to
+// report a failure as a system error.
+func WithIssuerKeyFunc(f IssuerKeyFunc) Option {
+	return func(ja *jwtAuth) {
+		ja.issuerKeyFunc = f
+	}
+}
+
+// WithRequireExpiry rejects tokens without an "exp" claim, which never expire, with
+// ErrMissingExpiry.
+func WithRequireExpiry() Option {
+	return func(ja *jwtAuth) {
+		ja.requireExpiry = true
+	}
+}
+
+// WithRelativeExpiry accepts tokens of issuers sending their lifetime in seconds in
+// claim, e.g. "expires_in", instead of an "exp" claim: tokens without "exp" expire at
+// their issue time plus claim, which is set as their "exp" claim. "exp" takes
+// precedence when present.
+func WithRelativeExpiry(claim string) Option {
+	return func(ja *jwtAuth) {
+		ja.relativeExpiryClaim = claim
+	}
+}
+
+// WithMaxTokenLifetime rejects tokens valid for longer than d, from their "iat" claim
+// or from now if they have none to their "exp" claim, with ErrTokenLifetimeExceeded.
+// Tokens without an "exp" claim exceed any lifetime.
+func WithMaxTokenLifetime(d time.Duration) Option {
+	return func(ja *jwtAuth) {
+		ja.maxLifetime = d
+	}
+}
+
+// WithMaxFutureSkew rejects tokens with an "iat" or "nbf" claim more than d ahead of
+// the local clock with ErrIATInvalid, hinting at a broken clock or a forgery, even
+// when the leeway set with WithLeeway would tolerate them.
+func WithMaxFutureSkew(d time.Duration) Option {
+	return func(ja *jwtAuth) {
+		ja.maxFutureSkew = d
+	}
+}
+
+// WithRequiredTyp accepts only tokens whose "typ" header is one of typs, e.g. "at+jwt"
+// for RFC 9068 access tokens or "JWT". Other tokens, and tokens without the header,
+// fail with ErrTypInvalid.
+func WithRequiredTyp(typs ...string) Option {
+	return func(ja *jwtAuth) {
+		ja.typs = typs
+	}
+}
+
+// WithAudience validates the "aud" claim, a single string or an array, against the
+// accepted audiences. Tokens not matching them fail with ErrAudienceInvalid.
+func WithAudience(aud ...string) Option {
+	return func(ja *jwtAuth) {
+		ja.audience = aud
+	}
+}
+
+// WithServiceName accepts only tokens whose "aud" claim includes name, the canonical
+// name of the service, failing others with ErrAudienceInvalid. It is shorthand for
+// WithAudience(name) and replaces the audiences set before.
+func WithServiceName(name string) Option {
+	return WithAudience(name)
+}
+
+// WithAudienceMatchMode sets how the accepted audiences are matched, AudienceMatchAny
+// by default. With AudienceMatchAll the "aud" claim has to contain every accepted
+// audience.
+func WithAudienceMatchMode(mode AudienceMatchMode) Option {
+	return func(ja *jwtAuth) {
+		ja.audienceMode = mode
+	}
+}
+
+// WithAudienceFunc validates the "aud" claim against the audiences accept computes
+// for each request, e.g. from its Host header, so that a single authenticator can
+// front many virtual hosts. Tokens not matching the accepted audiences fail with
+// ErrAudienceInvalid, as do all tokens when accept returns no audience.
+func WithAudienceFunc(accept func(r *http.Request) []string) Option {
+	return func(ja *jwtAuth) {
+		ja.audienceFunc = accept
+	}
+}
+
+// WithTokenSources sets the sources Verify searches for a token, in the given order,
+// from TokenSourceQuery, TokenSourceHeader and TokenSourceCookie. All three are
+// searched by default.
+func WithTokenSources(sources ...string) Option {
+	return func(ja *jwtAuth) {
+		ja.tokenSources = sources
+	}
+}
+
+// WithTrustedMeshPayload accepts the token payload a service mesh verified at the
+// edge and forwards in the X-Jwt-Payload header, base64url encoded, without verifying
+// a signature locally. The time, issuer, audience and lifetime checks still apply.
+// Enable it together with the TokenSourceMeshPayload source, and only behind a mesh
+// that strips the header from client requests: anyone able to set it can forge claims.
+func WithTrustedMeshPayload() Option {
+	return func(ja *jwtAuth) {
+		ja.trustMeshPayload = true
+	}
+}
+
+// WithStrictSources rejects requests carrying a token in a source that is not
+// searched with ErrTokenInDisallowedSource, instead of silently ignoring it.
+func WithStrictSources() Option {
+	return func(ja *jwtAuth) {
+		ja.strictSources = true
+	}
+}
+
+// WithNativeHMAC verifies HS256, HS384 and HS512 tokens with the standard library
+// instead of jwt-go. Tokens are accepted and rejected exactly as before.
+func WithNativeHMAC() Option {
+	return func(ja *jwtAuth) {
+		ja.nativeHMAC = true
+	}
+}
+
+// WithTokenUseClaim sets the claim RequiresTokenUse reads the token use from,
+// "token_use" by default.
+func WithTokenUseClaim(name string) Option {
+	return func(ja *jwtAuth) {
+		ja.tokenUseClaim = name
+	}
+}
+
+// WithFeaturesClaim sets the claim RequiresFeature reads the enabled features from,
+// "features" by default.
+func WithFeaturesClaim(name string) Option {
+	return func(ja *jwtAuth) {
+		ja.featuresClaim = name
+	}
+}
+
+// WithLazyClaims defers parsing the AppClaims in Authenticate to their first access
+// with AppClaimsFromCtx, Authorize or RequiresRole, saving the work on routes only
+// needing a valid token. Authenticate then accepts tokens whose claims don't parse,
+// which read as empty AppClaims, and the AccessClaimsCtxKey context value is no
+// longer of type AppClaims: read it with AppClaimsFromCtx only.
+func WithLazyClaims() Option {
+	return func(ja *jwtAuth) {
+		ja.lazyClaims = true
+	}
+}
+
+// WithLenientBase64 accepts tokens whose segments carry base64 padding, as sent by
+// some legacy issuers, by stripping the padding before the token is verified. The
+// signature must then be over the unpadded segments, as RFC 7515 requires.
+func WithLenientBase64() Option {
+	return func(ja *jwtAuth) {
+		ja.lenientBase64 = true
+	}
+}
+
+// WithCaseInsensitiveRoles makes RequiresRole match roles regardless of case, for
+// issuers that send e.g. "Admin" for the ADMIN role. Roles match exactly by default.
+func WithCaseInsensitiveRoles() Option {
+	return func(ja *jwtAuth) {
+		ja.caseInsensitiveRoles = true
+	}
+}
+
+// WithRoleScopeMap declares the scopes each role implies, for federations where some
+// issuers grant roles and others scopes. RequiresScope and RequiresScopes then accept
+// tokens with a role implying the scope, and RequiresRole tokens granted every scope
+// the role implies.
+func WithRoleScopeMap(m map[Role][]string) Option {
+	return func(ja *jwtAuth) {
+		ja.roleScopes = m
+	}
+}
+
+// WithRolesDelimiter sets the delimiter a roles claim sent as a single string, e.g.
+// "admin,editor", is split on. It defaults to a comma.
+func WithRolesDelimiter(delimiter string) Option {
+	return func(ja *jwtAuth) {
+		ja.rolesDelimiter = delimiter
+	}
+}
+
+// WithMaxRoles rejects tokens granting more than n roles with ErrClaimsTooLarge, as a
+// guard against hostile issuers in federated setups. Zero, the default, disables it.
+func WithMaxRoles(n int) Option {
+	return func(ja *jwtAuth) {
+		ja.maxRoles = n
+	}
+}
+
+// WithMaxClaimsSize rejects tokens whose decoded claims exceed size bytes with
+// ErrClaimsTooLarge, before the claims are parsed or the signature verified. Zero,
+// the default, disables it.
+func WithMaxClaimsSize(size int) Option {
+	return func(ja *jwtAuth) {
+		ja.maxClaimsSize = size
+	}
+}
+
+// defaultMaxBodySize is the size limit of buffered request bodies, see WithMaxBodySize.
+const defaultMaxBodySize = 1 << 20
+
+// WithMaxBodySize sets the size limit, 1 MiB by default, of the request bodies the
+// middlewares buffer, for RequiresSubjectMatch and WithBodyHashBinding. Larger bodies
+// are rejected with ErrBodyTooLarge and a 413 Request Entity Too Large response.
+func WithMaxBodySize(size int64) Option {
+	return func(ja *jwtAuth) {
+		ja.maxBodySize = size
+	}
+}
+
+// WithRegionFunc derives the region RequiresRegion expects from the request, e.g. from
+// its host, for multi-region deployments of a single binary. Requests it returns no
+// region for expect the region given to RequiresRegion.
+func WithRegionFunc(region func(r *http.Request) string) Option {
+	return func(ja *jwtAuth) {
+		ja.regionFunc = region
+	}
+}
+
+// WithErrorHandler sets the handler writing the response for requests rejected by
+// the Authenticate and Optional middlewares. The handler receives the library error
+// the request failed with, e.g. ErrExpired or ErrNBFInvalid.
+func WithErrorHandler(h ErrorHandler) Option {
+	return func(ja *jwtAuth) {
+		ja.errorHandler = h
+	}
+}
@@ -0,0 +1,37 @@
+package authentication
+
+import (
+	"context"
+	"fmt"
+)
+
+// PostAuthHook enriches the context of a request Authenticate accepted with claims,
+// e.g. with a logger or the tenant of the user, see WithPostAuth.
+type PostAuthHook func(ctx context.Context, claims AppClaims) (context.Context, error)
+
+// WithPostAuth runs hooks, in order, on requests Authenticate or Optional accepted,
+// each passed the context returned by the previous one, which the next handler is
+// served with. A hook returning an error aborts the request with an error wrapping
+// ErrForbidden, a 403 Forbidden response by default. Setting the option again appends
+// to the hooks. With WithLazyClaims the claims are parsed before the first hook runs.
+func WithPostAuth(hooks ...PostAuthHook) Option {
+	return func(ja *jwtAuth) {
+		ja.postAuthHooks = append(ja.postAuthHooks, hooks...)
+	}
+}
+
+// postAuth runs the post authentication hooks on the context of an authenticated request.
+func (ja *jwtAuth) postAuth(ctx context.Context) (context.Context, error) {
+	if len(ja.postAuthHooks) == 0 {
+		return ctx, nil
+	}
+	claims := AppClaimsFromCtx(ctx)
+	for _, hook := range ja.postAuthHooks {
+		next, err := hook(ctx, claims)
+		if err != nil {
+			return ctx, fmt.Errorf("%w: %v", ErrForbidden, err)
+		}
+		ctx = next
+	}
+	return ctx, nil
+}
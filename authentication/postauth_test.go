@@ -0,0 +1,70 @@
+package authentication
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+)
+
+type postAuthKey struct{}
+
+func TestPostAuth(t *testing.T) {
+	tag := func(name string) PostAuthHook {
+		return func(ctx context.Context, claims AppClaims) (context.Context, error) {
+			prev, _ := ctx.Value(postAuthKey{}).(string)
+			return context.WithValue(ctx, postAuthKey{}, prev+name+":"+claims.UserID+" "), nil
+		}
+	}
+	banned := func(ctx context.Context, claims AppClaims) (context.Context, error) {
+		if claims.UserID == "banned" {
+			return ctx, errors.New("user is banned")
+		}
+		return ctx, nil
+	}
+
+	config := Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}
+	ja := NewJWTAuth(config, WithPostAuth(tag("first"), banned), WithPostAuth(tag("second")))
+	lazy := NewJWTAuth(config, WithLazyClaims(), WithPostAuth(tag("lazy")))
+	enriched := func(w http.ResponseWriter, r *http.Request) {
+		v, _ := r.Context().Value(postAuthKey{}).(string)
+		w.Write([]byte(v))
+	}
+
+	r := chi.NewRouter()
+	r.With(ja.Verify(), ja.Authenticate).Get("/", enriched)
+	r.With(ja.Verify(), ja.Optional).Get("/optional", enriched)
+	r.With(lazy.Verify(), lazy.Authenticate).Get("/lazy", enriched)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	user := func(uid string) http.Header {
+		return newAuthHeader(jwt.MapClaims{"uid": uid, "roles": []string{}})
+	}
+	tests := []struct {
+		name   string
+		path   string
+		header http.Header
+		status int
+		body   string
+	}{
+		{"hooks in order", "/", user("123"), 200, "first:123 second:123 "},
+		{"hook error", "/", user("banned"), 403, "Forbidden\n"},
+		{"optional", "/optional", user("123"), 200, "first:123 second:123 "},
+		{"optional anonymous", "/optional", nil, 200, ""},
+		{"optional hook error", "/optional", user("banned"), 403, "Forbidden\n"},
+		{"lazy claims", "/lazy", user("123"), 200, "lazy:123 "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, body := testRequest(t, ts, "GET", tt.path, tt.header, nil); status != tt.status || body != tt.body {
+				t.Fatalf("got %d %q, want %d %q", status, body, tt.status, tt.body)
+			}
+		})
+	}
+}
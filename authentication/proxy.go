@@ -0,0 +1,62 @@
+package authentication
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// forwardedHeaders are the request headers only a trusted proxy may set, see
+// WithTrustedProxies.
+var forwardedHeaders = []string{ForwardedAccessTokenHeader, MeshPayloadHeader}
+
+// WithTrustedProxies honours the headers set by a proxy or service mesh, the
+// X-Forwarded-Access-Token and X-Jwt-Payload token sources, only for requests whose
+// RemoteAddr is in one of the cidrs, e.g. "10.0.0.0/8". Requests from other addresses
+// carrying any of these headers are rejected with ErrUntrustedProxy, whatever source
+// their token is found in. It returns an error for malformed cidrs.
+func WithTrustedProxies(cidrs []string) (Option, error) {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("authentication: trusted proxy: %w", err)
+		}
+		nets[i] = ipNet
+	}
+	return func(ja *jwtAuth) {
+		ja.trustedProxies = nets
+	}, nil
+}
+
+// checkProxy rejects requests carrying forwarded headers that don't come from a
+// trusted proxy.
+func (ja *jwtAuth) checkProxy(r *http.Request) error {
+	if ja.trustedProxies == nil {
+		return nil
+	}
+	for _, h := range forwardedHeaders {
+		if r.Header.Get(h) != "" && !ja.fromTrustedProxy(r) {
+			return ErrUntrustedProxy
+		}
+	}
+	return nil
+}
+
+// fromTrustedProxy reports whether the request was sent by a trusted proxy.
+func (ja *jwtAuth) fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range ja.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
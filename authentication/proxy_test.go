@@ -0,0 +1,63 @@
+package authentication
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	proxies, err := WithTrustedProxies([]string{"10.0.0.0/8", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+	}, proxies, WithTokenSources(TokenSourceForwardedAccessToken, TokenSourceHeader))
+
+	h := TokenAuthHS256.Verify()(TokenAuthHS256.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})))
+
+	tokenString := newJwtToken(TokenSecret, jwt.MapClaims{"uid": "123", "roles": []string{}})
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		status     int
+	}{
+		{"forwarded token from trusted proxy", "10.1.2.3:4711", ForwardedAccessTokenHeader, 200},
+		{"forwarded token from trusted ipv6 proxy", "[fd00::1]:4711", ForwardedAccessTokenHeader, 200},
+		{"forwarded token from client", "203.0.113.7:4711", ForwardedAccessTokenHeader, 403},
+		{"spoofed payload header from client", "203.0.113.7:4711", MeshPayloadHeader, 403},
+		{"bearer token from client", "203.0.113.7:4711", "", 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			switch tt.header {
+			case "":
+				req.Header.Set("Authorization", "BEARER "+tokenString)
+			case MeshPayloadHeader:
+				req.Header.Set("Authorization", "BEARER "+tokenString)
+				req.Header.Set(MeshPayloadHeader, "e30")
+			default:
+				req.Header.Set(tt.header, tokenString)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("got %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+
+	if _, err := WithTrustedProxies([]string{"10.0.0.0"}); err == nil {
+		t.Fatal("WithTrustedProxies() accepted an address without prefix length")
+	}
+}
@@ -0,0 +1,26 @@
+package authentication
+
+// Reconfigure replaces the configuration the authenticator verifies and creates tokens
+// with, e.g. to apply the issuers, audiences or leeway pushed by a config watcher
+// without a restart. The options the authenticator was created with apply again on top
+// of config, and the result must pass Validate: otherwise the current configuration
+// is kept and the error returned. Requests in flight finish with the configuration
+// they started with. It is safe to call while serving requests.
+func (ja *jwtAuth) Reconfigure(config Config) error {
+	next := newJWTAuth(config, ja.opts...)
+	if err := next.Validate(); err != nil {
+		return err
+	}
+	ja.live.Store(next)
+	return nil
+}
+
+// current returns the authenticator of the configuration set last by Reconfigure, or
+// ja itself if it hasn't been reconfigured. Middlewares call it once per request, so
+// that the request is served with a single configuration throughout.
+func (ja *jwtAuth) current() *jwtAuth {
+	if next, ok := ja.live.Load().(*jwtAuth); ok {
+		return next
+	}
+	return ja
+}
@@ -0,0 +1,75 @@
+package authentication
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestReconfigure(t *testing.T) {
+	config := Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret, Issuers: []string{"https://a.example"}}
+	ja := NewJWTAuth(config)
+	h := ja.Verify()(ja.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})))
+	tokenA := newJwtToken(TokenSecret, jwt.MapClaims{"uid": "123", "roles": []string{}, "iss": "https://a.example"})
+	tokenB := newJwtToken(TokenSecret, jwt.MapClaims{"uid": "123", "roles": []string{}, "iss": "https://b.example"})
+
+	if _, err := ja.Parse(tokenB); err != ErrIssuerInvalid {
+		t.Fatalf("Parse() error = %v, want %v", err, ErrIssuerInvalid)
+	}
+	reconfigured := config
+	reconfigured.Issuers = []string{"https://b.example"}
+	if err := ja.Reconfigure(reconfigured); err != nil {
+		t.Fatalf("Reconfigure() error = %v", err)
+	}
+	if _, err := ja.Parse(tokenB); err != nil {
+		t.Fatalf("Parse() error = %v after reconfiguring", err)
+	}
+	if _, err := ja.Parse(tokenA); err != ErrIssuerInvalid {
+		t.Fatalf("Parse() error = %v, want %v after reconfiguring", err, ErrIssuerInvalid)
+	}
+
+	// An invalid configuration is rejected and the current one kept
+	invalid := reconfigured
+	invalid.JwtAuthAlgo = "HS999"
+	if err := ja.Reconfigure(invalid); err == nil {
+		t.Fatal("Reconfigure() accepted an invalid configuration")
+	}
+	if _, err := ja.Parse(tokenB); err != nil {
+		t.Fatalf("Parse() error = %v after an invalid reconfiguration", err)
+	}
+
+	// Requests are served with either configuration while it changes
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				for _, token := range []string{tokenA, tokenB} {
+					req := httptest.NewRequest("GET", "/", nil)
+					req.Header.Set("Authorization", "BEARER "+token)
+					rec := httptest.NewRecorder()
+					h.ServeHTTP(rec, req)
+					if rec.Code != 200 && rec.Code != 401 {
+						t.Errorf("got %d, want 200 or 401", rec.Code)
+					}
+				}
+			}
+		}()
+	}
+	for j := 0; j < 200; j++ {
+		next := config
+		if j%2 == 0 {
+			next = reconfigured
+		}
+		if err := ja.Reconfigure(next); err != nil {
+			t.Fatalf("Reconfigure() error = %v", err)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,90 @@
+package authentication
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RoleResolver returns the current roles of the subject sub from the authoritative
+// source, see WithRoleResolver.
+type RoleResolver func(ctx context.Context, sub string) ([]Role, error)
+
+// WithRoleResolver makes RequiresRole check the roles resolve returns, rather than
+// those of the token, for tokens issued more than maxAge ago, so that revoked roles
+// stop granting access before long-lived tokens expire. RequiresScope and
+// RequiresScopes likewise only accept the scopes implied by the resolved roles, see
+// WithRoleScopeMap. Tokens without an issue time count as stale. Resolved roles are
+// cached per subject for maxAge, and a failing resolve denies the request with
+// ErrRolesUnavailable.
+func WithRoleResolver(resolve RoleResolver, maxAge time.Duration) Option {
+	return func(ja *jwtAuth) {
+		ja.roleResolver = &roleCache{resolve: resolve, maxAge: maxAge, roles: map[string]resolvedRoles{}}
+	}
+}
+
+// roleCache caches the roles of the subjects returned by a RoleResolver.
+type roleCache struct {
+	resolve   RoleResolver
+	maxAge    time.Duration
+	mu        sync.Mutex
+	roles     map[string]resolvedRoles
+	lastSweep time.Time
+}
+
+// resolvedRoles are the roles of a subject as resolved at a given time.
+type resolvedRoles struct {
+	roles []Role
+	at    time.Time
+}
+
+// get returns the roles of sub, resolving them unless cached within the maximum age.
+func (rc *roleCache) get(ctx context.Context, sub string) ([]Role, error) {
+	rc.mu.Lock()
+	now := time.Now()
+	if now.Sub(rc.lastSweep) > rc.maxAge {
+		for s, r := range rc.roles {
+			if now.Sub(r.at) > rc.maxAge {
+				delete(rc.roles, s)
+			}
+		}
+		rc.lastSweep = now
+	}
+	r, ok := rc.roles[sub]
+	rc.mu.Unlock()
+	if ok && now.Sub(r.at) <= rc.maxAge {
+		return r.roles, nil
+	}
+
+	roles, err := rc.resolve(ctx, sub)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrRolesUnavailable, err)
+	}
+	rc.mu.Lock()
+	rc.roles[sub] = resolvedRoles{roles: roles, at: now}
+	rc.mu.Unlock()
+	return roles, nil
+}
+
+// currentRoles returns the roles RequiresRole checks for c: those of the token, or
+// with WithRoleResolver those resolved for its subject if the token is stale.
+func (ja *jwtAuth) currentRoles(ctx context.Context, c AppClaims) ([]Role, error) {
+	sub := c.Subject
+	if sub == "" {
+		sub = c.UserID
+	}
+	return ja.resolveRoles(ctx, sub, c.IssuedAt, c.Roles)
+}
+
+// resolveRoles returns roles, the roles of a token of sub issued at iat, or with
+// WithRoleResolver those resolved for sub if the token is stale.
+func (ja *jwtAuth) resolveRoles(ctx context.Context, sub string, iat int64, roles []Role) ([]Role, error) {
+	if ja.roleResolver == nil {
+		return roles, nil
+	}
+	if iat != 0 && time.Since(time.Unix(iat, 0)) <= ja.roleResolver.maxAge {
+		return roles, nil
+	}
+	return ja.roleResolver.get(ctx, sub)
+}
@@ -0,0 +1,116 @@
+package authentication
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+)
+
+func TestRoleResolver(t *testing.T) {
+	var calls int32
+	current := map[string][]Role{"alice": {"ADMIN"}, "bob": {}}
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret},
+		WithRoleResolver(func(ctx context.Context, sub string) ([]Role, error) {
+			atomic.AddInt32(&calls, 1)
+			if sub == "broken" {
+				return nil, errors.New("directory down")
+			}
+			return current[sub], nil
+		}, time.Hour))
+	welcome := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	}
+
+	r := chi.NewRouter()
+	r.With(ja.Verify(), ja.Authenticate, ja.RequiresRole("ADMIN")).Get("/admin", welcome)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	stale := time.Now().Add(-2 * time.Hour).Unix()
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		status int
+		calls  int32
+	}{
+		{"fresh token", jwt.MapClaims{"uid": "bob", "roles": []string{"ADMIN"}, "iat": time.Now().Unix()}, 200, 0},
+		{"cache miss", jwt.MapClaims{"uid": "alice", "roles": []string{}, "iat": stale}, 200, 1},
+		{"cache hit", jwt.MapClaims{"uid": "alice", "roles": []string{}, "iat": stale}, 200, 1},
+		{"revoked role", jwt.MapClaims{"uid": "bob", "roles": []string{"ADMIN"}, "iat": stale}, 401, 2},
+		{"no issue time", jwt.MapClaims{"uid": "bob", "roles": []string{"ADMIN"}}, 401, 2},
+		{"resolver failure", jwt.MapClaims{"uid": "broken", "roles": []string{"ADMIN"}, "iat": stale}, 503, 3},
+	}
+	for _, tt := range tests {
+		if status, _ := testRequest(t, ts, "GET", "/admin", newAuthHeader(tt.claims), nil); status != tt.status {
+			t.Errorf("%s: GET /admin = %d, want %d", tt.name, status, tt.status)
+		}
+		if got := atomic.LoadInt32(&calls); got != tt.calls {
+			t.Errorf("%s: %d resolver calls, want %d", tt.name, got, tt.calls)
+		}
+	}
+
+	// Cached roles expire after the maximum age
+	cache := ja.(*jwtAuth).roleResolver
+	cache.mu.Lock()
+	cache.roles["alice"] = resolvedRoles{roles: []Role{"ADMIN"}, at: time.Now().Add(-2 * time.Hour)}
+	cache.mu.Unlock()
+	current["alice"] = nil
+	h := newAuthHeader(jwt.MapClaims{"uid": "alice", "roles": []string{"ADMIN"}, "iat": stale})
+	if status, _ := testRequest(t, ts, "GET", "/admin", h, nil); status != 401 {
+		t.Errorf("expired cache: GET /admin = %d, want 401", status)
+	}
+	if got := atomic.LoadInt32(&calls); got != 4 {
+		t.Errorf("expired cache: %d resolver calls, want 4", got)
+	}
+}
+
+func TestRoleResolverScopes(t *testing.T) {
+	current := map[string][]Role{"alice": {"BILLING_ADMIN"}, "bob": {}}
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret},
+		WithRoleScopeMap(map[Role][]string{"BILLING_ADMIN": {"billing:read", "billing:write"}}),
+		WithRoleResolver(func(ctx context.Context, sub string) ([]Role, error) {
+			if sub == "broken" {
+				return nil, errors.New("directory down")
+			}
+			return current[sub], nil
+		}, time.Hour))
+	welcome := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	}
+
+	r := chi.NewRouter()
+	r.Use(ja.Verify())
+	r.With(ja.RequiresScope("billing:write")).Get("/scope", welcome)
+	r.With(ja.RequiresScopes(MatchAll, "billing:read", "billing:write")).Get("/scopes", welcome)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	stale := time.Now().Add(-2 * time.Hour).Unix()
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		status int
+	}{
+		{"fresh token", jwt.MapClaims{"sub": "bob", "roles": []string{"BILLING_ADMIN"}, "iat": time.Now().Unix()}, 200},
+		{"current role", jwt.MapClaims{"sub": "alice", "roles": []string{}, "iat": stale}, 200},
+		{"revoked role", jwt.MapClaims{"sub": "bob", "roles": []string{"BILLING_ADMIN"}, "iat": stale}, 403},
+		{"revoked role, granted scope", jwt.MapClaims{"sub": "bob", "roles": []string{"BILLING_ADMIN"}, "iat": stale, "scope": "billing:read billing:write"}, 200},
+		{"resolver failure", jwt.MapClaims{"sub": "broken", "roles": []string{"BILLING_ADMIN"}, "iat": stale}, 503},
+	}
+	for _, tt := range tests {
+		for _, path := range []string{"/scope", "/scopes"} {
+			if status, _ := testRequest(t, ts, "GET", path, newAuthHeader(tt.claims), nil); status != tt.status {
+				t.Errorf("%s: GET %s = %d, want %d", tt.name, path, status, tt.status)
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package authentication
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestTestRoundTrip(t *testing.T) {
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtExpiry: time.Hour, JwtParser: &jwt.Parser{}, SignKey: TokenSecret})
+	h := ja.Optional(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if claims := AppClaimsFromCtx(r.Context()); claims.UserID != "" {
+			w.Write([]byte("user " + claims.UserID))
+			return
+		}
+		w.Write([]byte("anonymous"))
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "BEARER "+newJwtToken(TokenSecret, jwt.MapClaims{"uid": "other"}))
+	claims := &AppClaims{UserID: "123"}
+	if rec := ja.TestRoundTrip(t, claims, req, h); rec.Code != 200 || rec.Body.String() != "user 123" {
+		t.Fatalf("expected the claims to authenticate, got %d %q", rec.Code, rec.Body.String())
+	}
+	if claims.IssuedAt != 0 || claims.ExpiresAt != 0 {
+		t.Fatalf("expected the claims to be left unmodified, got %+v", claims)
+	}
+	if rec := ja.TestRoundTrip(t, nil, req, h); rec.Code != 200 || rec.Body.String() != "anonymous" {
+		t.Fatalf("expected nil claims to be anonymous, got %d %q", rec.Code, rec.Body.String())
+	}
+	if req.Header.Get("Authorization") == "" {
+		t.Fatalf("expected the request to be left unmodified")
+	}
+}
+
+func TestTestRoundTripChain(t *testing.T) {
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtExpiry: time.Hour, JwtParser: &jwt.Parser{}, SignKey: TokenSecret})
+	admin := ja.Authenticate(ja.RequiresRole("ADMIN")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})))
+
+	tests := []struct {
+		name   string
+		claims *AppClaims
+		want   int
+	}{
+		{"granted role", &AppClaims{UserID: "123", Roles: []Role{"ADMIN"}}, 200},
+		{"missing role", &AppClaims{UserID: "456", Roles: []Role{"USER"}}, 401},
+		{"no token", nil, 401},
+	}
+	req := httptest.NewRequest("GET", "/admin", nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := ja.TestRoundTrip(t, tt.claims, req, admin); rec.Code != tt.want {
+				t.Fatalf("TestRoundTrip() status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
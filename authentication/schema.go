@@ -0,0 +1,331 @@
+package authentication
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonSchema is a compiled JSON Schema. The validation vocabulary relevant to claims is
+// supported: type, enum, const, required, properties, additionalProperties, items,
+// minItems, maxItems, minLength, maxLength, pattern, minimum and maximum, along with
+// the annotations in schemaAnnotations. Schemas using other keywords are rejected,
+// rather than silently accepting the claims those keywords would reject.
+type jsonSchema struct {
+	types                []string
+	enum                 []interface{}
+	constant             interface{}
+	hasConst             bool
+	required             []string
+	properties           map[string]*jsonSchema
+	additionalProperties *jsonSchema
+	noAdditional         bool
+	items                *jsonSchema
+	minItems, maxItems   *int
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+	minimum, maximum     *float64
+}
+
+// WithClaimsSchema validates the claims of every token against the JSON Schema
+// after the signature has been verified. Tokens violating the schema fail with an
+// error wrapping ErrClaimsSchemaViolation that names the failing claim path.
+func WithClaimsSchema(schema []byte) (Option, error) {
+	var doc interface{}
+	if err := json.Unmarshal(schema, &doc); err != nil {
+		return nil, fmt.Errorf("authentication: parsing claims schema: %w", err)
+	}
+	s, err := compileSchema(doc, "")
+	if err != nil {
+		return nil, err
+	}
+	return func(ja *jwtAuth) {
+		ja.claimsSchema = s
+	}, nil
+}
+
+// schemaKeywords are the keywords compileSchema supports.
+var schemaKeywords = map[string]bool{
+	"type": true, "enum": true, "const": true, "required": true, "properties": true,
+	"additionalProperties": true, "items": true, "minItems": true, "maxItems": true,
+	"minLength": true, "maxLength": true, "pattern": true, "minimum": true, "maximum": true,
+}
+
+// schemaAnnotations are the keywords that don't take part in validation.
+var schemaAnnotations = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true,
+	"default": true, "examples": true,
+}
+
+func compileSchema(doc interface{}, path string) (*jsonSchema, error) {
+	if b, ok := doc.(bool); ok {
+		// true accepts everything, false nothing
+		if b {
+			return &jsonSchema{}, nil
+		}
+		return &jsonSchema{noAdditional: true, types: []string{}}, nil
+	}
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, schemaError(path, "schema must be an object")
+	}
+	keywords := make([]string, 0, len(m))
+	for keyword := range m {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+	for _, keyword := range keywords {
+		if !schemaKeywords[keyword] && !schemaAnnotations[keyword] {
+			return nil, schemaError(path, "unsupported keyword "+keyword)
+		}
+	}
+
+	s := &jsonSchema{}
+	var err error
+	if t, ok := m["type"]; ok {
+		switch t := t.(type) {
+		case string:
+			s.types = []string{t}
+		case []interface{}:
+			if s.types, ok = toStringSlice(t); !ok {
+				return nil, schemaError(path, "type must be a string or an array of strings")
+			}
+		default:
+			return nil, schemaError(path, "type must be a string or an array of strings")
+		}
+	}
+	if e, ok := m["enum"]; ok {
+		if s.enum, ok = e.([]interface{}); !ok {
+			return nil, schemaError(path, "enum must be an array")
+		}
+	}
+	if c, ok := m["const"]; ok {
+		s.constant, s.hasConst = c, true
+	}
+	if r, ok := m["required"]; ok {
+		if s.required, ok = toStringSlice(r); !ok {
+			return nil, schemaError(path, "required must be an array of strings")
+		}
+	}
+	if p, ok := m["properties"]; ok {
+		props, ok := p.(map[string]interface{})
+		if !ok {
+			return nil, schemaError(path, "properties must be an object")
+		}
+		s.properties = make(map[string]*jsonSchema, len(props))
+		for name, sub := range props {
+			if s.properties[name], err = compileSchema(sub, path+"/properties/"+name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if a, ok := m["additionalProperties"]; ok {
+		if b, ok := a.(bool); ok {
+			s.noAdditional = !b
+		} else if s.additionalProperties, err = compileSchema(a, path+"/additionalProperties"); err != nil {
+			return nil, err
+		}
+	}
+	if i, ok := m["items"]; ok {
+		if s.items, err = compileSchema(i, path+"/items"); err != nil {
+			return nil, err
+		}
+	}
+	for keyword, dst := range map[string]**int{
+		"minItems":  &s.minItems,
+		"maxItems":  &s.maxItems,
+		"minLength": &s.minLength,
+		"maxLength": &s.maxLength,
+	} {
+		if v, ok := m[keyword]; ok {
+			n, ok := toInt64(v)
+			if !ok || n < 0 {
+				return nil, schemaError(path, keyword+" must be a non-negative integer")
+			}
+			i := int(n)
+			*dst = &i
+		}
+	}
+	for keyword, dst := range map[string]**float64{
+		"minimum": &s.minimum,
+		"maximum": &s.maximum,
+	} {
+		if v, ok := m[keyword]; ok {
+			f, ok := v.(float64)
+			if !ok {
+				return nil, schemaError(path, keyword+" must be a number")
+			}
+			*dst = &f
+		}
+	}
+	if p, ok := m["pattern"]; ok {
+		str, ok := p.(string)
+		if !ok {
+			return nil, schemaError(path, "pattern must be a string")
+		}
+		if s.pattern, err = regexp.Compile(str); err != nil {
+			return nil, schemaError(path, err.Error())
+		}
+	}
+	return s, nil
+}
+
+func schemaError(path, msg string) error {
+	if path == "" {
+		path = "/"
+	}
+	return fmt.Errorf("authentication: invalid claims schema at %s: %s", path, msg)
+}
+
+// validate checks the JSON value v, found at the JSON pointer path, against the schema.
+func (s *jsonSchema) validate(v interface{}, path string) error {
+	if s.types != nil && !s.matchesType(v) {
+		return s.violation(path, "expected type "+strings.Join(s.types, " or "))
+	}
+	if s.enum != nil {
+		found := false
+		for _, e := range s.enum {
+			if jsonEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return s.violation(path, "value is not one of the allowed values")
+		}
+	}
+	if s.hasConst && !jsonEqual(s.constant, v) {
+		return s.violation(path, "value does not match the constant")
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				return s.violation(path+"/"+name, "required claim is missing")
+			}
+		}
+		// in order, so that the reported violation is the same for every request
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			value := v[name]
+			sub, ok := s.properties[name]
+			if !ok {
+				if s.noAdditional {
+					return s.violation(path+"/"+name, "claim is not allowed")
+				}
+				sub = s.additionalProperties
+			}
+			if sub != nil {
+				if err := sub.validate(value, path+"/"+name); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if s.minItems != nil && len(v) < *s.minItems {
+			return s.violation(path, fmt.Sprintf("expected at least %d items", *s.minItems))
+		}
+		if s.maxItems != nil && len(v) > *s.maxItems {
+			return s.violation(path, fmt.Sprintf("expected at most %d items", *s.maxItems))
+		}
+		if s.items != nil {
+			for i, item := range v {
+				if err := s.items.validate(item, path+"/"+strconv.Itoa(i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		n := len([]rune(v))
+		if s.minLength != nil && n < *s.minLength {
+			return s.violation(path, fmt.Sprintf("expected at least %d characters", *s.minLength))
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			return s.violation(path, fmt.Sprintf("expected at most %d characters", *s.maxLength))
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return s.violation(path, "value does not match the pattern "+s.pattern.String())
+		}
+	}
+	if f, ok := jsonNumber(v); ok {
+		if s.minimum != nil && f < *s.minimum {
+			return s.violation(path, fmt.Sprintf("expected a minimum of %v", *s.minimum))
+		}
+		if s.maximum != nil && f > *s.maximum {
+			return s.violation(path, fmt.Sprintf("expected a maximum of %v", *s.maximum))
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) violation(path, msg string) error {
+	if path == "" {
+		path = "/"
+	}
+	return fmt.Errorf("%w at %s: %s", ErrClaimsSchemaViolation, path, msg)
+}
+
+func (s *jsonSchema) matchesType(v interface{}) bool {
+	for _, t := range s.types {
+		switch t {
+		case "object":
+			if _, ok := v.(map[string]interface{}); ok {
+				return true
+			}
+		case "array":
+			if _, ok := v.([]interface{}); ok {
+				return true
+			}
+		case "string":
+			if _, ok := v.(string); ok {
+				return true
+			}
+		case "boolean":
+			if _, ok := v.(bool); ok {
+				return true
+			}
+		case "null":
+			if v == nil {
+				return true
+			}
+		case "number":
+			if _, ok := jsonNumber(v); ok {
+				return true
+			}
+		case "integer":
+			if f, ok := jsonNumber(v); ok && f == math.Trunc(f) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func jsonNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func jsonEqual(a, b interface{}) bool {
+	if fa, ok := jsonNumber(a); ok {
+		fb, ok := jsonNumber(b)
+		return ok && fa == fb
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,90 @@
+package authentication
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const testClaimsSchema = `{
+	"type": "object",
+	"required": ["uid", "roles"],
+	"properties": {
+		"uid": {"type": "string", "minLength": 1},
+		"roles": {
+			"type": "array",
+			"minItems": 1,
+			"items": {"enum": ["USER", "ADMIN"]}
+		},
+		"exp": {"type": "integer"},
+		"tenant_id": {"type": "string", "pattern": "^[a-z]+$"}
+	}
+}`
+
+func TestClaimsSchema(t *testing.T) {
+	schemaOpt, err := WithClaimsSchema([]byte(testClaimsSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ja := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+	}, schemaOpt).(*jwtAuth)
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		path   string
+	}{
+		{"valid claims", jwt.MapClaims{"uid": "123", "roles": []string{"USER"}, "tenant_id": "acme", "extra": 1}, ""},
+		{"missing required claim", jwt.MapClaims{"uid": "123"}, "/roles"},
+		{"wrong type", jwt.MapClaims{"uid": 123, "roles": []string{"USER"}}, "/uid"},
+		{"role not in enum", jwt.MapClaims{"uid": "123", "roles": []string{"USER", "ROOT"}}, "/roles/1"},
+		{"empty roles", jwt.MapClaims{"uid": "123", "roles": []string{}}, "/roles"},
+		{"pattern mismatch", jwt.MapClaims{"uid": "123", "roles": []string{"ADMIN"}, "tenant_id": "ACME"}, "/tenant_id"},
+		{"two violations", jwt.MapClaims{"uid": 123, "roles": []string{"USER"}, "tenant_id": "ACME"}, "/tenant_id"},
+		{"non integer exp", jwt.MapClaims{"uid": "123", "roles": []string{"ADMIN"}, "exp": 1e12 + 0.5}, "/exp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ja.verifyToken(context.Background(), newJwtToken(TokenSecret, tt.claims))
+			if tt.path == "" {
+				if err != nil {
+					t.Fatalf("verifyToken() error = %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrClaimsSchemaViolation) {
+				t.Fatalf("verifyToken() error = %v, want %v", err, ErrClaimsSchemaViolation)
+			}
+			if !strings.Contains(err.Error(), " at "+tt.path+":") {
+				t.Fatalf("verifyToken() error = %v, want path %s", err, tt.path)
+			}
+		})
+	}
+}
+
+func TestClaimsSchemaInvalid(t *testing.T) {
+	for _, schema := range []string{
+		`not json`,
+		`{"type": 1}`,
+		`{"required": "uid"}`,
+		`{"properties": {"uid": {"pattern": "("}}}`,
+		`{"minItems": -1}`,
+		`{"format": "email"}`,
+		`{"properties": {"roles": {"uniqueItems": true}}}`,
+		`{"type": "object", "required": ["uid"], "propertes": {}}`,
+	} {
+		if _, err := WithClaimsSchema([]byte(schema)); err == nil {
+			t.Errorf("WithClaimsSchema(%s) should fail", schema)
+		}
+	}
+	// Annotations don't take part in validation
+	if _, err := WithClaimsSchema([]byte(`{"$schema": "http://json-schema.org/draft-07/schema#", "title": "claims", "type": "object"}`)); err != nil {
+		t.Errorf("WithClaimsSchema() with annotations error = %v", err)
+	}
+}
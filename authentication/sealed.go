@@ -0,0 +1,124 @@
+package authentication
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// minimalClaims are the claims kept in plain on the request context in minimal
+// claims mode, see WithMinimalClaims.
+var minimalClaims = []string{"uid", "sub", "roles", "exp", "iat", "nbf"}
+
+// sealedClaimsCtxKey holds the encrypted claims of the token in minimal claims mode.
+var sealedClaimsCtxKey = &contextKey{"SealedClaims"}
+
+// WithMinimalClaims keeps only the identity of the token on the request context: the
+// token set by Verify carries just the "uid", "sub", "roles" and time claims, and the
+// AppClaims set by Authenticate just the UserID, Subject and Roles. The full claims
+// are stored encrypted with a key generated for the authenticator and decrypted on
+// demand with FullClaims, so that they don't sit in plain in the context of every
+// request, e.g. for other middlewares or a panic dump to expose. The middlewares of
+// this package read the full claims as before.
+func WithMinimalClaims() (Option, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("authentication: generating claims key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return func(ja *jwtAuth) {
+		ja.claimsAEAD = aead
+	}, nil
+}
+
+// FullClaims returns all claims of the token verified by Verify, decrypting them in
+// minimal claims mode, see WithMinimalClaims.
+func (ja *jwtAuth) FullClaims(ctx context.Context) (jwt.MapClaims, error) {
+	ja = ja.current()
+	token, _, err := TokenFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		return nil, ErrNoTokenFound
+	}
+	if sealed, ok := ctx.Value(sealedClaimsCtxKey).([]byte); ok && ja.claimsAEAD != nil {
+		return ja.unsealClaims(sealed)
+	}
+	return token.Claims.(jwt.MapClaims), nil
+}
+
+// tokenFromContext is like TokenFromContext but returns the full claims of the token
+// in minimal claims mode.
+func (ja *jwtAuth) tokenFromContext(ctx context.Context) (*jwt.Token, jwt.MapClaims, error) {
+	token, claims, err := TokenFromContext(ctx)
+	if ja.claimsAEAD == nil {
+		return token, claims, err
+	}
+	sealed, ok := ctx.Value(sealedClaimsCtxKey).([]byte)
+	if !ok {
+		return token, claims, err
+	}
+	if full, uerr := ja.unsealClaims(sealed); uerr == nil {
+		claims = full
+	}
+	return token, claims, err
+}
+
+// sealClaims returns a copy of ctx carrying the encrypted claims of token, and a copy
+// of token carrying only the minimal claims.
+func (ja *jwtAuth) sealClaims(ctx context.Context, token *jwt.Token) (context.Context, *jwt.Token) {
+	claims, _ := token.Claims.(jwt.MapClaims)
+	minimal := jwt.MapClaims{}
+	for _, name := range minimalClaims {
+		if v, ok := claims[name]; ok {
+			minimal[name] = v
+		}
+	}
+
+	if data, err := json.Marshal(claims); err == nil {
+		nonce := make([]byte, ja.claimsAEAD.NonceSize())
+		if _, err := rand.Read(nonce); err == nil {
+			ctx = context.WithValue(ctx, sealedClaimsCtxKey, ja.claimsAEAD.Seal(nonce, nonce, data, nil))
+		}
+	}
+	return ctx, &jwt.Token{
+		Header: token.Header,
+		Method: token.Method,
+		Claims: minimal,
+		Valid:  token.Valid,
+	}
+}
+
+func (ja *jwtAuth) unsealClaims(sealed []byte) (jwt.MapClaims, error) {
+	n := ja.claimsAEAD.NonceSize()
+	if len(sealed) < n {
+		return nil, ErrUnauthorized
+	}
+	data, err := ja.claimsAEAD.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if ja.parser != nil && ja.parser.UseJSONNumber {
+		dec.UseNumber()
+	}
+	claims := jwt.MapClaims{}
+	if err := dec.Decode(&claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
@@ -0,0 +1,149 @@
+package authentication
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// SessionStore records the active sessions of each subject, see WithSessionLimit.
+// Implementations shared by several instances, e.g. backed by Redis, must make
+// Acquire atomic.
+type SessionStore interface {
+	// Acquire records the session jti of subject sub as active until expiry, the
+	// zero time for tokens that don't expire. It returns ErrSessionLimitExceeded if
+	// sub already has limit other active sessions or unless evict is set, in which
+	// case the oldest of them end to make room. Ended sessions are rejected with
+	// ErrSessionLimitExceeded too until they expire.
+	Acquire(sub, jti string, expiry time.Time, limit int, evict bool) error
+}
+
+// WithSessionLimit limits each subject to n concurrent sessions, told apart by the
+// "jti" claim of their tokens. Authenticate rejects the tokens of new sessions over
+// the limit with ErrSessionLimitExceeded, see WithSessionEviction to end the oldest
+// session instead. Sessions end when their token expires. Tokens without a "sub" or
+// "jti" claim are not limited, so pair it with WithClaimsSchema to require them. Other
+// store failures are reported as ErrSessionsUnavailable, a system error.
+func WithSessionLimit(n int, store SessionStore) Option {
+	return func(ja *jwtAuth) {
+		ja.sessionLimit = n
+		ja.sessionStore = store
+	}
+}
+
+// WithSessionEviction makes WithSessionLimit end the oldest session of a subject over
+// the limit rather than reject the new one.
+func WithSessionEviction() Option {
+	return func(ja *jwtAuth) {
+		ja.sessionEviction = true
+	}
+}
+
+// checkSession enforces the session limit of the token subject.
+func (ja *jwtAuth) checkSession(claims jwt.MapClaims) error {
+	if ja.sessionStore == nil || ja.sessionLimit <= 0 {
+		return nil
+	}
+	sub, _ := ja.rootClaims(claims)["sub"].(string)
+	jti, _ := claims["jti"].(string)
+	if sub == "" || jti == "" {
+		return nil
+	}
+	var expiry time.Time
+	if exp, ok := toInt64(claims["exp"]); ok {
+		expiry = time.Unix(exp, 0)
+	}
+	err := ja.sessionStore.Acquire(sub, jti, expiry, ja.sessionLimit, ja.sessionEviction)
+	if err != nil && !errors.Is(err, ErrSessionLimitExceeded) {
+		return fmt.Errorf("%w: %v", ErrSessionsUnavailable, err)
+	}
+	return err
+}
+
+// session is an active or ended session of a memorySessionStore.
+type session struct {
+	jti     string
+	started time.Time
+	expiry  time.Time
+	ended   bool
+}
+
+// memorySessionStore is a SessionStore keeping the sessions in memory until their token expires.
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions *expiringMap
+}
+
+// NewMemorySessionStore returns a SessionStore for a single instance service. The
+// sessions of a subject are kept until their tokens expire, so a session with a token
+// without an expiry holds its place under the limit for the lifetime of the store,
+// unless WithSessionEviction ends it. Each instance of a replicated service limits its
+// own sessions.
+func NewMemorySessionStore() SessionStore {
+	return &memorySessionStore{sessions: newExpiringMap()}
+}
+
+func (s *memorySessionStore) Acquire(sub, jti string, expiry time.Time, limit int, evict bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var active []*session
+	var current *session
+	v, _ := s.sessions.get(sub, now)
+	all, _ := v.([]*session)
+	sessions := all[:0]
+	for _, ss := range all {
+		if expiredAt(ss.expiry, now) {
+			continue
+		}
+		sessions = append(sessions, ss)
+		if ss.jti == jti {
+			current = ss
+		} else if !ss.ended {
+			active = append(active, ss)
+		}
+	}
+	s.setSessions(sub, sessions)
+
+	if current != nil {
+		if current.ended {
+			return ErrSessionLimitExceeded
+		}
+		return nil
+	}
+	if len(active) >= limit {
+		if !evict {
+			return ErrSessionLimitExceeded
+		}
+		sort.Slice(active, func(i, j int) bool { return active[i].started.Before(active[j].started) })
+		for _, ss := range active[:len(active)-limit+1] {
+			ss.ended = true
+		}
+	}
+	s.setSessions(sub, append(sessions, &session{jti: jti, started: now, expiry: expiry}))
+	return nil
+}
+
+// setSessions stores the sessions of sub until the last of them expires.
+func (s *memorySessionStore) setSessions(sub string, sessions []*session) {
+	if len(sessions) == 0 {
+		s.sessions.delete(sub)
+		return
+	}
+	var expiry time.Time
+	for _, ss := range sessions {
+		if ss.expiry.IsZero() {
+			expiry = time.Time{}
+			break
+		}
+		if ss.expiry.After(expiry) {
+			expiry = ss.expiry
+		}
+	}
+	s.sessions.set(sub, sessions, expiry)
+}
@@ -0,0 +1,72 @@
+package authentication
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+)
+
+func TestSessionLimit(t *testing.T) {
+	config := Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}
+	reject := NewJWTAuth(config, WithSessionLimit(2, NewMemorySessionStore()))
+	evict := NewJWTAuth(config, WithSessionLimit(2, NewMemorySessionStore()), WithSessionEviction())
+	welcome := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	}
+
+	r := chi.NewRouter()
+	r.With(reject.Verify(), reject.Authenticate).Get("/reject", welcome)
+	r.With(evict.Verify(), evict.Authenticate).Get("/evict", welcome)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	exp := time.Now().Add(time.Hour).Unix()
+	session := func(sub, jti string) http.Header {
+		return newAuthHeader(jwt.MapClaims{"uid": sub, "roles": []string{}, "sub": sub, "jti": jti, "exp": exp})
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		header http.Header
+		status int
+	}{
+		{"first session", "/reject", session("alice", "a1"), 200},
+		{"second session", "/reject", session("alice", "a2"), 200},
+		{"over the limit", "/reject", session("alice", "a3"), 403},
+		{"active session", "/reject", session("alice", "a1"), 200},
+		{"other subject", "/reject", session("bob", "b1"), 200},
+		{"no jti", "/reject", newAuthHeader(jwt.MapClaims{"uid": "alice", "roles": []string{}, "sub": "alice"}), 200},
+
+		{"evict first session", "/evict", session("alice", "a1"), 200},
+		{"evict second session", "/evict", session("alice", "a2"), 200},
+		{"evicts the oldest", "/evict", session("alice", "a3"), 200},
+		{"evicted session", "/evict", session("alice", "a1"), 403},
+		{"kept session", "/evict", session("alice", "a2"), 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, _ := testRequest(t, ts, "GET", tt.path, tt.header, nil); status != tt.status {
+				t.Fatalf("got %d, want %d", status, tt.status)
+			}
+		})
+	}
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	store := NewMemorySessionStore()
+	if err := store.Acquire("alice", "expired", time.Now().Add(-time.Second), 1, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Acquire("alice", "a1", time.Now().Add(time.Minute), 1, false); err != nil {
+		t.Fatalf("session of an expired token: Acquire() error = %v", err)
+	}
+	if err := store.Acquire("alice", "a2", time.Time{}, 1, false); err != ErrSessionLimitExceeded {
+		t.Fatalf("Acquire() error = %v, want %v", err, ErrSessionLimitExceeded)
+	}
+}
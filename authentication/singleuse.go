@@ -0,0 +1,76 @@
+package authentication
+
+import (
+	"net/http"
+	"time"
+)
+
+// UsedTokenStore records the "jti" claims of consumed single-use tokens, see
+// RequiresSingleUse. Implementations shared by several instances, e.g. backed by
+// Redis SETNX, must make Consume atomic.
+type UsedTokenStore interface {
+	// Consume marks the token jti as used until expiry, the zero time for tokens that
+	// don't expire, and returns ErrTokenAlreadyUsed if it has been used before.
+	Consume(jti string, expiry time.Time) error
+}
+
+// RequiresSingleUse middleware accepts each token once only, e.g. the tokens of email
+// confirmation or password reset links, consuming its "jti" claim in store on first
+// use. Requests without a verified token, with a token without a "jti" claim or with
+// a consumed token get a 401 Unauthorized response. Mount it last, after the
+// middlewares that may still reject the request, so that rejected requests don't
+// consume the token.
+func (ja *jwtAuth) RequiresSingleUse(store UsedTokenStore) Middleware {
+	return func(next http.Handler) http.Handler {
+		hfn := func(w http.ResponseWriter, r *http.Request) {
+			ja := ja.current()
+			if ja.isExempt(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token, claims, err := ja.tokenFromContext(r.Context())
+			if err != nil || token == nil || !token.Valid {
+				deny(w, unauthorizedReason(err), http.StatusText(401), 401)
+				return
+			}
+			jti, _ := claims["jti"].(string)
+			if jti == "" {
+				deny(w, ErrorCodeMissingJTI, http.StatusText(401), 401)
+				return
+			}
+			var expiry time.Time
+			if exp, ok := toInt64(claims["exp"]); ok {
+				expiry = time.Unix(exp, 0)
+			}
+			if err := store.Consume(jti, expiry); err != nil {
+				deny(w, unauthorizedReason(err), http.StatusText(401), 401)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(hfn)
+	}
+}
+
+// memoryUsedTokenStore is a UsedTokenStore keeping the consumed tokens in memory until
+// they expire, like a memoryNonceStore does nonces.
+type memoryUsedTokenStore struct {
+	used NonceStore
+}
+
+// NewMemoryUsedTokenStore returns a UsedTokenStore for a single instance service. A
+// consumed token is remembered until it expires, so single-use links should carry a
+// short expiry: a link token without one stays consumed, and in memory, for the
+// lifetime of the store, and is usable again once the service restarts.
+func NewMemoryUsedTokenStore() UsedTokenStore {
+	return &memoryUsedTokenStore{used: NewMemoryNonceStore()}
+}
+
+func (s *memoryUsedTokenStore) Consume(jti string, expiry time.Time) error {
+	err := s.used.Use(jti, expiry)
+	if err == ErrReplay {
+		return ErrTokenAlreadyUsed
+	}
+	return err
+}
@@ -0,0 +1,55 @@
+package authentication
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestRequiresSingleUse(t *testing.T) {
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret})
+	h := ja.Verify()(ja.RequiresSingleUse(NewMemoryUsedTokenStore())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("password reset"))
+	})))
+	serve := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/reset", nil)
+		req.Header = header.Clone()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	exp := time.Now().Add(time.Hour).Unix()
+	reset := newAuthHeader(jwt.MapClaims{"sub": "alice", "jti": "reset-1", "exp": exp})
+
+	// of two simultaneous uses only one succeeds
+	codes := make([]int, 2)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = serve(reset).Code
+		}(i)
+	}
+	wg.Wait()
+	if codes[0]+codes[1] != 200+401 {
+		t.Fatalf("simultaneous uses: got %v, want one 200 and one 401", codes)
+	}
+
+	rec := serve(reset)
+	if rec.Code != 401 || rec.Header().Get(DenyReasonHeader) != ErrorCodeTokenAlreadyUsed {
+		t.Fatalf("reuse: got %d %q, want 401 %q", rec.Code, rec.Header().Get(DenyReasonHeader), ErrorCodeTokenAlreadyUsed)
+	}
+	rec = serve(newAuthHeader(jwt.MapClaims{"sub": "alice", "exp": exp}))
+	if rec.Code != 401 || rec.Header().Get(DenyReasonHeader) != ErrorCodeMissingJTI {
+		t.Fatalf("no jti: got %d %q, want 401 %q", rec.Code, rec.Header().Get(DenyReasonHeader), ErrorCodeMissingJTI)
+	}
+	if rec := serve(newAuthHeader(jwt.MapClaims{"sub": "alice", "jti": "reset-2", "exp": exp})); rec.Code != 200 {
+		t.Fatalf("other token: got %d, want 200", rec.Code)
+	}
+}
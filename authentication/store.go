@@ -0,0 +1,66 @@
+package authentication
+
+import (
+	"time"
+)
+
+// sweepInterval is how often an expiringMap deletes its expired entries.
+const sweepInterval = time.Minute
+
+// expiringMap holds the entries of the memory stores until they expire. Entries of the
+// zero expiry never do. Expired entries are invisible right away and deleted by a
+// sweep at most once per sweepInterval, so the map stays bounded by the entries of
+// the last interval. It is not safe for concurrent use, the stores guard it.
+type expiringMap struct {
+	entries   map[string]expiringEntry
+	lastSweep time.Time
+}
+
+// expiringEntry is a value of an expiringMap and the time it expires.
+type expiringEntry struct {
+	value  interface{}
+	expiry time.Time
+}
+
+func newExpiringMap() *expiringMap {
+	return &expiringMap{entries: map[string]expiringEntry{}}
+}
+
+// get returns the value of key, unless it is missing or expired at now.
+func (m *expiringMap) get(key string, now time.Time) (interface{}, bool) {
+	m.sweep(now)
+	e, ok := m.entries[key]
+	if !ok || expiredAt(e.expiry, now) {
+		return nil, false
+	}
+	return e.value, true
+}
+
+// set stores value under key until expiry.
+func (m *expiringMap) set(key string, value interface{}, expiry time.Time) {
+	m.entries[key] = expiringEntry{value, expiry}
+}
+
+// delete deletes key.
+func (m *expiringMap) delete(key string) {
+	delete(m.entries, key)
+}
+
+// sweep deletes the entries expired at now, unless the last sweep is more recent than
+// sweepInterval.
+func (m *expiringMap) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) <= sweepInterval {
+		return
+	}
+	for key, e := range m.entries {
+		if expiredAt(e.expiry, now) {
+			delete(m.entries, key)
+		}
+	}
+	m.lastSweep = now
+}
+
+// expiredAt reports whether expiry, the zero time for never, has passed at now.
+func expiredAt(expiry, now time.Time) bool {
+	return !expiry.IsZero() && now.After(expiry)
+}
@@ -0,0 +1,85 @@
+package authentication
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// failingSessionStore is a SessionStore that is down.
+type failingSessionStore struct{}
+
+func (failingSessionStore) Acquire(sub, jti string, expiry time.Time, limit int, evict bool) error {
+	return errors.New("store down")
+}
+
+// failingUsageStore is a UsageStore that is down.
+type failingUsageStore struct{}
+
+func (failingUsageStore) Increment(jti string, expiry time.Time) (int64, error) {
+	return 0, errors.New("store down")
+}
+
+func TestStoreFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  Option
+		code string
+	}{
+		{"session store", WithSessionLimit(2, failingSessionStore{}), ErrorCodeSessionsUnavailable},
+		{"usage store", WithUsageCap(10, failingUsageStore{}), ErrorCodeUsageUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}, tt.opt)
+			h := ja.Verify()(ja.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("welcome"))
+			})))
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header = newAuthHeader(jwt.MapClaims{"uid": "alice", "roles": []string{}, "sub": "alice", "jti": "a1"})
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != 503 || rec.Header().Get(DenyReasonHeader) != tt.code {
+				t.Fatalf("got %d %q, want 503 %q", rec.Code, rec.Header().Get(DenyReasonHeader), tt.code)
+			}
+		})
+	}
+}
+
+func TestExpiringMap(t *testing.T) {
+	m := newExpiringMap()
+	now := time.Now()
+	m.set("expired", 1, now.Add(-time.Second))
+	m.set("live", 2, now.Add(time.Hour))
+	m.set("forever", 3, time.Time{})
+
+	if _, ok := m.get("expired", now); ok {
+		t.Error("get() returned an expired entry")
+	}
+	for key, want := range map[string]int{"live": 2, "forever": 3} {
+		if v, ok := m.get(key, now); !ok || v != want {
+			t.Errorf("get(%s) = %v, %v, want %d", key, v, ok, want)
+		}
+	}
+	if len(m.entries) != 2 {
+		t.Errorf("sweep left %d entries, want 2", len(m.entries))
+	}
+
+	// Expired entries are deleted once the sweep interval passed
+	m.set("short", 4, now.Add(time.Second))
+	if _, ok := m.get("short", now.Add(sweepInterval/2)); ok {
+		t.Error("get() returned an expired entry")
+	}
+	if _, ok := m.entries["short"]; !ok {
+		t.Error("swept before the sweep interval passed")
+	}
+	m.get("forever", now.Add(2*sweepInterval))
+	if _, ok := m.entries["short"]; ok {
+		t.Error("not swept after the sweep interval passed")
+	}
+}
@@ -0,0 +1,60 @@
+package authentication
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// tenantCtxKey holds the tenant of the request, see WithTenantFunc.
+var tenantCtxKey = &contextKey{"Tenant"}
+
+// HMACSecretFunc resolves the secret verifying an HMAC token from the context of the
+// request it was sent with, the "kid" header of the token, empty if it has none, and
+// the tenant of the request, see WithTenantFunc.
+type HMACSecretFunc func(ctx context.Context, kid, tenant string) ([]byte, error)
+
+// WithHMACSecretFunc verifies HMAC tokens with a secret resolved per request, e.g.
+// the secret of the tenant the request is for, instead of the configured key. The
+// algorithm must be one of HS256, HS384 and HS512, and tokens signed with another
+// are still rejected with ErrAlgoInvalid. Tokens the secret isn't resolved for fail
+// verification with the returned error; return ErrKeyUnavailable to report the
+// failure as a system error.
+func WithHMACSecretFunc(f HMACSecretFunc) Option {
+	return func(ja *jwtAuth) {
+		ja.hmacSecretFunc = f
+	}
+}
+
+// WithTenantFunc sets how Verify tells the tenant a request is for, e.g. from a
+// header or the host name, passed on to the HMACSecretFunc. Tokens verified outside
+// of a request, e.g. with Parse, have no tenant.
+func WithTenantFunc(f func(r *http.Request) string) Option {
+	return func(ja *jwtAuth) {
+		ja.tenantFunc = f
+	}
+}
+
+// tenantContext returns a copy of ctx carrying the tenant of the request.
+func (ja *jwtAuth) tenantContext(ctx context.Context, r *http.Request) context.Context {
+	if ja.tenantFunc == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, tenantCtxKey, ja.tenantFunc(r))
+}
+
+// hmacSecret resolves the secret verifying token with the HMACSecretFunc.
+func (ja *jwtAuth) hmacSecret(ctx context.Context, t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	tenant, _ := ctx.Value(tenantCtxKey).(string)
+	secret, err := ja.hmacSecretFunc(ctx, kid, tenant)
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("authentication: no HMAC secret for tenant %q", tenant)
+	}
+	return secret, nil
+}
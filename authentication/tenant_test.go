@@ -0,0 +1,58 @@
+package authentication
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestHMACSecretFunc(t *testing.T) {
+	secrets := map[string][]byte{"acme": []byte("acme-secret"), "globex": []byte("globex-secret")}
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}},
+		WithHMACSecretFunc(func(ctx context.Context, kid, tenant string) ([]byte, error) {
+			return secrets[tenant], nil
+		}),
+		WithTenantFunc(func(r *http.Request) string { return r.Header.Get("X-Tenant") }),
+	)
+	if err := ja.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	h := ja.Verify()(ja.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})))
+
+	claims := jwt.MapClaims{"uid": "123", "roles": []string{}}
+	tests := []struct {
+		name   string
+		tenant string
+		token  string
+		status int
+	}{
+		{"acme", "acme", newJwtToken(secrets["acme"], claims), 200},
+		{"globex", "globex", newJwtToken(secrets["globex"], claims), 200},
+		{"cross tenant", "globex", newJwtToken(secrets["acme"], claims), 401},
+		{"unknown tenant", "initech", newJwtToken(secrets["acme"], claims), 401},
+		{"wrong algorithm", "acme", newJwt512Token(secrets["acme"], claims), 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Authorization", "BEARER "+tt.token)
+			req.Header.Set("X-Tenant", tt.tenant)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("got %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+
+	rsa := NewJWTAuth(Config{JwtAuthAlgo: "RS256", JwtParser: &jwt.Parser{}},
+		WithHMACSecretFunc(func(ctx context.Context, kid, tenant string) ([]byte, error) { return nil, nil }))
+	if err := rsa.Validate(); err == nil {
+		t.Fatal("Validate: HMAC secret func accepted for RS256")
+	}
+}
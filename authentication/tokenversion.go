@@ -0,0 +1,34 @@
+package authentication
+
+import (
+	"fmt"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// WithTokenVersion rejects tokens whose "tv" claim, 0 if absent, is below the current
+// token version of their subject with ErrTokenVersionStale, so bumping the version
+// invalidates all the tokens of the subject. lookup returns the current version; its
+// failures are reported as ErrTokenVersionUnavailable, a system error.
+func WithTokenVersion(lookup func(sub string) (int, error)) Option {
+	return func(ja *jwtAuth) {
+		ja.tokenVersion = lookup
+	}
+}
+
+// checkTokenVersion verifies the token has the current version of its subject.
+func (ja *jwtAuth) checkTokenVersion(token *jwt.Token) error {
+	if ja.tokenVersion == nil {
+		return nil
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	current, err := ja.tokenVersion(subjectClaim(ja.rootClaims(claims)))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrTokenVersionUnavailable, err)
+	}
+	tv, _ := toInt64(claims["tv"])
+	if tv < int64(current) {
+		return ErrTokenVersionStale
+	}
+	return nil
+}
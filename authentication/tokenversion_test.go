@@ -0,0 +1,49 @@
+package authentication
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestTokenVersion(t *testing.T) {
+	versions := map[string]int{"alice": 3}
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret},
+		WithTokenVersion(func(sub string) (int, error) {
+			if sub == "broken" {
+				return 0, errors.New("database down")
+			}
+			return versions[sub], nil
+		}))
+	h := ja.Verify()(ja.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})))
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		status int
+		reason string
+	}{
+		{"current version", jwt.MapClaims{"uid": "alice", "tv": 3}, 200, ""},
+		{"stale version", jwt.MapClaims{"uid": "alice", "tv": 2}, 401, ErrorCodeTokenVersionStale},
+		{"absent version", jwt.MapClaims{"uid": "alice"}, 401, ErrorCodeTokenVersionStale},
+		{"never bumped", jwt.MapClaims{"uid": "bob"}, 200, ""},
+		{"lookup error", jwt.MapClaims{"uid": "broken", "tv": 1}, 503, ErrorCodeTokenVersionUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.claims["roles"] = []string{}
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header = newAuthHeader(tt.claims)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.status || rec.Header().Get(DenyReasonHeader) != tt.reason {
+				t.Fatalf("got %d %q, want %d %q", rec.Code, rec.Header().Get(DenyReasonHeader), tt.status, tt.reason)
+			}
+		})
+	}
+}
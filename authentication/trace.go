@@ -0,0 +1,93 @@
+package authentication
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// WithDebugTrace writes a JSON line to w for every request Verify handles, tracing the
+// verification: the source the token was found in, its algorithm, key id, issuer,
+// audience and subject, the verification error and the response status, which shows
+// the decisions of the middlewares further down the chain. The token itself is never
+// written.
+//
+// WARNING: for debugging only, don't enable it in production. It writes a line per
+// request and exposes the identity of every caller.
+func WithDebugTrace(w io.Writer) Option {
+	return func(ja *jwtAuth) {
+		ja.debugTrace = &debugTracer{w: w}
+	}
+}
+
+// debugTracer serializes the trace events written to w.
+type debugTracer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// debugEvent is the trace of the verification of a request.
+type debugEvent struct {
+	Time     time.Time   `json:"time"`
+	Method   string      `json:"method"`
+	Path     string      `json:"path"`
+	Source   string      `json:"source,omitempty"`
+	Alg      string      `json:"alg,omitempty"`
+	KeyID    string      `json:"kid,omitempty"`
+	Issuer   string      `json:"iss,omitempty"`
+	Audience []string    `json:"aud,omitempty"`
+	Subject  string      `json:"sub,omitempty"`
+	Valid    bool        `json:"valid"`
+	Error    string      `json:"error,omitempty"`
+	Status   int         `json:"status"`
+	Duration jsonSeconds `json:"duration"`
+}
+
+// jsonSeconds is a duration encoded as fractional seconds.
+type jsonSeconds time.Duration
+
+func (d jsonSeconds) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).Seconds())
+}
+
+// trace serves the request with next and writes its trace event.
+func (t *debugTracer) trace(w http.ResponseWriter, r *http.Request, next http.Handler, token *jwt.Token, source string, err error) {
+	e := debugEvent{
+		Time:   time.Now().UTC(),
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Source: source,
+	}
+	if token != nil {
+		claims, _ := token.Claims.(jwt.MapClaims)
+		e.Alg, _ = token.Header["alg"].(string)
+		e.KeyID, _ = token.Header["kid"].(string)
+		e.Issuer, _ = claims["iss"].(string)
+		e.Audience = audienceClaim(claims)
+		e.Subject, _ = claims["sub"].(string)
+		e.Valid = token.Valid && err == nil
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	sw := &statusWriter{ResponseWriter: w}
+	next.ServeHTTP(sw, r)
+	e.Status = sw.status
+	if e.Status == 0 {
+		e.Status = http.StatusOK
+	}
+	e.Duration = jsonSeconds(time.Since(e.Time))
+
+	line, merr := json.Marshal(e)
+	if merr != nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.w.Write(append(line, '\n'))
+}
@@ -0,0 +1,64 @@
+package authentication
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+)
+
+func TestDebugTrace(t *testing.T) {
+	var buf bytes.Buffer
+	TokenAuthHS256 := NewJWTAuth(Config{
+		JwtAuthAlgo: "HS256",
+		JwtParser:   &jwt.Parser{},
+		SignKey:     TokenSecret,
+	}, WithDebugTrace(&buf))
+
+	r := chi.NewRouter()
+	r.Use(TokenAuthHS256.Verify(), TokenAuthHS256.Authenticate, TokenAuthHS256.RequiresRole("ADMIN"))
+	r.Get("/admin", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	admin := newAuthHeader(jwt.MapClaims{"uid": "1", "sub": "admin-1", "iss": "https://issuer.example", "aud": "api", "roles": []string{"ADMIN"}})
+	user := newAuthHeader(jwt.MapClaims{"uid": "2", "sub": "user-2", "roles": []string{"USER"}})
+	testRequest(t, ts, "GET", "/admin", admin, nil)
+	testRequest(t, ts, "GET", "/admin", user, nil)
+	testRequest(t, ts, "GET", "/admin", nil, nil)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d trace lines, want 3:\n%s", len(lines), buf.String())
+	}
+	want := []debugEvent{
+		{Source: TokenSourceHeader, Alg: "HS256", Issuer: "https://issuer.example", Audience: []string{"api"}, Subject: "admin-1", Valid: true, Status: 200},
+		{Source: TokenSourceHeader, Alg: "HS256", Subject: "user-2", Valid: true, Status: 401},
+		{Error: ErrNoTokenFound.Error(), Status: 401},
+	}
+	for i, line := range lines {
+		if strings.Contains(line, admin.Get("Authorization")[7:]) || strings.Contains(line, user.Get("Authorization")[7:]) {
+			t.Fatalf("trace line %d leaks the token: %s", i, line)
+		}
+		var e struct {
+			debugEvent
+			Duration float64 `json:"duration"`
+		}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		w := want[i]
+		if e.Source != w.Source || e.Alg != w.Alg || e.Issuer != w.Issuer || len(e.Audience) != len(w.Audience) ||
+			e.Subject != w.Subject || e.Valid != w.Valid || e.Error != w.Error || e.Status != w.Status || e.Path != "/admin" {
+			t.Errorf("trace line %d = %s, want %+v", i, line, w)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package authentication
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// UsageStore counts the uses of each token, see WithUsageCap. Implementations shared
+// by several instances, e.g. backed by Redis INCR, must make Increment atomic.
+type UsageStore interface {
+	// Increment counts a use of the token jti, which expires at expiry, the zero time
+	// for tokens that don't, and returns the number of uses counted so far, this one
+	// included.
+	Increment(jti string, expiry time.Time) (int64, error)
+}
+
+// WithUsageCap limits each token to n uses, told apart by its "jti" claim and counted
+// by store whatever the token expiry. A request is counted once, by the first of
+// Authenticate, Optional and the Requires middlewares its token passes, however many
+// of them are stacked. Uses beyond the cap are rejected with ErrUsageCapExceeded and
+// store failures with ErrUsageUnavailable, a system error.
+// Tokens without a "jti" claim are not capped, so pair it with WithClaimsSchema to
+// require one.
+func WithUsageCap(n int, store UsageStore) Option {
+	return func(ja *jwtAuth) {
+		ja.usageCap = n
+		ja.usageStore = store
+	}
+}
+
+// checkUsage counts the use of the token against its usage cap.
+func (ja *jwtAuth) checkUsage(claims jwt.MapClaims) error {
+	if ja.usageStore == nil {
+		return nil
+	}
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return nil
+	}
+	var expiry time.Time
+	if exp, ok := toInt64(claims["exp"]); ok {
+		expiry = time.Unix(exp, 0)
+	}
+	uses, err := ja.usageStore.Increment(jti, expiry)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUsageUnavailable, err)
+	}
+	if uses > int64(ja.usageCap) {
+		return ErrUsageCapExceeded
+	}
+	return nil
+}
+
+// usage is the use count of a token in a memoryUsageStore.
+type usage struct {
+	uses int64
+}
+
+// memoryUsageStore is a UsageStore keeping the counts in memory until their token expires.
+type memoryUsageStore struct {
+	mu     sync.Mutex
+	usages *expiringMap
+}
+
+// NewMemoryUsageStore returns a UsageStore for a single instance service. The count of
+// a token is kept until the token expires, and for the lifetime of the store for
+// tokens without an expiry, so a capped token stays capped until the service
+// restarts. Each instance of a replicated service counts on its own, allowing up to
+// the cap per instance.
+func NewMemoryUsageStore() UsageStore {
+	return &memoryUsageStore{usages: newExpiringMap()}
+}
+
+func (s *memoryUsageStore) Increment(jti string, expiry time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.usages.get(jti, time.Now())
+	if !ok {
+		v = &usage{}
+		s.usages.set(jti, v, expiry)
+	}
+	u := v.(*usage)
+	u.uses++
+	return u.uses, nil
+}
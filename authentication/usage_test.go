@@ -0,0 +1,73 @@
+package authentication
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestUsageCap(t *testing.T) {
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}, WithUsageCap(10, NewMemoryUsageStore()))
+	h := ja.Verify()(ja.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})))
+
+	header := newAuthHeader(jwt.MapClaims{"uid": "123", "roles": []string{}, "jti": "key-1", "exp": time.Now().Add(time.Hour).Unix()})
+	var mu sync.Mutex
+	statuses := map[int]int{}
+	var wg sync.WaitGroup
+	for i := 0; i < 25; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header = header.Clone()
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			mu.Lock()
+			statuses[rec.Code]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if statuses[200] != 10 || statuses[403] != 15 {
+		t.Fatalf("got statuses %v, want 10 200s and 15 403s", statuses)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header = newAuthHeader(jwt.MapClaims{"uid": "123", "roles": []string{}, "jti": "key-2"})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("other token: got %d, want 200", rec.Code)
+	}
+}
+
+func TestUsageCountedOncePerRequest(t *testing.T) {
+	ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}, WithUsageCap(2, NewMemoryUsageStore()))
+	welcome := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("welcome"))
+	})
+	chains := map[string]http.Handler{
+		"authenticated": ja.Verify()(ja.Authenticate(ja.ForceAuthenticate(ja.RequiresRole("A")(ja.RequiresRole("B")(welcome))))),
+		"roles only":    ja.Verify()(ja.RequiresRole("A")(ja.RequiresRole("B")(welcome))),
+	}
+
+	for name, h := range chains {
+		header := newAuthHeader(jwt.MapClaims{"uid": "123", "roles": []string{"A", "B"}, "jti": name, "exp": time.Now().Add(time.Hour).Unix()})
+		for i, want := range []int{200, 200, 403} {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header = header.Clone()
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != want {
+				t.Fatalf("%s: use %d: got %d, want %d", name, i+1, rec.Code, want)
+			}
+		}
+	}
+}
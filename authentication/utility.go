@@ -1,6 +1,11 @@
 package authentication
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"net/http"
 	"strings"
 	"time"
@@ -9,15 +14,71 @@ import (
 )
 
 // TokenFromCookie tries to retreive the token string from a cookie named
-// "jwt".
+// "jwt", or the name set with WithCookieName.
 func (ja *jwtAuth) TokenFromCookie(r *http.Request) string {
-	cookie, err := r.Cookie("jwt")
+	ja = ja.current()
+	cookie, err := r.Cookie(ja.cookieName)
 	if err != nil {
 		return ""
 	}
 	return cookie.Value
 }
 
+// tokenFromForwardedAccessToken retrieves the raw token forwarded by a service mesh.
+func (ja *jwtAuth) tokenFromForwardedAccessToken(r *http.Request) string {
+	return r.Header.Get(ForwardedAccessTokenHeader)
+}
+
+// tokenFromMeshPayload retrieves the verified token payload forwarded by a service mesh.
+func (ja *jwtAuth) tokenFromMeshPayload(r *http.Request) string {
+	return r.Header.Get(MeshPayloadHeader)
+}
+
+// SetTokenCookie writes the token string to the token cookie. When a cookie
+// signature secret is configured the companion "<cookiename>.sig" cookie is
+// written as well.
+func (ja *jwtAuth) SetTokenCookie(w http.ResponseWriter, tokenString string) {
+	ja = ja.current()
+	http.SetCookie(w, ja.newCookie(ja.cookieName, tokenString))
+	if ja.cookieSecret != nil {
+		http.SetCookie(w, ja.newCookie(ja.cookieName+".sig", ja.cookieSignature(tokenString)))
+	}
+}
+
+func (ja *jwtAuth) newCookie(name, value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// cookieSignature returns the base64url encoded HMAC-SHA256 of the cookie value.
+func (ja *jwtAuth) cookieSignature(value string) string {
+	mac := hmac.New(sha256.New, ja.cookieSecret)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyCookieSignature checks the companion signature cookie of the token cookie.
+func (ja *jwtAuth) verifyCookieSignature(r *http.Request) error {
+	cookie, err := r.Cookie(ja.cookieName)
+	if err != nil {
+		return ErrCookieSignatureInvalid
+	}
+	sig, err := r.Cookie(ja.cookieName + ".sig")
+	if err != nil {
+		return ErrCookieSignatureInvalid
+	}
+	if !hmac.Equal([]byte(sig.Value), []byte(ja.cookieSignature(cookie.Value))) {
+		return ErrCookieSignatureInvalid
+	}
+	return nil
+}
+
 // TokenFromHeader tries to retreive the token string from the
 // "Authorization" request header: "Authorization: BEARER T".
 func (ja *jwtAuth) TokenFromHeader(r *http.Request) string {
@@ -71,15 +132,59 @@ func (ja *jwtAuth) SetExpiryIn(claims jwt.MapClaims, tm time.Duration) {
 	claims["exp"] = ja.ExpireIn(tm)
 }
 
-func (ja *jwtAuth) keyFunc(t *jwt.Token) (interface{}, error) {
+// keyFunc returns the jwt.Keyfunc resolving the verify key for a token decoded
+// within ctx. Keys are only released for tokens signed with exactly the configured
+// method, never to another method of the same family, e.g. HS256 for HS512.
+func (ja *jwtAuth) keyFunc(ctx context.Context) jwt.Keyfunc {
+	return func(t *jwt.Token) (interface{}, error) {
+		if !ja.isSigner(t.Method) {
+			return nil, ErrAlgoInvalid
+		}
+		if ja.x5cPool != nil {
+			if key, ok, err := ja.x5cKey(t); ok {
+				return key, err
+			}
+		}
+		if ja.hmacSecretFunc != nil {
+			return ja.hmacSecret(ctx, t)
+		}
+		kid, _ := t.Header["kid"].(string)
+		if ja.issuerKeyFunc != nil {
+			claims, _ := t.Claims.(jwt.MapClaims)
+			iss, _ := claims["iss"].(string)
+			return ja.issuerKeyFunc(ctx, iss, kid)
+		}
+		if ja.keyFuncCtx == nil {
+			return ja.staticKey(t)
+		}
+		return ja.keyFuncCtx(ctx, kid)
+	}
+}
+
+// resolvesKeys reports whether the verify keys are resolved per token by a KeyFuncCtx
+// or an IssuerKeyFunc.
+func (ja *jwtAuth) resolvesKeys() bool {
+	return ja.keyFuncCtx != nil || ja.issuerKeyFunc != nil
+}
+
+// isSigner reports whether m is the configured signing method. Methods compare by
+// name, as the jwt-go registry may return a new instance for every lookup.
+func (ja *jwtAuth) isSigner(m jwt.SigningMethod) bool {
+	return m != nil && ja.signer != nil && m.Alg() == ja.signer.Alg()
+}
+
+func (ja *jwtAuth) staticKey(t *jwt.Token) (interface{}, error) {
 	if ja.verifyKey != nil {
 		return ja.verifyKey, nil
-	} else {
+	}
+	if ja.signKey != nil {
 		return ja.signKey, nil
 	}
+	return nil, ErrKeyUnavailable
 }
 
 func (ja *jwtAuth) Encode(claims jwt.Claims) (t *jwt.Token, tokenString string, err error) {
+	ja = ja.current()
 	t = jwt.New(ja.signer)
 	t.Claims = claims
 	tokenString, err = t.SignedString(ja.signKey)
@@ -88,9 +193,123 @@ func (ja *jwtAuth) Encode(claims jwt.Claims) (t *jwt.Token, tokenString string,
 }
 
 func (ja *jwtAuth) Decode(tokenString string) (t *jwt.Token, err error) {
-	t, err = ja.parser.Parse(tokenString, ja.keyFunc)
+	ja = ja.current()
+	t, err = ja.decode(context.Background(), tokenString, ja.typs)
 	if err != nil {
 		return nil, err
 	}
 	return
 }
+
+// decode parses and validates the token string, returning the parsed token even
+// when validation fails. The "typ" header must be one of typs, if any, even for
+// tokens failing validation, so that the leeway and grace checks can't accept them.
+func (ja *jwtAuth) decode(ctx context.Context, tokenString string, typs []string) (*jwt.Token, error) {
+	if ja.lenientBase64 {
+		tokenString = strings.Replace(tokenString, "=", "", -1)
+	}
+	// Only the compact serialization is supported. Tokens in the JSON serialization,
+	// e.g. signed by several parties, are rejected rather than reported malformed.
+	if strings.HasPrefix(strings.TrimSpace(tokenString), "{") {
+		return nil, ErrUnsupportedSerialization
+	}
+	if ja.maxClaimsSize > 0 && claimsSize(tokenString) > ja.maxClaimsSize {
+		return nil, ErrClaimsTooLarge
+	}
+	token, err := ja.verifier().verify(tokenString, ja.keyFunc(ctx))
+	if token != nil && ja.relativeExpiryClaim != "" {
+		err = ja.relativeExpiry(token, err)
+	}
+	if token != nil && hasCritHeader(token.Header) {
+		return token, ErrUnsupportedCritHeader
+	}
+	if token != nil && len(typs) > 0 && !typMatches(token, typs) {
+		return token, ErrTypInvalid
+	}
+	return token, err
+}
+
+// relativeExpiry sets the "exp" claim of a token without one to its issue time plus
+// the relative expiry claim, see WithRelativeExpiry, adding the expiry error to err if
+// the token is expired.
+func (ja *jwtAuth) relativeExpiry(token *jwt.Token, err error) error {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return err
+	}
+	if _, ok := claims["exp"]; ok {
+		return err
+	}
+	iat, ok := ja.issuedAt(claims)
+	if !ok {
+		return err
+	}
+	expiresIn, ok := toInt64(claims[ja.relativeExpiryClaim])
+	if !ok {
+		return err
+	}
+	// Stored as a NumericDate so that the leeway and grace checks see it
+	claims["exp"] = float64(iat + expiresIn)
+	if ja.parser != nil && ja.parser.SkipClaimsValidation {
+		return err
+	}
+	expired := &jwt.ValidationError{}
+	validateTimes(claims, time.Now().Unix(), expired)
+	if expired.Errors&jwt.ValidationErrorExpired == 0 {
+		return err
+	}
+
+	verr, ok := err.(*jwt.ValidationError)
+	if err != nil && !ok {
+		return err
+	}
+	if verr == nil {
+		verr = &jwt.ValidationError{Inner: errors.New("Token is expired")}
+	}
+	verr.Errors |= jwt.ValidationErrorExpired
+	token.Valid = false
+	return verr
+}
+
+// claimsSize returns the size of the decoded claims segment of tokenString.
+func claimsSize(tokenString string) int {
+	parts := strings.SplitN(tokenString, ".", 3)
+	if len(parts) < 2 {
+		return 0
+	}
+	return base64.RawURLEncoding.DecodedLen(len(strings.TrimRight(parts[1], "=")))
+}
+
+// hasCritHeader reports whether the header uses JWS extensions, none of which are
+// supported: a "crit" header, or the RFC 7797 unencoded payload "b64" header, which
+// changes the signing input.
+func hasCritHeader(header map[string]interface{}) bool {
+	if _, ok := header["crit"]; ok {
+		return true
+	}
+	b64, ok := header["b64"]
+	return ok && b64 != true
+}
+
+// typMatches reports whether the "typ" header of the token is one of typs. Media
+// types compare case insensitively and with or without their "application/" prefix.
+func typMatches(token *jwt.Token, typs []string) bool {
+	typ, _ := token.Header["typ"].(string)
+	typ = strings.TrimPrefix(strings.ToLower(typ), "application/")
+	for _, t := range typs {
+		if typ != "" && typ == strings.TrimPrefix(strings.ToLower(t), "application/") {
+			return true
+		}
+	}
+	return false
+}
+
+// verifier returns the verifier for the configured signing method.
+func (ja *jwtAuth) verifier() tokenVerifier {
+	if ja.nativeHMAC && ja.signer != nil {
+		if _, ok := hmacHashes[ja.signer.Alg()]; ok {
+			return hmacVerifier{ja.parser}
+		}
+	}
+	return parserVerifier{ja.parser}
+}
@@ -0,0 +1,169 @@
+package authentication
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// ConfigError lists every problem Validate found in the configuration.
+type ConfigError []error
+
+func (e ConfigError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return "authentication: invalid configuration: " + strings.Join(msgs, "; ")
+}
+
+// Validate checks that the configuration is internally consistent, so that a
+// misconfigured authenticator fails at startup rather than on the first request.
+// Call it in main before serving:
+//
+//	tokenAuth := authentication.NewJWTAuth(config)
+//	if err := tokenAuth.Validate(); err != nil {
+//		log.Fatal(err)
+//	}
+//
+// The returned error is a ConfigError listing every problem found.
+func (ja *jwtAuth) Validate() error {
+	ja = ja.current()
+	var errs ConfigError
+
+	if ja.signer == nil {
+		errs = append(errs, fmt.Errorf("unsupported signing algorithm %q", ja.algorithm))
+	} else if jwt.GetSigningMethod(ja.signer.Alg()) == nil {
+		errs = append(errs, fmt.Errorf("signing method %s is not registered with jwt.RegisterSigningMethod", ja.signer.Alg()))
+	} else {
+		errs = append(errs, ja.validateKeys()...)
+	}
+
+	if ja.parser == nil {
+		errs = append(errs, errors.New("no JWT parser configured"))
+	} else if ja.parser.ValidMethods != nil && ja.signer != nil && !containsString(ja.parser.ValidMethods, ja.signer.Alg()) {
+		errs = append(errs, fmt.Errorf("parser valid methods %v exclude the signing algorithm %s", ja.parser.ValidMethods, ja.signer.Alg()))
+	}
+
+	if ja.jwtExpiry < 0 {
+		errs = append(errs, fmt.Errorf("negative token expiry %s", ja.jwtExpiry))
+	}
+	if ja.jwtRefreshExpiry < 0 {
+		errs = append(errs, fmt.Errorf("negative refresh token expiry %s", ja.jwtRefreshExpiry))
+	}
+
+	if len(ja.tokenSources) == 0 {
+		errs = append(errs, errors.New("no token sources configured"))
+	}
+	for _, source := range ja.tokenSources {
+		if !hasFinder(ja.finders(), source) {
+			errs = append(errs, fmt.Errorf("unknown token source %q", source))
+		}
+		if source == TokenSourceMeshPayload && !ja.trustMeshPayload {
+			errs = append(errs, errors.New("mesh payload token source without a trusted mesh"))
+		}
+	}
+
+	if ja.cookieName == "" {
+		errs = append(errs, errors.New("empty token cookie name"))
+	}
+	if ja.csrfCookieName != "" && ja.csrfCookieName == ja.cookieName {
+		errs = append(errs, errors.New("csrf cookie name equals the token cookie name"))
+	}
+
+	if ja.challengeURL != "" {
+		if _, err := url.Parse(ja.challengeURL); err != nil {
+			errs = append(errs, fmt.Errorf("challenge redirect: %w", err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Warmup prepares the authenticator for serving, call it at startup before reporting
+// readiness. It validates the configuration, see Validate, and with a sign key
+// configured signs and verifies a probe token, catching a verify key that doesn't
+// match the sign key. Warmup is safe to call repeatedly.
+func (ja *jwtAuth) Warmup(ctx context.Context) error {
+	ja = ja.current()
+	if err := ja.Validate(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ja.signKey == nil || ja.resolvesKeys() {
+		// nothing to probe the verify keys with
+		return nil
+	}
+
+	_, tokenString, err := ja.Encode(jwt.MapClaims{"exp": time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		return fmt.Errorf("authentication: signing probe token: %w", err)
+	}
+	if _, err := ja.verifier().verify(tokenString, ja.staticKey); err != nil {
+		return fmt.Errorf("authentication: verifying probe token: %w", err)
+	}
+	return nil
+}
+
+// validateKeys checks the configured keys are of the type the signing algorithm needs.
+func (ja *jwtAuth) validateKeys() []error {
+	if _, ok := ja.signer.(*jwt.SigningMethodHMAC); ja.hmacSecretFunc != nil && !ok {
+		return []error{fmt.Errorf("HMAC secret func requires an HMAC algorithm, got %s", ja.signer.Alg())}
+	}
+	if ja.signKey == nil && ja.verifyKey == nil {
+		if ja.resolvesKeys() || ja.x5cPool != nil || ja.hmacSecretFunc != nil {
+			// verify keys are resolved per token
+			return nil
+		}
+		return []error{fmt.Errorf("no key configured for %s", ja.signer.Alg())}
+	}
+
+	var errs []error
+	switch ja.signer.(type) {
+	case *jwt.SigningMethodHMAC:
+		for _, key := range []interface{}{ja.signKey, ja.verifyKey} {
+			if key == nil {
+				continue
+			}
+			if b, ok := key.([]byte); !ok || len(b) == 0 {
+				errs = append(errs, fmt.Errorf("%s requires a non-empty []byte key, got %T", ja.signer.Alg(), key))
+			}
+		}
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		if _, ok := ja.signKey.(*rsa.PrivateKey); ja.signKey != nil && !ok {
+			errs = append(errs, fmt.Errorf("%s requires a *rsa.PrivateKey sign key, got %T", ja.signer.Alg(), ja.signKey))
+		}
+		if _, ok := ja.verifyKey.(*rsa.PublicKey); !ok && !ja.resolvesKeys() && ja.x5cPool == nil {
+			errs = append(errs, fmt.Errorf("%s requires a *rsa.PublicKey verify key, got %T", ja.signer.Alg(), ja.verifyKey))
+		}
+	case *jwt.SigningMethodECDSA:
+		if _, ok := ja.signKey.(*ecdsa.PrivateKey); ja.signKey != nil && !ok {
+			errs = append(errs, fmt.Errorf("%s requires a *ecdsa.PrivateKey sign key, got %T", ja.signer.Alg(), ja.signKey))
+		}
+		if _, ok := ja.verifyKey.(*ecdsa.PublicKey); !ok && !ja.resolvesKeys() && ja.x5cPool == nil {
+			errs = append(errs, fmt.Errorf("%s requires a *ecdsa.PublicKey verify key, got %T", ja.signer.Alg(), ja.verifyKey))
+		}
+	}
+	return errs
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,208 @@
+package authentication
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		opts     []Option
+		problems int
+	}{
+		{
+			name:   "valid HMAC config",
+			config: Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret},
+		},
+		{
+			name:     "unknown algorithm and no parser",
+			config:   Config{JwtAuthAlgo: "HS257", SignKey: TokenSecret},
+			problems: 2,
+		},
+		{
+			name:     "no key",
+			config:   Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}},
+			problems: 1,
+		},
+		{
+			name:     "wrong key type and negative expiry",
+			config:   Config{JwtAuthAlgo: "RS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret, JwtExpiry: -time.Minute},
+			problems: 3,
+		},
+		{
+			name:     "empty accepted methods",
+			config:   Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{ValidMethods: []string{}}, SignKey: TokenSecret},
+			problems: 1,
+		},
+		{
+			name:     "empty cookie name",
+			config:   Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret},
+			opts:     []Option{WithCookieName("")},
+			problems: 1,
+		},
+		{
+			name:     "unknown token source",
+			config:   Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret},
+			opts:     []Option{WithTokenSources("form")},
+			problems: 1,
+		},
+		{
+			name:     "no token sources",
+			config:   Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret},
+			opts:     []Option{WithTokenSources()},
+			problems: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := NewJWTAuth(tt.config, tt.opts...).Validate()
+			if tt.problems == 0 {
+				if err != nil {
+					t.Fatalf("Validate() error = %v", err)
+				}
+				return
+			}
+			cerr, ok := err.(ConfigError)
+			if !ok {
+				t.Fatalf("Validate() error = %v, want a ConfigError", err)
+			}
+			if len(cerr) != tt.problems {
+				t.Fatalf("Validate() found %d problems, want %d: %v", len(cerr), tt.problems, err)
+			}
+		})
+	}
+}
+
+func TestNewFromConfig(t *testing.T) {
+	ja, err := NewFromConfig(Config{
+		JwtAuthAlgo:  "RS256",
+		SignKeyPEM:   PrivateKeyRS256String,
+		Issuers:      []string{"https://issuer.example"},
+		CookieName:   "session",
+		TokenSources: []string{TokenSourceHeader},
+	})
+	if err != nil {
+		t.Fatalf("NewFromConfig() error = %v", err)
+	}
+	_, tokenString, err := ja.Encode(jwt.MapClaims{"iss": "https://issuer.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ja.Decode(tokenString); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+
+	if _, err := NewFromConfig(Config{JwtAuthAlgo: "RS256", VerifyKeyPEM: "not a key"}); !errors.Is(err, ErrKeyPEMInvalid) {
+		t.Fatalf("NewFromConfig() error = %v, want %v", err, ErrKeyPEMInvalid)
+	}
+	if _, err := NewFromConfig(Config{JwtAuthAlgo: "HS256", TokenSources: []string{"form"}}); err == nil {
+		t.Fatal("NewFromConfig() accepted a config without key and an unknown token source")
+	} else if cerr, ok := err.(ConfigError); !ok || len(cerr) != 2 {
+		t.Fatalf("NewFromConfig() error = %v, want a ConfigError with 2 problems", err)
+	}
+}
+
+func TestNewFromConfigKeyTypes(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPEM := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	if der, err = x509.MarshalPKIXPublicKey(&ecKey.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	ecPublicPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{"hmac secret", Config{JwtAuthAlgo: "HS256", Secret: "secret"}},
+		{"ecdsa private key", Config{JwtAuthAlgo: "ES256", SignKeyPEM: ecPEM}},
+		{"ecdsa keys", Config{JwtAuthAlgo: "ES256", SignKeyPEM: ecPEM, VerifyKeyPEM: ecPublicPEM}},
+		{"rsa private key", Config{JwtAuthAlgo: "RS256", SignKeyPEM: PrivateKeyRS256String}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ja, err := NewFromConfig(tt.config)
+			if err != nil {
+				t.Fatalf("NewFromConfig() error = %v", err)
+			}
+			_, tokenString, err := ja.Encode(jwt.MapClaims{"uid": "123"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ja.Decode(tokenString); err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+		})
+	}
+
+	// The key must suit the algorithm
+	if _, err := NewFromConfig(Config{JwtAuthAlgo: "RS256", SignKeyPEM: ecPEM}); err == nil {
+		t.Fatal("NewFromConfig() accepted an ECDSA key for RS256")
+	}
+}
+
+func TestConfigDurations(t *testing.T) {
+	var config Config
+	data := `{"jwtAuthAlgo": "HS256", "jwtExpiry": "15m", "jwtRefreshExpiry": 3600000000000, "leeway": "30s"}`
+	if err := json.Unmarshal([]byte(data), &config); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if config.JwtAuthAlgo != "HS256" || config.JwtExpiry != 15*time.Minute || config.JwtRefreshExpiry != time.Hour || config.Leeway != 30*time.Second {
+		t.Fatalf("Unmarshal() = %+v", config)
+	}
+	if err := json.Unmarshal([]byte(`{"leeway": "soon"}`), &config); err == nil {
+		t.Fatal("Unmarshal() accepted an invalid duration")
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	ctx := context.Background()
+	if err := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}).Warmup(ctx); err != nil {
+		t.Fatalf("Warmup() error = %v", err)
+	}
+	if _, ok := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}}).Warmup(ctx).(ConfigError); !ok {
+		t.Fatal("Warmup() accepted a config without key")
+	}
+
+	signKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(PrivateKeyRS256String))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mismatched := NewJWTAuth(Config{JwtAuthAlgo: "RS256", JwtParser: &jwt.Parser{}, SignKey: signKey, VerifyKey: &otherKey.PublicKey})
+	if err := mismatched.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	if err := mismatched.Warmup(ctx); err == nil {
+		t.Fatal("Warmup() accepted a verify key not matching the sign key")
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}).Warmup(canceled); err != context.Canceled {
+		t.Fatalf("Warmup() error = %v, want %v", err, context.Canceled)
+	}
+}
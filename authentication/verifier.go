@@ -0,0 +1,175 @@
+package authentication
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	// hash implementations used by the HMAC methods
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// tokenVerifier parses a token string, validates its time based claims and verifies
+// its signature with the key returned by keyFunc. Like jwt.Parser it returns the
+// parsed token along with any *jwt.ValidationError.
+type tokenVerifier interface {
+	verify(tokenString string, keyFunc jwt.Keyfunc) (*jwt.Token, error)
+}
+
+// parserVerifier verifies tokens with the jwt-go parser.
+type parserVerifier struct {
+	parser *jwt.Parser
+}
+
+func (v parserVerifier) verify(tokenString string, keyFunc jwt.Keyfunc) (*jwt.Token, error) {
+	return v.parser.Parse(tokenString, keyFunc)
+}
+
+// hmacVerifier verifies HS256, HS384 and HS512 tokens with the standard library only,
+// honouring the ValidMethods, UseJSONNumber and SkipClaimsValidation parser settings.
+type hmacVerifier struct {
+	parser *jwt.Parser
+}
+
+var hmacHashes = map[string]crypto.Hash{
+	"HS256": crypto.SHA256,
+	"HS384": crypto.SHA384,
+	"HS512": crypto.SHA512,
+}
+
+func (v hmacVerifier) verify(tokenString string, keyFunc jwt.Keyfunc) (*jwt.Token, error) {
+	parts := strings.Split(tokenString, ".")
+	if len(parts) != 3 {
+		return nil, jwt.NewValidationError("token contains an invalid number of segments", jwt.ValidationErrorMalformed)
+	}
+	token := &jwt.Token{Raw: tokenString}
+
+	// Parse header
+	headerBytes, err := decodeSegment(parts[0])
+	if err != nil {
+		if strings.HasPrefix(strings.ToLower(tokenString), "bearer ") {
+			return token, jwt.NewValidationError("tokenstring should not contain 'bearer '", jwt.ValidationErrorMalformed)
+		}
+		return token, &jwt.ValidationError{Inner: err, Errors: jwt.ValidationErrorMalformed}
+	}
+	if err := json.Unmarshal(headerBytes, &token.Header); err != nil {
+		return token, &jwt.ValidationError{Inner: err, Errors: jwt.ValidationErrorMalformed}
+	}
+
+	// Parse claims
+	claimBytes, err := decodeSegment(parts[1])
+	if err != nil {
+		return token, &jwt.ValidationError{Inner: err, Errors: jwt.ValidationErrorMalformed}
+	}
+	claims := jwt.MapClaims{}
+	dec := json.NewDecoder(bytes.NewBuffer(claimBytes))
+	if v.parser.UseJSONNumber {
+		dec.UseNumber()
+	}
+	if err := dec.Decode(&claims); err != nil {
+		return token, &jwt.ValidationError{Inner: err, Errors: jwt.ValidationErrorMalformed}
+	}
+	token.Claims = claims
+
+	// Lookup signing method
+	alg, _ := token.Header["alg"].(string)
+	if token.Method = jwt.GetSigningMethod(alg); token.Method == nil {
+		return token, jwt.NewValidationError("signing method (alg) is unavailable.", jwt.ValidationErrorUnverifiable)
+	}
+	if v.parser.ValidMethods != nil && !containsString(v.parser.ValidMethods, alg) {
+		return token, jwt.NewValidationError("signing method "+alg+" is invalid", jwt.ValidationErrorSignatureInvalid)
+	}
+
+	// Lookup key
+	key, err := keyFunc(token)
+	if err != nil {
+		if ve, ok := err.(*jwt.ValidationError); ok {
+			return token, ve
+		}
+		return token, &jwt.ValidationError{Inner: err, Errors: jwt.ValidationErrorUnverifiable}
+	}
+
+	vErr := &jwt.ValidationError{}
+	if !v.parser.SkipClaimsValidation {
+		validateTimes(claims, time.Now().Unix(), vErr)
+	}
+
+	// Verify signature
+	token.Signature = parts[2]
+	if err := verifyHMAC(alg, parts[0]+"."+parts[1], parts[2], key); err != nil {
+		vErr.Inner = err
+		vErr.Errors |= jwt.ValidationErrorSignatureInvalid
+	}
+
+	if vErr.Errors == 0 {
+		token.Valid = true
+		return token, nil
+	}
+	return token, vErr
+}
+
+// validateTimes checks the "exp", "iat" and "nbf" claims like jwt.MapClaims.Valid.
+func validateTimes(claims jwt.MapClaims, now int64, vErr *jwt.ValidationError) {
+	if exp, ok := timeClaim(claims, "exp"); ok && now > exp {
+		vErr.Inner = errors.New("Token is expired")
+		vErr.Errors |= jwt.ValidationErrorExpired
+	}
+	if iat, ok := timeClaim(claims, "iat"); ok && now < iat {
+		vErr.Inner = errors.New("Token used before issued")
+		vErr.Errors |= jwt.ValidationErrorIssuedAt
+	}
+	if nbf, ok := timeClaim(claims, "nbf"); ok && now < nbf {
+		vErr.Inner = errors.New("Token is not valid yet")
+		vErr.Errors |= jwt.ValidationErrorNotValidYet
+	}
+}
+
+// timeClaim returns a NumericDate claim, ignoring claims of other types as jwt-go does.
+func timeClaim(claims jwt.MapClaims, name string) (int64, bool) {
+	switch v := claims[name].(type) {
+	case float64:
+		return int64(v), true
+	case json.Number:
+		i, _ := v.Int64()
+		return i, true
+	}
+	return 0, false
+}
+
+func verifyHMAC(alg, signingString, signature string, key interface{}) error {
+	hash, ok := hmacHashes[alg]
+	if !ok {
+		// only HMAC keys are configured, so other methods can't verify either
+		return jwt.ErrInvalidKeyType
+	}
+	keyBytes, ok := key.([]byte)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := decodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(hash.New, keyBytes)
+	mac.Write([]byte(signingString))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+// decodeSegment decodes a base64url token segment, with or without padding.
+func decodeSegment(seg string) ([]byte, error) {
+	if l := len(seg) % 4; l > 0 {
+		seg += strings.Repeat("=", 4-l)
+	}
+	return base64.URLEncoding.DecodeString(seg)
+}
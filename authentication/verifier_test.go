@@ -0,0 +1,121 @@
+package authentication
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestNativeHMACParity(t *testing.T) {
+	now := time.Now().Unix()
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"valid", newJwtToken(TokenSecret, jwt.MapClaims{"uid": "123", "exp": now + 60})},
+		{"no claims", newJwtToken(TokenSecret)},
+		{"expired", newJwtToken(TokenSecret, jwt.MapClaims{"exp": now - 60})},
+		{"not valid yet", newJwtToken(TokenSecret, jwt.MapClaims{"nbf": now + 60})},
+		{"issued in the future", newJwtToken(TokenSecret, jwt.MapClaims{"iat": now + 60})},
+		{"wrong secret", newJwtToken([]byte("wrong"))},
+		{"expired with wrong secret", newJwtToken([]byte("wrong"), jwt.MapClaims{"exp": now - 60})},
+		{"wrong algorithm", newJwt512Token(TokenSecret)},
+		{"malformed", "asdf"},
+		{"bad segment", "a.b.c"},
+		{"bearer prefix", "Bearer " + newJwtToken(TokenSecret)},
+		{"tampered claims", tamperClaims(newJwtToken(TokenSecret, jwt.MapClaims{"uid": "123"}))},
+	}
+
+	for _, parser := range []*jwt.Parser{
+		{},
+		{UseJSONNumber: true},
+		{ValidMethods: []string{"HS512"}},
+	} {
+		config := Config{JwtAuthAlgo: "HS256", JwtParser: parser, SignKey: TokenSecret}
+		jwtGo := NewJWTAuth(config).(*jwtAuth)
+		native := NewJWTAuth(config, WithNativeHMAC()).(*jwtAuth)
+		if _, ok := native.verifier().(hmacVerifier); !ok {
+			t.Fatalf("WithNativeHMAC should select the native verifier")
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				wantToken, wantErr := jwtGo.verifyToken(context.Background(), tt.token)
+				gotToken, gotErr := native.verifyToken(context.Background(), tt.token)
+
+				if (wantErr == nil) != (gotErr == nil) {
+					t.Fatalf("native error = %v, jwt-go error = %v", gotErr, wantErr)
+				}
+				if wantVErr, ok := wantErr.(*jwt.ValidationError); ok {
+					gotVErr, ok := gotErr.(*jwt.ValidationError)
+					if !ok || gotVErr.Errors != wantVErr.Errors {
+						t.Fatalf("native error = %#v, jwt-go error = %#v", gotErr, wantErr)
+					}
+				} else if gotErr != wantErr {
+					t.Fatalf("native error = %v, jwt-go error = %v", gotErr, wantErr)
+				}
+				if wantToken == nil || gotToken == nil {
+					if wantToken != gotToken {
+						t.Fatalf("native token = %v, jwt-go token = %v", gotToken, wantToken)
+					}
+					return
+				}
+				if gotToken.Valid != wantToken.Valid || gotToken.Method != wantToken.Method ||
+					!reflect.DeepEqual(gotToken.Header, wantToken.Header) ||
+					!reflect.DeepEqual(gotToken.Claims, wantToken.Claims) {
+					t.Fatalf("native token = %+v, jwt-go token = %+v", gotToken, wantToken)
+				}
+			})
+		}
+	}
+}
+
+// tamperClaims replaces the claims segment of a token, keeping its signature.
+func tamperClaims(token string) string {
+	parts := strings.Split(token, ".")
+	parts[1] = strings.TrimRight(jwt.EncodeSegment([]byte(`{"uid":"admin"}`)), "=")
+	return strings.Join(parts, ".")
+}
+
+func TestUnsupportedCritHeader(t *testing.T) {
+	token := func(header string, payload string) string {
+		h := base64.RawURLEncoding.EncodeToString([]byte(header))
+		mac := hmac.New(sha256.New, TokenSecret)
+		mac.Write([]byte(h + "." + payload))
+		return h + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"uid":"123","roles":[]}`))
+
+	tests := []struct {
+		name        string
+		tokenString string
+	}{
+		// RFC 7797 unencoded payload, detached: the payload segment is empty
+		{"detached b64 false", token(`{"alg":"HS256","b64":false,"crit":["b64"]}`, "")},
+		{"b64 false", token(`{"alg":"HS256","b64":false,"crit":["b64"]}`, `{"uid":"123","roles":[]}`)},
+		{"b64 false without crit", token(`{"alg":"HS256","b64":false}`, payload)},
+		{"unknown crit extension", token(`{"alg":"HS256","crit":["exp"],"exp":1}`, payload)},
+	}
+	for _, native := range []bool{false, true} {
+		var opts []Option
+		if native {
+			opts = append(opts, WithNativeHMAC())
+		}
+		ja := NewJWTAuth(Config{JwtAuthAlgo: "HS256", JwtParser: &jwt.Parser{}, SignKey: TokenSecret}, opts...)
+		for _, tt := range tests {
+			if _, err := ja.Decode(tt.tokenString); err != ErrUnsupportedCritHeader {
+				t.Errorf("native HMAC %v, %s: Decode() error = %v, want %v", native, tt.name, err, ErrUnsupportedCritHeader)
+			}
+		}
+		if _, err := ja.Decode(token(`{"alg":"HS256","typ":"JWT","b64":true}`, payload)); err != nil {
+			t.Errorf("native HMAC %v, b64 true: Decode() error = %v", native, err)
+		}
+	}
+}
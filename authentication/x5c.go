@@ -0,0 +1,58 @@
+package authentication
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// WithX5CTrustPool verifies tokens carrying a "x5c" certificate chain header with the
+// public key of the leaf certificate, once the chain is validated against the trust
+// anchors in pool. Tokens whose chain doesn't validate fail with ErrX5CChainInvalid,
+// tokens without the header are verified with the configured key as before.
+func WithX5CTrustPool(pool *x509.CertPool) Option {
+	return func(ja *jwtAuth) {
+		ja.x5cPool = pool
+	}
+}
+
+// x5cKey returns the public key of the leaf certificate of the validated "x5c" chain
+// of the token, or false if the token doesn't carry one.
+func (ja *jwtAuth) x5cKey(t *jwt.Token) (interface{}, bool, error) {
+	v, ok := t.Header["x5c"]
+	if !ok {
+		return nil, false, nil
+	}
+	encoded, ok := toStringSlice(v)
+	if !ok || len(encoded) == 0 {
+		return nil, true, fmt.Errorf("%w: malformed x5c header", ErrX5CChainInvalid)
+	}
+
+	certs := make([]*x509.Certificate, len(encoded))
+	for i, e := range encoded {
+		// x5c carries standard, not url, base64 encoded DER certificates
+		der, err := base64.StdEncoding.DecodeString(e)
+		if err != nil {
+			return nil, true, fmt.Errorf("%w: %v", ErrX5CChainInvalid, err)
+		}
+		if certs[i], err = x509.ParseCertificate(der); err != nil {
+			return nil, true, fmt.Errorf("%w: %v", ErrX5CChainInvalid, err)
+		}
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         ja.x5cPool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, true, fmt.Errorf("%w: %v", ErrX5CChainInvalid, err)
+	}
+	return certs[0].PublicKey, true, nil
+}
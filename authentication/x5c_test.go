@@ -0,0 +1,102 @@
+package authentication
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestX5CTrustPool(t *testing.T) {
+	ca, caKey := newTestCert(t, "partner root", nil, nil)
+	leaf, leafKey := newTestCert(t, "partner signer", ca, caKey)
+	other, _ := newTestCert(t, "other root", nil, nil)
+
+	trusted := x509.NewCertPool()
+	trusted.AddCert(ca)
+	untrusted := x509.NewCertPool()
+	untrusted.AddCert(other)
+
+	token := func(chain ...*x509.Certificate) string {
+		tok := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"uid": "123", "roles": []string{}})
+		x5c := make([]string, len(chain))
+		for i, cert := range chain {
+			x5c[i] = base64.StdEncoding.EncodeToString(cert.Raw)
+		}
+		tok.Header["x5c"] = x5c
+		tokenString, err := tok.SignedString(leafKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokenString
+	}
+
+	tests := []struct {
+		name        string
+		pool        *x509.CertPool
+		tokenString string
+		wantErr     error
+	}{
+		{"trusted chain", trusted, token(leaf, ca), nil},
+		{"trusted leaf only", trusted, token(leaf), nil},
+		{"untrusted chain", untrusted, token(leaf, ca), ErrX5CChainInvalid},
+		{"chain of another key", trusted, token(ca), jwt.ErrECDSAVerification},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ja := NewJWTAuth(Config{JwtAuthAlgo: "ES256", JwtParser: &jwt.Parser{}}, WithX5CTrustPool(tt.pool)).(*jwtAuth)
+			if err := ja.Validate(); err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			_, err := ja.verifyToken(context.Background(), tt.tokenString)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("verifyToken() error = %v", err)
+				}
+				return
+			}
+			verr, _ := err.(*jwt.ValidationError)
+			if !errors.Is(err, tt.wantErr) && (verr == nil || verr.Inner != tt.wantErr) {
+				t.Fatalf("verifyToken() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// newTestCert returns a CA certificate signed by parent, or self-signed if parent is nil.
+func newTestCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}